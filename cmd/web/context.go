@@ -9,4 +9,7 @@ const (
 	
 	// nonceContextKey is the key used to store the nonce in the context.
 	nonceContextKey = contextKey("nonce")
+	
+	// userContextKey is the key used to store the authenticated user in the context.
+	userContextKey = contextKey("user")
 )
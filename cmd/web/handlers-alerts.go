@@ -0,0 +1,154 @@
+package main
+
+import (
+	"errors"
+	"log/slog"
+	"net/http"
+	"strings"
+	"time"
+
+	"HomeIoT/internal/data"
+)
+
+// alerts handler - renders the alarm state and the alert recipients
+func (app *application) alerts(w http.ResponseWriter, r *http.Request) {
+
+	if !app.authorizePage(w, r, data.ACTION_COMMAND, 0) {
+		return
+	}
+
+	form := alertRecipientForm{Cooldown: int(data.DefaultAlertCooldown / time.Minute)}
+	app.renderAlerts(w, r, http.StatusOK, form)
+}
+
+// alertsArmPost handler - arms the home, so that the presence detectors trigger alerts
+func (app *application) alertsArmPost(w http.ResponseWriter, r *http.Request) {
+	app.setArmed(w, r, true)
+}
+
+// alertsDisarmPost handler - disarms the home
+func (app *application) alertsDisarmPost(w http.ResponseWriter, r *http.Request) {
+	app.setArmed(w, r, false)
+}
+
+// alertRecipientCreatePost handler - adds an alert recipient
+func (app *application) alertRecipientCreatePost(w http.ResponseWriter, r *http.Request) {
+
+	if !app.authorizePage(w, r, data.ACTION_CONFIGURE, 0) {
+		return
+	}
+
+	// retrieving the form data
+	var form alertRecipientForm
+	err := app.decodePostForm(r, &form)
+	if err != nil {
+		app.clientError(w, r, http.StatusBadRequest)
+		return
+	}
+
+	recipient := &data.AlertRecipient{
+		Email:    strings.TrimSpace(form.Email),
+		Cooldown: time.Duration(form.Cooldown) * time.Minute,
+	}
+
+	// checking the data from the user
+	data.ValidateAlertRecipient(&form.Validator, recipient)
+	if !form.Valid() {
+		app.renderAlerts(w, r, http.StatusUnprocessableEntity, form)
+		return
+	}
+
+	err = app.Models.Alert.InsertRecipient(recipient)
+	if err != nil {
+		switch {
+		case errors.Is(err, data.ErrDuplicateRecipient):
+			form.AddFieldError("email", "This address already receives the alerts")
+			app.renderAlerts(w, r, http.StatusUnprocessableEntity, form)
+		default:
+			app.serverError(w, r, err)
+		}
+		return
+	}
+
+	app.sessionManager.Put(r.Context(), "flash", "The recipient has been added successfully!")
+	http.Redirect(w, r, "/alerts", http.StatusSeeOther)
+}
+
+// alertRecipientDeletePost handler - removes an alert recipient
+func (app *application) alertRecipientDeletePost(w http.ResponseWriter, r *http.Request) {
+
+	if !app.authorizePage(w, r, data.ACTION_CONFIGURE, 0) {
+		return
+	}
+
+	id, err := getPathID(r)
+	if err != nil {
+		app.clientError(w, r, http.StatusNotFound)
+		return
+	}
+
+	err = app.Models.Alert.DeleteRecipient(uint(id))
+	if err != nil {
+		switch {
+		case errors.Is(err, data.ErrRecordNotFound):
+			app.clientError(w, r, http.StatusNotFound)
+		default:
+			app.serverError(w, r, err)
+		}
+		return
+	}
+
+	app.sessionManager.Put(r.Context(), "flash", "The recipient has been removed.")
+	http.Redirect(w, r, "/alerts", http.StatusSeeOther)
+}
+
+// setArmed arms or disarms the home, for the users allowed to send commands.
+func (app *application) setArmed(w http.ResponseWriter, r *http.Request, armed bool) {
+
+	if !app.authorizePage(w, r, data.ACTION_COMMAND, 0) {
+		return
+	}
+
+	user := app.contextGetUser(r)
+	err := app.Models.Alert.SetArmed(armed, user.ID)
+	if err != nil {
+		app.serverError(w, r, err)
+		return
+	}
+
+	flash := "The home is now disarmed."
+	if armed {
+		flash = "The home is now armed."
+	}
+	app.logger.Info("alarm state changed", slog.Bool("armed", armed), slog.Uint64("user", uint64(user.ID)))
+
+	app.sessionManager.Put(r.Context(), "flash", flash)
+	http.Redirect(w, r, "/alerts", http.StatusSeeOther)
+}
+
+// renderAlerts renders the alerts page with the recipient form.
+func (app *application) renderAlerts(w http.ResponseWriter, r *http.Request, status int, form alertRecipientForm) {
+	alarm, err := app.Models.Alert.GetAlarm()
+	if err != nil {
+		app.serverError(w, r, err)
+		return
+	}
+
+	recipients, err := app.Models.Alert.GetRecipients()
+	if err != nil {
+		app.serverError(w, r, err)
+		return
+	}
+
+	// retrieving basic template data
+	tmplData := app.newTemplateData(r)
+	tmplData.Title = "Home IoT - Alerts"
+	tmplData.Alarm = alarm
+	tmplData.AlertRecipients = recipients
+	tmplData.Form = form
+	tmplData.FieldErrors = form.FieldErrors
+	tmplData.NonFieldErrors = form.NonFieldErrors
+
+	// rendering the template
+	app.render(w, r, status, "alerts.tmpl", tmplData)
+}
@@ -0,0 +1,1013 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"net/http"
+	"slices"
+	"strconv"
+	"time"
+
+	"HomeIoT/internal/data"
+	"HomeIoT/internal/validator"
+
+	"github.com/alexedwards/flow"
+)
+
+// ###########################################################
+// #					   LOCATIONS						 #
+// ###########################################################
+
+// listLocationsAPI handler - lists every location
+func (app *application) listLocationsAPI(w http.ResponseWriter, r *http.Request) {
+	locations, err := app.Models.Location.GetAll()
+	if err != nil {
+		app.serverErrorJSON(w, r, err)
+		return
+	}
+
+	// only listing the locations the user may view
+	all, viewable, err := app.Models.Policy.ViewableLocations(app.contextGetUser(r))
+	if err != nil {
+		app.serverErrorJSON(w, r, err)
+		return
+	}
+
+	res := make([]locationResponse, 0, len(locations))
+	for _, location := range locations {
+		if !all && !slices.Contains(viewable, location.ID) {
+			continue
+		}
+		res = append(res, newLocationResponse(location))
+	}
+
+	err = app.writeJSON(w, http.StatusOK, envelope{"locations": res}, nil)
+	if err != nil {
+		app.serverErrorJSON(w, r, err)
+	}
+}
+
+// showLocationAPI handler - retrieves a single location
+func (app *application) showLocationAPI(w http.ResponseWriter, r *http.Request) {
+	location, ok := app.locationFromPath(w, r, data.ACTION_VIEW)
+	if !ok {
+		return
+	}
+
+	err := app.writeJSON(w, http.StatusOK, envelope{"location": newLocationResponse(location)}, nil)
+	if err != nil {
+		app.serverErrorJSON(w, r, err)
+	}
+}
+
+// createLocationAPI handler - creates a new location
+func (app *application) createLocationAPI(w http.ResponseWriter, r *http.Request) {
+	if !app.authorize(w, r, data.ACTION_CONFIGURE, 0) {
+		return
+	}
+
+	var input struct {
+		Name string `json:"name"`
+		Type string `json:"type"`
+	}
+
+	err := app.readJSON(w, r, &input)
+	if err != nil {
+		app.badRequestJSON(w, r, err)
+		return
+	}
+
+	location := &data.Location{Name: input.Name, Type: input.Type}
+
+	v := validator.New()
+	data.ValidateLocation(v, location)
+	if !app.checkLocationName(w, r, v, location) {
+		return
+	}
+	if !v.Valid() {
+		app.failedValidationJSON(w, r, v)
+		return
+	}
+
+	err = app.Models.Location.Insert(location)
+	if err != nil {
+		app.serverErrorJSON(w, r, err)
+		return
+	}
+
+	headers := make(http.Header)
+	headers.Set("Location", fmt.Sprintf("/api/v1/locations/%d", location.ID))
+
+	err = app.writeJSON(w, http.StatusCreated, envelope{"location": newLocationResponse(location)}, headers)
+	if err != nil {
+		app.serverErrorJSON(w, r, err)
+	}
+}
+
+// updateLocationAPI handler - updates the name and/or type of a location
+func (app *application) updateLocationAPI(w http.ResponseWriter, r *http.Request) {
+	location, ok := app.locationFromPath(w, r, data.ACTION_CONFIGURE)
+	if !ok {
+		return
+	}
+
+	var input struct {
+		Name *string `json:"name"`
+		Type *string `json:"type"`
+	}
+
+	err := app.readJSON(w, r, &input)
+	if err != nil {
+		app.badRequestJSON(w, r, err)
+		return
+	}
+
+	if input.Name != nil {
+		location.Name = *input.Name
+	}
+	if input.Type != nil {
+		location.Type = *input.Type
+	}
+
+	v := validator.New()
+	data.ValidateLocation(v, location)
+	if input.Name != nil && !app.checkLocationName(w, r, v, location) {
+		return
+	}
+	if !v.Valid() {
+		app.failedValidationJSON(w, r, v)
+		return
+	}
+
+	if input.Name != nil {
+		err = app.Models.Location.UpdateName(location)
+		if err != nil {
+			app.serverErrorJSON(w, r, err)
+			return
+		}
+	}
+	if input.Type != nil {
+		err = app.Models.Location.UpdateType(location)
+		if err != nil {
+			app.serverErrorJSON(w, r, err)
+			return
+		}
+	}
+
+	err = app.writeJSON(w, http.StatusOK, envelope{"location": newLocationResponse(location)}, nil)
+	if err != nil {
+		app.serverErrorJSON(w, r, err)
+	}
+}
+
+// deleteLocationAPI handler - deletes an empty location
+func (app *application) deleteLocationAPI(w http.ResponseWriter, r *http.Request) {
+	location, ok := app.locationFromPath(w, r, data.ACTION_CONFIGURE)
+	if !ok {
+		return
+	}
+
+	err := app.Models.Location.Delete(location.ID)
+	if err != nil {
+		switch {
+		case errors.Is(err, data.ErrLocationNotEmpty):
+			app.errorJSON(w, r, http.StatusConflict, "the location still contains devices")
+		default:
+			app.serverErrorJSON(w, r, err)
+		}
+		return
+	}
+
+	err = app.writeJSON(w, http.StatusOK, envelope{"message": "location successfully deleted"}, nil)
+	if err != nil {
+		app.serverErrorJSON(w, r, err)
+	}
+}
+
+// ###########################################################
+// #						DEVICES							 #
+// ###########################################################
+
+// listDevicesAPI handler - lists every device with its location and modules
+func (app *application) listDevicesAPI(w http.ResponseWriter, r *http.Request) {
+	devices, err := app.Models.Device.GetAll()
+	if err != nil {
+		app.serverErrorJSON(w, r, err)
+		return
+	}
+
+	// only listing the devices the user may view
+	devices, err = app.Models.Policy.FilterDevices(app.contextGetUser(r), devices)
+	if err != nil {
+		app.serverErrorJSON(w, r, err)
+		return
+	}
+
+	res := make([]deviceResponse, 0, len(devices))
+	for _, device := range devices {
+		res = append(res, app.newDeviceResponse(device))
+	}
+
+	err = app.writeJSON(w, http.StatusOK, envelope{"devices": res}, nil)
+	if err != nil {
+		app.serverErrorJSON(w, r, err)
+	}
+}
+
+// showDeviceAPI handler - retrieves a single device
+func (app *application) showDeviceAPI(w http.ResponseWriter, r *http.Request) {
+	device, ok := app.deviceFromPath(w, r, data.ACTION_VIEW)
+	if !ok {
+		return
+	}
+
+	err := app.writeJSON(w, http.StatusOK, envelope{"device": app.newDeviceResponse(device)}, nil)
+	if err != nil {
+		app.serverErrorJSON(w, r, err)
+	}
+}
+
+// createDeviceAPI handler - registers a new device in an existing location
+func (app *application) createDeviceAPI(w http.ResponseWriter, r *http.Request) {
+	if !app.authorize(w, r, data.ACTION_CONFIGURE, 0) {
+		return
+	}
+
+	var input struct {
+		ID         string `json:"id"`
+		Name       string `json:"name"`
+		Type       string `json:"type"`
+		LocationID uint   `json:"location_id"`
+	}
+
+	err := app.readJSON(w, r, &input)
+	if err != nil {
+		app.badRequestJSON(w, r, err)
+		return
+	}
+
+	device := &data.Device{ID: input.ID, Name: input.Name, Type: input.Type, LocationID: input.LocationID}
+
+	v := validator.New()
+	data.ValidateDevice(v, device)
+	v.CheckID(int(input.LocationID), "location_id")
+
+	if v.Valid() {
+		exists, err := app.Models.Device.Exists(device.ID)
+		if err != nil {
+			app.serverErrorJSON(w, r, err)
+			return
+		}
+		v.Check(!exists, "id", "a device with this id already exists")
+
+		location, err := app.Models.Location.GetByID(input.LocationID)
+		switch {
+		case errors.Is(err, data.ErrRecordNotFound):
+			v.AddFieldError("location_id", "location not found")
+		case err != nil:
+			app.serverErrorJSON(w, r, err)
+			return
+		default:
+			device.Location = *location
+		}
+	}
+
+	if !v.Valid() {
+		app.failedValidationJSON(w, r, v)
+		return
+	}
+
+	err = app.Models.Device.Insert(device)
+	if err != nil {
+		app.serverErrorJSON(w, r, err)
+		return
+	}
+
+	headers := make(http.Header)
+	headers.Set("Location", fmt.Sprintf("/api/v1/devices/%s", device.ID))
+
+	err = app.writeJSON(w, http.StatusCreated, envelope{"device": app.newDeviceResponse(device)}, headers)
+	if err != nil {
+		app.serverErrorJSON(w, r, err)
+	}
+}
+
+// updateDeviceAPI handler - renames a device and/or moves it to another location
+func (app *application) updateDeviceAPI(w http.ResponseWriter, r *http.Request) {
+	device, ok := app.deviceFromPath(w, r, data.ACTION_CONFIGURE)
+	if !ok {
+		return
+	}
+
+	var input struct {
+		Name       *string `json:"name"`
+		LocationID *uint   `json:"location_id"`
+	}
+
+	err := app.readJSON(w, r, &input)
+	if err != nil {
+		app.badRequestJSON(w, r, err)
+		return
+	}
+
+	if input.Name != nil {
+		device.Name = *input.Name
+	}
+
+	v := validator.New()
+	data.ValidateDevice(v, device)
+
+	if input.LocationID != nil {
+		v.CheckID(int(*input.LocationID), "location_id")
+		if v.Valid() && *input.LocationID != device.LocationID {
+			location, err := app.Models.Location.GetByID(*input.LocationID)
+			switch {
+			case errors.Is(err, data.ErrRecordNotFound):
+				v.AddFieldError("location_id", "location not found")
+			case err != nil:
+				app.serverErrorJSON(w, r, err)
+				return
+			default:
+				device.Location = *location
+			}
+		}
+	}
+
+	if !v.Valid() {
+		app.failedValidationJSON(w, r, v)
+		return
+	}
+
+	if input.Name != nil {
+		err = app.Models.Device.UpdateName(device)
+		if err != nil {
+			app.serverErrorJSON(w, r, err)
+			return
+		}
+	}
+
+	if input.LocationID != nil && *input.LocationID != device.LocationID {
+		err = app.Models.Device.UpdateLocation(r.Context(), device)
+		if err != nil && !errors.Is(err, data.ErrPublishQueued) {
+			app.publishErrorJSON(w, r, err)
+			return
+		}
+		device.LocationID = device.Location.ID
+	}
+
+	err = app.writeJSON(w, http.StatusOK, envelope{"device": app.newDeviceResponse(device)}, nil)
+	if err != nil {
+		app.serverErrorJSON(w, r, err)
+	}
+}
+
+// deleteDeviceAPI handler - deletes a device with its modules and data
+func (app *application) deleteDeviceAPI(w http.ResponseWriter, r *http.Request) {
+	device, ok := app.deviceFromPath(w, r, data.ACTION_CONFIGURE)
+	if !ok {
+		return
+	}
+
+	err := app.Models.Device.Delete(device.ID)
+	if err != nil {
+		app.serverErrorJSON(w, r, err)
+		return
+	}
+
+	err = app.writeJSON(w, http.StatusOK, envelope{"message": "device successfully deleted"}, nil)
+	if err != nil {
+		app.serverErrorJSON(w, r, err)
+	}
+}
+
+// resetDeviceAPI handler - asks a device to restart its startup sequence
+func (app *application) resetDeviceAPI(w http.ResponseWriter, r *http.Request) {
+	device, ok := app.deviceFromPath(w, r, data.ACTION_CONFIGURE)
+	if !ok {
+		return
+	}
+
+	message := "reset sent"
+	err := app.Models.Device.Reset(r.Context(), device)
+	if err != nil {
+		if !errors.Is(err, data.ErrPublishQueued) {
+			app.publishErrorJSON(w, r, err)
+			return
+		}
+		message = "broker unreachable, reset queued"
+	}
+
+	err = app.writeJSON(w, http.StatusAccepted, envelope{"message": message}, nil)
+	if err != nil {
+		app.serverErrorJSON(w, r, err)
+	}
+}
+
+// ###########################################################
+// #						MODULES							 #
+// ###########################################################
+
+// listModulesAPI handler - lists the modules of a device
+func (app *application) listModulesAPI(w http.ResponseWriter, r *http.Request) {
+	device, ok := app.deviceFromPath(w, r, data.ACTION_VIEW)
+	if !ok {
+		return
+	}
+
+	res := make([]moduleResponse, 0, len(device.Modules))
+	for _, module := range device.Modules {
+		res = append(res, app.newModuleResponse(module))
+	}
+
+	err := app.writeJSON(w, http.StatusOK, envelope{"modules": res}, nil)
+	if err != nil {
+		app.serverErrorJSON(w, r, err)
+	}
+}
+
+// showModuleAPI handler - retrieves a single module
+func (app *application) showModuleAPI(w http.ResponseWriter, r *http.Request) {
+	module, ok := app.moduleFromPath(w, r, data.ACTION_VIEW)
+	if !ok {
+		return
+	}
+
+	err := app.writeJSON(w, http.StatusOK, envelope{"module": app.newModuleResponse(*module)}, nil)
+	if err != nil {
+		app.serverErrorJSON(w, r, err)
+	}
+}
+
+// createModuleAPI handler - adds a module to a device
+func (app *application) createModuleAPI(w http.ResponseWriter, r *http.Request) {
+	device, ok := app.deviceFromPath(w, r, data.ACTION_CONFIGURE)
+	if !ok {
+		return
+	}
+
+	var input struct {
+		Name  string `json:"name"`
+		Value string `json:"value"`
+	}
+
+	err := app.readJSON(w, r, &input)
+	if err != nil {
+		app.badRequestJSON(w, r, err)
+		return
+	}
+
+	module := &data.Module{DeviceID: device.ID, Name: input.Name, Value: input.Value}
+
+	v := validator.New()
+	data.ValidateModule(v, module)
+	if !app.checkModuleName(w, r, v, module) {
+		return
+	}
+	if !v.Valid() {
+		app.failedValidationJSON(w, r, v)
+		return
+	}
+
+	err = app.Models.Module.Insert(module)
+	if err != nil {
+		app.serverErrorJSON(w, r, err)
+		return
+	}
+
+	headers := make(http.Header)
+	headers.Set("Location", fmt.Sprintf("/api/v1/modules/%d", module.ID))
+
+	err = app.writeJSON(w, http.StatusCreated, envelope{"module": app.newModuleResponse(*module)}, headers)
+	if err != nil {
+		app.serverErrorJSON(w, r, err)
+	}
+}
+
+// updateModuleAPI handler - renames a module and/or sends it a new value
+func (app *application) updateModuleAPI(w http.ResponseWriter, r *http.Request) {
+	module, ok := app.moduleFromPath(w, r, data.ACTION_VIEW)
+	if !ok {
+		return
+	}
+
+	var input struct {
+		Name  *string `json:"name"`
+		Value any     `json:"value"`
+	}
+
+	err := app.readJSON(w, r, &input)
+	if err != nil {
+		app.badRequestJSON(w, r, err)
+		return
+	}
+
+	wait, err := app.readWait(r)
+	if err != nil {
+		app.badRequestJSON(w, r, err)
+		return
+	}
+
+	// renaming a module is a configuration, sending it a value is a command
+	device, err := app.Models.Device.GetByID(module.DeviceID)
+	if err != nil {
+		app.serverErrorJSON(w, r, err)
+		return
+	}
+	if input.Name != nil && !app.authorize(w, r, data.ACTION_CONFIGURE, device.LocationID) {
+		return
+	}
+	if input.Value != nil && !app.authorize(w, r, data.ACTION_COMMAND, device.LocationID) {
+		return
+	}
+
+	v := validator.New()
+
+	if input.Name != nil {
+		module.Name = *input.Name
+		data.ValidateModule(v, &data.Module{Name: module.Name})
+		if !app.checkModuleName(w, r, v, module) {
+			return
+		}
+	}
+
+	// the value is checked against the module, renamed or not, before anything is written
+	if input.Value != nil {
+		_, err = app.Models.ModuleModels.Encode(*module, input.Value)
+		switch {
+		case err == nil:
+		case errors.Is(err, data.ErrInvalidValue):
+			v.AddFieldError("value", fmt.Sprintf("invalid value for module %s", module.Name))
+		case errors.Is(err, data.ErrReadOnlyModule):
+			v.AddFieldError("value", fmt.Sprintf("module %s is read-only", module.Name))
+		case errors.Is(err, data.ErrUnknownModule):
+			v.AddFieldError("value", fmt.Sprintf("module %s cannot be commanded", module.Name))
+		default:
+			app.serverErrorJSON(w, r, err)
+			return
+		}
+	}
+
+	if !v.Valid() {
+		app.failedValidationJSON(w, r, v)
+		return
+	}
+
+	if input.Name != nil {
+		err = app.Models.Module.UpdateName(module)
+		if err != nil {
+			app.serverErrorJSON(w, r, err)
+			return
+		}
+	}
+
+	// the value is not written directly: it is sent to the device, which acknowledges it and reports it back
+	status, res := http.StatusOK, envelope{"module": app.newModuleResponse(*module)}
+	if input.Value != nil {
+		command, err := app.Models.ModuleModels.Send(r.Context(), *module, input.Value)
+		if err != nil && !errors.Is(err, data.ErrPublishQueued) {
+			app.publishErrorJSON(w, r, err)
+			return
+		}
+
+		// the value is sent when the broker is reachable again if queued
+		if err == nil {
+			command, err = app.waitCommand(r, command, wait)
+			if err != nil {
+				app.serverErrorJSON(w, r, err)
+				return
+			}
+		}
+		status, res["command"] = commandStatus(command), newCommandResponse(command)
+	}
+
+	err = app.writeJSON(w, status, res, nil)
+	if err != nil {
+		app.serverErrorJSON(w, r, err)
+	}
+}
+
+// showCommandAPI handler - returns the state of a command, waiting for its acknowledgement with the "wait" query parameter
+func (app *application) showCommandAPI(w http.ResponseWriter, r *http.Request) {
+	wait, err := app.readWait(r)
+	if err != nil {
+		app.badRequestJSON(w, r, err)
+		return
+	}
+
+	command, err := app.Models.Command.Get(flow.Param(r.Context(), "id"))
+	if err != nil {
+		switch {
+		case errors.Is(err, data.ErrRecordNotFound):
+			app.notFoundJSON(w, r, "command not found")
+		default:
+			app.serverErrorJSON(w, r, err)
+		}
+		return
+	}
+
+	if !app.authorize(w, r, data.ACTION_VIEW, command.LocationID) {
+		return
+	}
+
+	command, err = app.waitCommand(r, command, wait)
+	if err != nil {
+		app.serverErrorJSON(w, r, err)
+		return
+	}
+
+	err = app.writeJSON(w, http.StatusOK, envelope{"command": newCommandResponse(command)}, nil)
+	if err != nil {
+		app.serverErrorJSON(w, r, err)
+	}
+}
+
+// deleteModuleAPI handler - removes a module from its device
+func (app *application) deleteModuleAPI(w http.ResponseWriter, r *http.Request) {
+	module, ok := app.moduleFromPath(w, r, data.ACTION_CONFIGURE)
+	if !ok {
+		return
+	}
+
+	err := app.Models.Module.Delete(module.ID)
+	if err != nil {
+		app.serverErrorJSON(w, r, err)
+		return
+	}
+
+	err = app.writeJSON(w, http.StatusOK, envelope{"message": "module successfully deleted"}, nil)
+	if err != nil {
+		app.serverErrorJSON(w, r, err)
+	}
+}
+
+// ###########################################################
+// #						HISTORY							 #
+// ###########################################################
+
+// moduleHistoryAPI handler - retrieves the readings of a device module over a time range
+func (app *application) moduleHistoryAPI(w http.ResponseWriter, r *http.Request) {
+	device, ok := app.deviceFromPath(w, r, data.ACTION_VIEW)
+	if !ok {
+		return
+	}
+
+	qs := r.URL.Query()
+	v := validator.New()
+
+	query := data.HistoryQuery{
+		DeviceID:   device.ID,
+		ModuleName: flow.Param(r.Context(), "module"),
+		To:         time.Now(),
+	}
+
+	// reading the optional time range, defaulting to the last 24 hours
+	if to := qs.Get("to"); to != "" {
+		t, err := time.Parse(time.RFC3339, to)
+		v.Check(err == nil, "to", "must be an RFC 3339 date")
+		query.To = t
+	}
+	query.From = query.To.Add(-24 * time.Hour)
+	if from := qs.Get("from"); from != "" {
+		t, err := time.Parse(time.RFC3339, from)
+		v.Check(err == nil, "from", "must be an RFC 3339 date")
+		query.From = t
+	}
+
+	// reading the optional bucket size
+	if bucket := qs.Get("bucket"); bucket != "" {
+		d, err := time.ParseDuration(bucket)
+		v.Check(err == nil, "bucket", "must be a duration such as 30s, 5m or 1h")
+		query.Bucket = d
+	}
+
+	if v.Valid() {
+		data.ValidateHistoryQuery(v, &query)
+	}
+	if !v.Valid() {
+		app.failedValidationJSON(w, r, v)
+		return
+	}
+
+	if !slices.ContainsFunc(device.Modules, func(module data.Module) bool { return module.Name == query.ModuleName }) {
+		app.notFoundJSON(w, r, fmt.Sprintf("module %s not found on device %s", query.ModuleName, device.ID))
+		return
+	}
+
+	history, err := app.Models.Data.History(query)
+	if err != nil {
+		app.serverErrorJSON(w, r, err)
+		return
+	}
+
+	err = app.writeJSON(w, http.StatusOK, envelope{"history": history}, nil)
+	if err != nil {
+		app.serverErrorJSON(w, r, err)
+	}
+}
+
+// ###########################################################
+// #					 USERS & GRANTS						 #
+// ###########################################################
+
+// listUsersAPI handler - lists every user with their role
+func (app *application) listUsersAPI(w http.ResponseWriter, r *http.Request) {
+	if !app.authorize(w, r, data.ACTION_CONFIGURE, 0) {
+		return
+	}
+
+	users, err := app.Models.User.GetAll()
+	if err != nil {
+		app.serverErrorJSON(w, r, err)
+		return
+	}
+
+	res := make([]userResponse, 0, len(users))
+	for _, user := range users {
+		res = append(res, newUserResponse(user))
+	}
+
+	err = app.writeJSON(w, http.StatusOK, envelope{"users": res}, nil)
+	if err != nil {
+		app.serverErrorJSON(w, r, err)
+	}
+}
+
+// updateUserRoleAPI handler - changes the role of a user
+func (app *application) updateUserRoleAPI(w http.ResponseWriter, r *http.Request) {
+	user, ok := app.userFromPath(w, r)
+	if !ok {
+		return
+	}
+
+	var input struct {
+		Role string `json:"role"`
+	}
+
+	err := app.readJSON(w, r, &input)
+	if err != nil {
+		app.badRequestJSON(w, r, err)
+		return
+	}
+
+	v := validator.New()
+	v.Check(validator.PermittedValue(input.Role, data.Roles...), "role", "must be admin, resident or guest")
+	v.Check(user.ID != app.contextGetUser(r).ID, "role", "you cannot change your own role")
+	if !v.Valid() {
+		app.failedValidationJSON(w, r, v)
+		return
+	}
+
+	user.Role = input.Role
+	err = app.Models.User.UpdateRole(user)
+	if err != nil {
+		app.serverErrorJSON(w, r, err)
+		return
+	}
+
+	err = app.writeJSON(w, http.StatusOK, envelope{"user": newUserResponse(user)}, nil)
+	if err != nil {
+		app.serverErrorJSON(w, r, err)
+	}
+}
+
+// listGrantsAPI handler - lists the locations granted to a user
+func (app *application) listGrantsAPI(w http.ResponseWriter, r *http.Request) {
+	user, ok := app.userFromPath(w, r)
+	if !ok {
+		return
+	}
+
+	grants, err := app.Models.Policy.GetGrants(user.ID)
+	if err != nil {
+		app.serverErrorJSON(w, r, err)
+		return
+	}
+
+	res := make([]grantResponse, 0, len(grants))
+	for _, grant := range grants {
+		res = append(res, newGrantResponse(grant))
+	}
+
+	err = app.writeJSON(w, http.StatusOK, envelope{"grants": res}, nil)
+	if err != nil {
+		app.serverErrorJSON(w, r, err)
+	}
+}
+
+// setGrantAPI handler - grants a location to a user, optionally with the right to command its devices
+func (app *application) setGrantAPI(w http.ResponseWriter, r *http.Request) {
+	user, ok := app.userFromPath(w, r)
+	if !ok {
+		return
+	}
+
+	var input struct {
+		LocationID uint `json:"location_id"`
+		CanCommand bool `json:"can_command"`
+	}
+
+	err := app.readJSON(w, r, &input)
+	if err != nil {
+		app.badRequestJSON(w, r, err)
+		return
+	}
+
+	grant := &data.LocationGrant{UserID: user.ID, LocationID: input.LocationID, CanCommand: input.CanCommand}
+
+	v := validator.New()
+	v.CheckID(int(input.LocationID), "location_id")
+	if v.Valid() {
+		location, err := app.Models.Location.GetByID(input.LocationID)
+		switch {
+		case errors.Is(err, data.ErrRecordNotFound):
+			v.AddFieldError("location_id", "location not found")
+		case err != nil:
+			app.serverErrorJSON(w, r, err)
+			return
+		default:
+			grant.Location = *location
+		}
+	}
+	if !v.Valid() {
+		app.failedValidationJSON(w, r, v)
+		return
+	}
+
+	err = app.Models.Policy.SetGrant(grant)
+	if err != nil {
+		app.serverErrorJSON(w, r, err)
+		return
+	}
+
+	err = app.writeJSON(w, http.StatusOK, envelope{"grant": newGrantResponse(grant)}, nil)
+	if err != nil {
+		app.serverErrorJSON(w, r, err)
+	}
+}
+
+// deleteGrantAPI handler - revokes the access of a user to a location
+func (app *application) deleteGrantAPI(w http.ResponseWriter, r *http.Request) {
+	user, ok := app.userFromPath(w, r)
+	if !ok {
+		return
+	}
+
+	locationID, err := strconv.ParseUint(flow.Param(r.Context(), "locationID"), 10, 64)
+	if err != nil {
+		app.notFoundJSON(w, r, "grant not found")
+		return
+	}
+
+	err = app.Models.Policy.DeleteGrant(user.ID, uint(locationID))
+	if err != nil {
+		switch {
+		case errors.Is(err, data.ErrRecordNotFound):
+			app.notFoundJSON(w, r, "grant not found")
+		default:
+			app.serverErrorJSON(w, r, err)
+		}
+		return
+	}
+
+	err = app.writeJSON(w, http.StatusOK, envelope{"message": "grant successfully deleted"}, nil)
+	if err != nil {
+		app.serverErrorJSON(w, r, err)
+	}
+}
+
+// ###########################################################
+// #						HELPERS							 #
+// ###########################################################
+
+// locationFromPath fetches the location matching the id path parameter and checks the user may perform the action on it.
+// It writes the error response and returns false if the location cannot be retrieved or the action is denied.
+func (app *application) locationFromPath(w http.ResponseWriter, r *http.Request, action string) (*data.Location, bool) {
+	id, err := getPathID(r)
+	if err != nil {
+		app.notFoundJSON(w, r, "location not found")
+		return nil, false
+	}
+
+	location, err := app.Models.Location.GetByID(uint(id))
+	if err != nil {
+		switch {
+		case errors.Is(err, data.ErrRecordNotFound):
+			app.notFoundJSON(w, r, fmt.Sprintf("location %d not found", id))
+		default:
+			app.serverErrorJSON(w, r, err)
+		}
+		return nil, false
+	}
+
+	if !app.authorize(w, r, action, location.ID) {
+		return nil, false
+	}
+
+	return location, true
+}
+
+// deviceFromPath fetches the device matching the id path parameter and checks the user may perform the action on its location.
+// It writes the error response and returns false if the device cannot be retrieved or the action is denied.
+func (app *application) deviceFromPath(w http.ResponseWriter, r *http.Request, action string) (*data.Device, bool) {
+	id := flow.Param(r.Context(), "id")
+
+	device, err := app.Models.Device.GetByID(id)
+	if err != nil {
+		switch {
+		case errors.Is(err, data.ErrRecordNotFound):
+			app.notFoundJSON(w, r, fmt.Sprintf("device %s not found", id))
+		default:
+			app.serverErrorJSON(w, r, err)
+		}
+		return nil, false
+	}
+
+	if !app.authorize(w, r, action, device.LocationID) {
+		return nil, false
+	}
+
+	return device, true
+}
+
+// moduleFromPath fetches the module matching the id path parameter and checks the user may perform the action on its location.
+// It writes the error response and returns false if the module cannot be retrieved or the action is denied.
+func (app *application) moduleFromPath(w http.ResponseWriter, r *http.Request, action string) (*data.Module, bool) {
+	id, err := getPathID(r)
+	if err != nil {
+		app.notFoundJSON(w, r, "module not found")
+		return nil, false
+	}
+
+	module, err := app.Models.Module.Get(uint(id))
+	if err != nil {
+		switch {
+		case errors.Is(err, data.ErrRecordNotFound):
+			app.notFoundJSON(w, r, fmt.Sprintf("module %d not found", id))
+		default:
+			app.serverErrorJSON(w, r, err)
+		}
+		return nil, false
+	}
+
+	device, err := app.Models.Device.GetByID(module.DeviceID)
+	if err != nil {
+		app.serverErrorJSON(w, r, err)
+		return nil, false
+	}
+	if !app.authorize(w, r, action, device.LocationID) {
+		return nil, false
+	}
+
+	return module, true
+}
+
+// userFromPath fetches the user matching the id path parameter, for the admins only.
+// It writes the error response and returns false if the user cannot be retrieved or the action is denied.
+func (app *application) userFromPath(w http.ResponseWriter, r *http.Request) (*data.User, bool) {
+	if !app.authorize(w, r, data.ACTION_CONFIGURE, 0) {
+		return nil, false
+	}
+
+	id, err := getPathID(r)
+	if err != nil {
+		app.notFoundJSON(w, r, "user not found")
+		return nil, false
+	}
+
+	user, err := app.Models.User.Get(uint(id))
+	if err != nil {
+		switch {
+		case errors.Is(err, data.ErrRecordNotFound):
+			app.notFoundJSON(w, r, fmt.Sprintf("user %d not found", id))
+		default:
+			app.serverErrorJSON(w, r, err)
+		}
+		return nil, false
+	}
+
+	return user, true
+}
+
+// checkLocationName adds a validation error if another location already uses the same name.
+// It writes a server error and returns false if the check cannot be performed.
+func (app *application) checkLocationName(w http.ResponseWriter, r *http.Request, v *validator.Validator, location *data.Location) bool {
+	exists, err := app.Models.Location.NameExists(location.Name, location.ID)
+	if err != nil {
+		app.serverErrorJSON(w, r, err)
+		return false
+	}
+	v.Check(!exists, "name", "a location with this name already exists")
+	return true
+}
+
+// checkModuleName adds a validation error if the device already has a module with the same name.
+// It writes a server error and returns false if the check cannot be performed.
+func (app *application) checkModuleName(w http.ResponseWriter, r *http.Request, v *validator.Validator, module *data.Module) bool {
+	exists, err := app.Models.Module.NameExists(module.DeviceID, module.Name, module.ID)
+	if err != nil {
+		app.serverErrorJSON(w, r, err)
+		return false
+	}
+	v.Check(!exists, "name", "the device already has this module")
+	return true
+}
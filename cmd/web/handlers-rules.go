@@ -0,0 +1,323 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"net/http"
+	"strings"
+
+	"HomeIoT/internal/data"
+)
+
+// ruleFormBlankRows is the number of empty condition and action rows offered in the rule form.
+const ruleFormBlankRows = 2
+
+// ruleRunsDisplayed is the number of recent runs displayed on the rule page.
+const ruleRunsDisplayed = 20
+
+// rules handler - renders the list of automation rules
+func (app *application) rules(w http.ResponseWriter, r *http.Request) {
+
+	if !app.authorizePage(w, r, data.ACTION_CONFIGURE, 0) {
+		return
+	}
+
+	rules, err := app.Models.Rule.GetAll()
+	if err != nil {
+		app.serverError(w, r, err)
+		return
+	}
+
+	// retrieving basic template data
+	tmplData := app.newTemplateData(r)
+	tmplData.Title = "Home IoT - Automations"
+	tmplData.Rules = rules
+
+	// rendering the template
+	app.render(w, r, http.StatusOK, "rules.tmpl", tmplData)
+}
+
+// ruleCreate handler - renders the form to create an automation rule
+func (app *application) ruleCreate(w http.ResponseWriter, r *http.Request) {
+
+	if !app.authorizePage(w, r, data.ACTION_CONFIGURE, 0) {
+		return
+	}
+
+	// new rules only log what they would do until they are checked
+	form := newRuleForm(&data.Rule{Match: data.MATCH_ALL, Enabled: true, DryRun: true})
+	app.renderRuleForm(w, r, http.StatusOK, form, nil)
+}
+
+// ruleCreatePost handler - creates an automation rule
+func (app *application) ruleCreatePost(w http.ResponseWriter, r *http.Request) {
+
+	if !app.authorizePage(w, r, data.ACTION_CONFIGURE, 0) {
+		return
+	}
+
+	// retrieving the form data
+	var form ruleForm
+	err := app.decodePostForm(r, &form)
+	if err != nil {
+		app.clientError(w, r, http.StatusBadRequest)
+		return
+	}
+
+	rule := &data.Rule{}
+	form.toRule(rule)
+
+	// checking the data from the user
+	data.ValidateRule(&form.Validator, rule)
+	if !form.Valid() {
+		app.failedRuleForm(w, r, form, rule, nil)
+		return
+	}
+
+	err = app.Models.Rule.Insert(rule)
+	if err != nil {
+		app.serverError(w, r, err)
+		return
+	}
+
+	app.sessionManager.Put(r.Context(), "flash", "The rule has been created successfully!")
+	http.Redirect(w, r, fmt.Sprintf("/rules/%d", rule.ID), http.StatusSeeOther)
+}
+
+// ruleEdit handler - renders the form to edit an automation rule, with its recent runs
+func (app *application) ruleEdit(w http.ResponseWriter, r *http.Request) {
+
+	if !app.authorizePage(w, r, data.ACTION_CONFIGURE, 0) {
+		return
+	}
+
+	rule, ok := app.ruleFromPath(w, r)
+	if !ok {
+		return
+	}
+
+	app.renderRuleForm(w, r, http.StatusOK, newRuleForm(rule), rule)
+}
+
+// ruleEditPost handler - updates an automation rule
+func (app *application) ruleEditPost(w http.ResponseWriter, r *http.Request) {
+
+	if !app.authorizePage(w, r, data.ACTION_CONFIGURE, 0) {
+		return
+	}
+
+	rule, ok := app.ruleFromPath(w, r)
+	if !ok {
+		return
+	}
+
+	// retrieving the form data
+	var form ruleForm
+	err := app.decodePostForm(r, &form)
+	if err != nil {
+		app.clientError(w, r, http.StatusBadRequest)
+		return
+	}
+
+	form.toRule(rule)
+
+	// checking the data from the user
+	data.ValidateRule(&form.Validator, rule)
+	if !form.Valid() {
+		app.failedRuleForm(w, r, form, rule, rule)
+		return
+	}
+
+	err = app.Models.Rule.Update(rule)
+	if err != nil {
+		app.serverError(w, r, err)
+		return
+	}
+
+	app.sessionManager.Put(r.Context(), "flash", "The rule has been updated successfully!")
+	http.Redirect(w, r, fmt.Sprintf("/rules/%d", rule.ID), http.StatusSeeOther)
+}
+
+// ruleDeletePost handler - deletes an automation rule and its runs
+func (app *application) ruleDeletePost(w http.ResponseWriter, r *http.Request) {
+
+	if !app.authorizePage(w, r, data.ACTION_CONFIGURE, 0) {
+		return
+	}
+
+	rule, ok := app.ruleFromPath(w, r)
+	if !ok {
+		return
+	}
+
+	err := app.Models.Rule.Delete(rule.ID)
+	if err != nil {
+		app.serverError(w, r, err)
+		return
+	}
+
+	app.sessionManager.Put(r.Context(), "flash", "The rule has been deleted.")
+	http.Redirect(w, r, "/rules", http.StatusSeeOther)
+}
+
+// ruleTest handler - evaluates a rule against the current module values without firing its actions
+func (app *application) ruleTest(w http.ResponseWriter, r *http.Request) {
+
+	if !app.authorizePage(w, r, data.ACTION_CONFIGURE, 0) {
+		return
+	}
+
+	rule, ok := app.ruleFromPath(w, r)
+	if !ok {
+		return
+	}
+
+	// retrieving basic template data
+	tmplData := app.newTemplateData(r)
+	tmplData.Title = "Home IoT - Test " + rule.Name
+	tmplData.Rule = rule
+	tmplData.Evaluation = app.ruleEngine.Evaluate(rule)
+
+	// rendering the template
+	app.render(w, r, http.StatusOK, "rule-test.tmpl", tmplData)
+}
+
+// ruleFromPath retrieves the rule from the id in the URL path.
+// It writes the error page and returns false if the rule cannot be found.
+func (app *application) ruleFromPath(w http.ResponseWriter, r *http.Request) (*data.Rule, bool) {
+	id, err := getPathID(r)
+	if err != nil {
+		app.clientError(w, r, http.StatusNotFound)
+		return nil, false
+	}
+
+	rule, err := app.Models.Rule.Get(uint(id))
+	if err != nil {
+		switch {
+		case errors.Is(err, data.ErrRecordNotFound):
+			app.clientError(w, r, http.StatusNotFound)
+		default:
+			app.serverError(w, r, err)
+		}
+		return nil, false
+	}
+
+	return rule, true
+}
+
+// renderRuleForm renders the rule form with the devices to choose from, and the recent runs of an existing rule.
+func (app *application) renderRuleForm(w http.ResponseWriter, r *http.Request, status int, form ruleForm, rule *data.Rule) {
+	devices, err := app.Models.Device.GetAll()
+	if err != nil {
+		app.serverError(w, r, err)
+		return
+	}
+
+	tmplData := app.newTemplateData(r)
+	tmplData.Title = "Home IoT - New automation"
+	tmplData.Form = form
+	tmplData.Devices = devices
+	tmplData.FieldErrors = form.FieldErrors
+	tmplData.NonFieldErrors = form.NonFieldErrors
+
+	if rule != nil && rule.ID != 0 {
+		tmplData.Title = "Home IoT - " + rule.Name
+		tmplData.Rule = rule
+		tmplData.RuleRuns, err = app.Models.Rule.GetRuns(rule.ID, ruleRunsDisplayed)
+		if err != nil {
+			app.serverError(w, r, err)
+			return
+		}
+	}
+
+	app.render(w, r, status, "rule-form.tmpl", tmplData)
+}
+
+// failedRuleForm renders the rule form again with the validation errors.
+// The rows are rebuilt from the parsed rule, so that the error keys match the row indexes.
+func (app *application) failedRuleForm(w http.ResponseWriter, r *http.Request, form ruleForm, parsed *data.Rule, existing *data.Rule) {
+	rebuilt := newRuleForm(parsed)
+	rebuilt.Validator = form.Validator
+	app.renderRuleForm(w, r, http.StatusUnprocessableEntity, rebuilt, existing)
+}
+
+// newRuleForm fills the rule form with the rule values, followed by blank rows.
+func newRuleForm(rule *data.Rule) ruleForm {
+	form := ruleForm{
+		Name:    rule.Name,
+		Match:   rule.Match,
+		Enabled: rule.Enabled,
+		DryRun:  rule.DryRun,
+	}
+
+	for _, condition := range rule.Conditions {
+		form.Conditions = append(form.Conditions, ruleConditionForm{
+			Target:   ruleTarget(condition.DeviceID, condition.ModuleName),
+			Operator: condition.Operator,
+			Value:    condition.Value,
+		})
+	}
+	for _, action := range rule.Actions {
+		form.Actions = append(form.Actions, ruleActionForm{
+			Type:      action.Type,
+			Target:    ruleTarget(action.DeviceID, action.ModuleName),
+			Value:     action.Value,
+			Recipient: action.Recipient,
+		})
+	}
+
+	for range ruleFormBlankRows {
+		form.Conditions = append(form.Conditions, ruleConditionForm{})
+		form.Actions = append(form.Actions, ruleActionForm{})
+	}
+
+	return form
+}
+
+// toRule fills the rule with the form values, skipping the blank rows.
+func (form *ruleForm) toRule(rule *data.Rule) {
+	rule.Name = strings.TrimSpace(form.Name)
+	rule.Match = form.Match
+	rule.Enabled = form.Enabled
+	rule.DryRun = form.DryRun
+	rule.Conditions = nil
+	rule.Actions = nil
+
+	for _, condition := range form.Conditions {
+		if condition.Target == "" && condition.Value == "" {
+			continue
+		}
+		deviceID, moduleName, _ := strings.Cut(condition.Target, "/")
+		rule.Conditions = append(rule.Conditions, data.RuleCondition{
+			DeviceID:   deviceID,
+			ModuleName: moduleName,
+			Operator:   condition.Operator,
+			Value:      strings.TrimSpace(condition.Value),
+		})
+	}
+
+	for _, action := range form.Actions {
+		if action.Type == "" {
+			continue
+		}
+		deviceID, moduleName, _ := strings.Cut(action.Target, "/")
+		if action.Type == data.ACTION_TYPE_RESET {
+			moduleName = ""
+		}
+		rule.Actions = append(rule.Actions, data.RuleAction{
+			Type:       action.Type,
+			DeviceID:   deviceID,
+			ModuleName: moduleName,
+			Value:      strings.TrimSpace(action.Value),
+			Recipient:  strings.TrimSpace(action.Recipient),
+		})
+	}
+}
+
+// ruleTarget returns the value of the device/module select of the rule form.
+func ruleTarget(deviceID, moduleName string) string {
+	if moduleName == "" {
+		return deviceID
+	}
+	return deviceID + "/" + moduleName
+}
@@ -0,0 +1,359 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"net/http"
+	"strings"
+
+	"HomeIoT/internal/data"
+	"HomeIoT/internal/validator"
+)
+
+// sceneTargetInput is a target of a scene in the JSON requests.
+type sceneTargetInput struct {
+	DeviceID string `json:"device_id"`
+	Module   string `json:"module"`
+	Value    any    `json:"value"`
+}
+
+// listScenesAPI handler - lists the scenes whose devices the user may all view
+func (app *application) listScenesAPI(w http.ResponseWriter, r *http.Request) {
+	scenes, err := app.Models.Scene.GetAll()
+	if err != nil {
+		app.serverErrorJSON(w, r, err)
+		return
+	}
+
+	devices, err := app.Models.Device.GetAll()
+	if err != nil {
+		app.serverErrorJSON(w, r, err)
+		return
+	}
+	locations := make(map[string]uint, len(devices))
+	for _, device := range devices {
+		locations[device.ID] = device.LocationID
+	}
+
+	user := app.contextGetUser(r)
+	res := make([]sceneResponse, 0, len(scenes))
+	for _, scene := range scenes {
+		viewable := true
+		for _, target := range scene.Targets {
+			ok, err := app.Models.Policy.Can(user, data.ACTION_VIEW, locations[target.DeviceID])
+			if err != nil {
+				app.serverErrorJSON(w, r, err)
+				return
+			}
+			viewable = viewable && ok
+		}
+		if viewable {
+			res = append(res, newSceneResponse(scene))
+		}
+	}
+
+	err = app.writeJSON(w, http.StatusOK, envelope{"scenes": res}, nil)
+	if err != nil {
+		app.serverErrorJSON(w, r, err)
+	}
+}
+
+// showSceneAPI handler - retrieves a single scene
+func (app *application) showSceneAPI(w http.ResponseWriter, r *http.Request) {
+	scene, ok := app.sceneFromPath(w, r, data.ACTION_VIEW)
+	if !ok {
+		return
+	}
+
+	err := app.writeJSON(w, http.StatusOK, envelope{"scene": newSceneResponse(scene)}, nil)
+	if err != nil {
+		app.serverErrorJSON(w, r, err)
+	}
+}
+
+// createSceneAPI handler - creates a scene from a list of module values
+func (app *application) createSceneAPI(w http.ResponseWriter, r *http.Request) {
+	var input struct {
+		Name    string             `json:"name"`
+		Targets []sceneTargetInput `json:"targets"`
+	}
+
+	err := app.readJSON(w, r, &input)
+	if err != nil {
+		app.badRequestJSON(w, r, err)
+		return
+	}
+
+	scene := &data.Scene{
+		Name:    strings.TrimSpace(input.Name),
+		Targets: newSceneTargets(input.Targets),
+	}
+
+	app.insertScene(w, r, scene)
+}
+
+// captureSceneAPI handler - creates a scene from the current values of the modules of some devices
+func (app *application) captureSceneAPI(w http.ResponseWriter, r *http.Request) {
+	var input struct {
+		Name      string   `json:"name"`
+		DeviceIDs []string `json:"device_ids"`
+	}
+
+	err := app.readJSON(w, r, &input)
+	if err != nil {
+		app.badRequestJSON(w, r, err)
+		return
+	}
+
+	v := validator.New()
+	v.Check(len(input.DeviceIDs) > 0, "device_ids", "at least one device is required")
+	v.Check(validator.Unique(input.DeviceIDs), "device_ids", "must not contain duplicates")
+	if !v.Valid() {
+		app.failedValidationJSON(w, r, v)
+		return
+	}
+
+	for _, id := range input.DeviceIDs {
+		device, err := app.Models.Device.GetByID(id)
+		if err != nil {
+			switch {
+			case errors.Is(err, data.ErrRecordNotFound):
+				v.AddFieldError("device_ids", fmt.Sprintf("device %s not found", id))
+				app.failedValidationJSON(w, r, v)
+			default:
+				app.serverErrorJSON(w, r, err)
+			}
+			return
+		}
+		if !app.authorize(w, r, data.ACTION_COMMAND, device.LocationID) {
+			return
+		}
+	}
+
+	scene := &data.Scene{Name: strings.TrimSpace(input.Name)}
+	err = app.Models.Scene.Capture(scene, input.DeviceIDs)
+	if err != nil {
+		app.serverErrorJSON(w, r, err)
+		return
+	}
+
+	app.insertScene(w, r, scene)
+}
+
+// updateSceneAPI handler - renames a scene and replaces its targets
+func (app *application) updateSceneAPI(w http.ResponseWriter, r *http.Request) {
+	scene, ok := app.sceneFromPath(w, r, data.ACTION_COMMAND)
+	if !ok {
+		return
+	}
+
+	var input struct {
+		Name    *string            `json:"name"`
+		Targets []sceneTargetInput `json:"targets"`
+	}
+
+	err := app.readJSON(w, r, &input)
+	if err != nil {
+		app.badRequestJSON(w, r, err)
+		return
+	}
+
+	if input.Name != nil {
+		scene.Name = strings.TrimSpace(*input.Name)
+	}
+	if input.Targets != nil {
+		scene.Targets = newSceneTargets(input.Targets)
+	}
+
+	v := validator.New()
+	data.ValidateScene(v, scene)
+	if !app.checkSceneName(w, r, v, scene) {
+		return
+	}
+	if !v.Valid() {
+		app.failedValidationJSON(w, r, v)
+		return
+	}
+	if !app.authorizeScene(w, r, data.ACTION_COMMAND, scene) {
+		return
+	}
+
+	err = app.Models.Scene.Update(scene)
+	if err != nil {
+		app.serverErrorJSON(w, r, err)
+		return
+	}
+
+	err = app.writeJSON(w, http.StatusOK, envelope{"scene": newSceneResponse(scene)}, nil)
+	if err != nil {
+		app.serverErrorJSON(w, r, err)
+	}
+}
+
+// deleteSceneAPI handler - deletes a scene
+func (app *application) deleteSceneAPI(w http.ResponseWriter, r *http.Request) {
+	scene, ok := app.sceneFromPath(w, r, data.ACTION_COMMAND)
+	if !ok {
+		return
+	}
+
+	err := app.Models.Scene.Delete(scene.ID)
+	if err != nil {
+		app.serverErrorJSON(w, r, err)
+		return
+	}
+
+	err = app.writeJSON(w, http.StatusOK, envelope{"message": "scene successfully deleted"}, nil)
+	if err != nil {
+		app.serverErrorJSON(w, r, err)
+	}
+}
+
+// applySceneAPI handler - sends the values of a scene to its devices and reports the outcome of each publish
+func (app *application) applySceneAPI(w http.ResponseWriter, r *http.Request) {
+	scene, ok := app.sceneFromPath(w, r, data.ACTION_COMMAND)
+	if !ok {
+		return
+	}
+
+	results, err := app.Models.Scene.Apply(r.Context(), scene)
+	if err != nil {
+		switch {
+		case errors.Is(err, data.ErrRecordNotFound):
+			app.errorJSON(w, r, http.StatusConflict, fmt.Sprintf("the scene cannot be applied: %s", err.Error()))
+		default:
+			app.serverErrorJSON(w, r, err)
+		}
+		return
+	}
+
+	applied, queued := 0, 0
+	for _, result := range results {
+		switch {
+		case result.Success:
+			applied++
+		case result.Queued:
+			queued++
+		}
+	}
+
+	err = app.writeJSON(w, http.StatusOK, envelope{"scene_id": scene.ID, "applied": applied, "queued": queued, "failed": len(results) - applied - queued, "results": results}, nil)
+	if err != nil {
+		app.serverErrorJSON(w, r, err)
+	}
+}
+
+// insertScene validates and creates a new scene, and writes the response.
+func (app *application) insertScene(w http.ResponseWriter, r *http.Request, scene *data.Scene) {
+	v := validator.New()
+	data.ValidateScene(v, scene)
+	if !app.checkSceneName(w, r, v, scene) {
+		return
+	}
+	if !v.Valid() {
+		app.failedValidationJSON(w, r, v)
+		return
+	}
+	if !app.authorizeScene(w, r, data.ACTION_COMMAND, scene) {
+		return
+	}
+
+	err := app.Models.Scene.Insert(scene)
+	if err != nil {
+		app.serverErrorJSON(w, r, err)
+		return
+	}
+
+	headers := make(http.Header)
+	headers.Set("Location", fmt.Sprintf("/api/v1/scenes/%d", scene.ID))
+
+	err = app.writeJSON(w, http.StatusCreated, envelope{"scene": newSceneResponse(scene)}, headers)
+	if err != nil {
+		app.serverErrorJSON(w, r, err)
+	}
+}
+
+// sceneFromPath fetches the scene matching the id path parameter and checks the user may perform the action on every device of the scene.
+// It writes the error response and returns false if the scene cannot be retrieved or the action is denied.
+func (app *application) sceneFromPath(w http.ResponseWriter, r *http.Request, action string) (*data.Scene, bool) {
+	id, err := getPathID(r)
+	if err != nil {
+		app.notFoundJSON(w, r, "scene not found")
+		return nil, false
+	}
+
+	scene, err := app.Models.Scene.Get(uint(id))
+	if err != nil {
+		switch {
+		case errors.Is(err, data.ErrRecordNotFound):
+			app.notFoundJSON(w, r, fmt.Sprintf("scene %d not found", id))
+		default:
+			app.serverErrorJSON(w, r, err)
+		}
+		return nil, false
+	}
+
+	if !app.authorizeScene(w, r, action, scene) {
+		return nil, false
+	}
+
+	return scene, true
+}
+
+// authorizeScene checks the user may perform the action on the locations of every device of the scene.
+// The devices removed since the scene was saved are checked against the global permissions.
+func (app *application) authorizeScene(w http.ResponseWriter, r *http.Request, action string, scene *data.Scene) bool {
+	checked := make(map[string]bool)
+
+	for _, target := range scene.Targets {
+		if checked[target.DeviceID] {
+			continue
+		}
+		checked[target.DeviceID] = true
+
+		var locationID uint
+		device, err := app.Models.Device.GetByID(target.DeviceID)
+		if err != nil && !errors.Is(err, data.ErrRecordNotFound) {
+			app.serverErrorJSON(w, r, err)
+			return false
+		}
+		if device != nil {
+			locationID = device.LocationID
+		}
+
+		if !app.authorize(w, r, action, locationID) {
+			return false
+		}
+	}
+
+	return true
+}
+
+// checkSceneName adds a validation error if another scene already uses the same name.
+// It writes a server error and returns false if the check cannot be performed.
+func (app *application) checkSceneName(w http.ResponseWriter, r *http.Request, v *validator.Validator, scene *data.Scene) bool {
+	exists, err := app.Models.Scene.NameExists(scene.Name, scene.ID)
+	if err != nil {
+		app.serverErrorJSON(w, r, err)
+		return false
+	}
+	v.Check(!exists, "name", "a scene with this name already exists")
+	return true
+}
+
+// newSceneTargets converts the targets of a request, the values being stored as the modules store them.
+func newSceneTargets(input []sceneTargetInput) []data.SceneTarget {
+	targets := make([]data.SceneTarget, 0, len(input))
+	for _, target := range input {
+		value := ""
+		if target.Value != nil {
+			value = fmt.Sprint(target.Value)
+		}
+		targets = append(targets, data.SceneTarget{
+			DeviceID:   target.DeviceID,
+			ModuleName: target.Module,
+			Value:      value,
+		})
+	}
+	return targets
+}
@@ -0,0 +1,249 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"net/http"
+	"strings"
+	"time"
+
+	"HomeIoT/internal/data"
+)
+
+// scheduleRunsDisplayed is the number of recent runs displayed on the schedule page.
+const scheduleRunsDisplayed = 50
+
+// schedules handler - renders the list of schedules
+func (app *application) schedules(w http.ResponseWriter, r *http.Request) {
+
+	if !app.authorizePage(w, r, data.ACTION_CONFIGURE, 0) {
+		return
+	}
+
+	schedules, err := app.Models.Schedule.GetAll()
+	if err != nil {
+		app.serverError(w, r, err)
+		return
+	}
+
+	// retrieving basic template data
+	tmplData := app.newTemplateData(r)
+	tmplData.Title = "Home IoT - Schedules"
+	tmplData.Schedules = schedules
+
+	// rendering the template
+	app.render(w, r, http.StatusOK, "schedules.tmpl", tmplData)
+}
+
+// scheduleCreate handler - renders the form to create a schedule
+func (app *application) scheduleCreate(w http.ResponseWriter, r *http.Request) {
+
+	if !app.authorizePage(w, r, data.ACTION_CONFIGURE, 0) {
+		return
+	}
+
+	form := scheduleForm{Enabled: true, MissedPolicy: data.MISSED_SKIP, ActionType: data.ACTION_TYPE_SET}
+	app.renderScheduleForm(w, r, http.StatusOK, form, nil)
+}
+
+// scheduleCreatePost handler - creates a schedule
+func (app *application) scheduleCreatePost(w http.ResponseWriter, r *http.Request) {
+
+	if !app.authorizePage(w, r, data.ACTION_CONFIGURE, 0) {
+		return
+	}
+
+	// retrieving the form data
+	var form scheduleForm
+	err := app.decodePostForm(r, &form)
+	if err != nil {
+		app.clientError(w, r, http.StatusBadRequest)
+		return
+	}
+
+	schedule := &data.Schedule{}
+	form.toSchedule(schedule)
+
+	// checking the data from the user
+	data.ValidateSchedule(&form.Validator, schedule)
+	if !form.Valid() {
+		app.renderScheduleForm(w, r, http.StatusUnprocessableEntity, form, nil)
+		return
+	}
+
+	// the first run is the next occurrence, nothing is considered missed before the creation
+	err = schedule.ComputeNextRun(time.Now())
+	if err != nil {
+		app.serverError(w, r, err)
+		return
+	}
+
+	err = app.Models.Schedule.Insert(schedule)
+	if err != nil {
+		app.serverError(w, r, err)
+		return
+	}
+
+	app.sessionManager.Put(r.Context(), "flash", "The schedule has been created successfully!")
+	http.Redirect(w, r, fmt.Sprintf("/schedules/%d", schedule.ID), http.StatusSeeOther)
+}
+
+// scheduleEdit handler - renders the form to edit a schedule, with its run history
+func (app *application) scheduleEdit(w http.ResponseWriter, r *http.Request) {
+
+	if !app.authorizePage(w, r, data.ACTION_CONFIGURE, 0) {
+		return
+	}
+
+	schedule, ok := app.scheduleFromPath(w, r)
+	if !ok {
+		return
+	}
+
+	form := scheduleForm{
+		Name:         schedule.Name,
+		Spec:         schedule.Spec,
+		Enabled:      schedule.Enabled,
+		MissedPolicy: schedule.MissedPolicy,
+		ActionType:   schedule.ActionType,
+		Target:       ruleTarget(schedule.DeviceID, schedule.ModuleName),
+		Value:        schedule.Value,
+	}
+	app.renderScheduleForm(w, r, http.StatusOK, form, schedule)
+}
+
+// scheduleEditPost handler - updates a schedule
+func (app *application) scheduleEditPost(w http.ResponseWriter, r *http.Request) {
+
+	if !app.authorizePage(w, r, data.ACTION_CONFIGURE, 0) {
+		return
+	}
+
+	schedule, ok := app.scheduleFromPath(w, r)
+	if !ok {
+		return
+	}
+
+	// retrieving the form data
+	var form scheduleForm
+	err := app.decodePostForm(r, &form)
+	if err != nil {
+		app.clientError(w, r, http.StatusBadRequest)
+		return
+	}
+
+	form.toSchedule(schedule)
+
+	// checking the data from the user
+	data.ValidateSchedule(&form.Validator, schedule)
+	if !form.Valid() {
+		app.renderScheduleForm(w, r, http.StatusUnprocessableEntity, form, schedule)
+		return
+	}
+
+	// the runs are computed again from the new expression
+	err = schedule.ComputeNextRun(time.Now())
+	if err != nil {
+		app.serverError(w, r, err)
+		return
+	}
+
+	err = app.Models.Schedule.Update(schedule)
+	if err != nil {
+		app.serverError(w, r, err)
+		return
+	}
+
+	app.sessionManager.Put(r.Context(), "flash", "The schedule has been updated successfully!")
+	http.Redirect(w, r, fmt.Sprintf("/schedules/%d", schedule.ID), http.StatusSeeOther)
+}
+
+// scheduleDeletePost handler - deletes a schedule and its run history
+func (app *application) scheduleDeletePost(w http.ResponseWriter, r *http.Request) {
+
+	if !app.authorizePage(w, r, data.ACTION_CONFIGURE, 0) {
+		return
+	}
+
+	schedule, ok := app.scheduleFromPath(w, r)
+	if !ok {
+		return
+	}
+
+	err := app.Models.Schedule.Delete(schedule.ID)
+	if err != nil {
+		app.serverError(w, r, err)
+		return
+	}
+
+	app.sessionManager.Put(r.Context(), "flash", "The schedule has been deleted.")
+	http.Redirect(w, r, "/schedules", http.StatusSeeOther)
+}
+
+// scheduleFromPath retrieves the schedule from the id in the URL path.
+// It writes the error page and returns false if the schedule cannot be found.
+func (app *application) scheduleFromPath(w http.ResponseWriter, r *http.Request) (*data.Schedule, bool) {
+	id, err := getPathID(r)
+	if err != nil {
+		app.clientError(w, r, http.StatusNotFound)
+		return nil, false
+	}
+
+	schedule, err := app.Models.Schedule.Get(uint(id))
+	if err != nil {
+		switch {
+		case errors.Is(err, data.ErrRecordNotFound):
+			app.clientError(w, r, http.StatusNotFound)
+		default:
+			app.serverError(w, r, err)
+		}
+		return nil, false
+	}
+
+	return schedule, true
+}
+
+// renderScheduleForm renders the schedule form with the devices to choose from, and the run history of an existing schedule.
+func (app *application) renderScheduleForm(w http.ResponseWriter, r *http.Request, status int, form scheduleForm, schedule *data.Schedule) {
+	devices, err := app.Models.Device.GetAll()
+	if err != nil {
+		app.serverError(w, r, err)
+		return
+	}
+
+	tmplData := app.newTemplateData(r)
+	tmplData.Title = "Home IoT - New schedule"
+	tmplData.Form = form
+	tmplData.Devices = devices
+	tmplData.FieldErrors = form.FieldErrors
+	tmplData.NonFieldErrors = form.NonFieldErrors
+
+	if schedule != nil {
+		tmplData.Title = "Home IoT - " + schedule.Name
+		tmplData.Schedule = schedule
+		tmplData.ScheduleRuns, err = app.Models.Schedule.GetRuns(schedule.ID, scheduleRunsDisplayed)
+		if err != nil {
+			app.serverError(w, r, err)
+			return
+		}
+	}
+
+	app.render(w, r, status, "schedule-form.tmpl", tmplData)
+}
+
+// toSchedule fills the schedule with the form values.
+func (form *scheduleForm) toSchedule(schedule *data.Schedule) {
+	deviceID, moduleName, _ := strings.Cut(form.Target, "/")
+	if form.ActionType == data.ACTION_TYPE_RESET {
+		moduleName = ""
+	}
+
+	schedule.Name = strings.TrimSpace(form.Name)
+	schedule.Spec = strings.TrimSpace(form.Spec)
+	schedule.Enabled = form.Enabled
+	schedule.MissedPolicy = form.MissedPolicy
+	schedule.ActionType = form.ActionType
+	schedule.DeviceID = deviceID
+	schedule.ModuleName = moduleName
+	schedule.Value = strings.TrimSpace(form.Value)
+}
@@ -0,0 +1,337 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"net/http"
+	"net/url"
+	"time"
+
+	"HomeIoT/internal/data"
+)
+
+// passwordResetTTL is the lifetime of the password reset links.
+const passwordResetTTL = 45 * time.Minute
+
+// login handler - renders the login page
+func (app *application) login(w http.ResponseWriter, r *http.Request) {
+
+	// retrieving basic template data
+	tmplData := app.newTemplateData(r)
+	tmplData.Title = "Home IoT - Login"
+	tmplData.Form = userLoginForm{}
+
+	// rendering the template
+	app.render(w, r, http.StatusOK, "login.tmpl", tmplData)
+}
+
+// loginPost handler - authenticates the user and stores it in the session
+func (app *application) loginPost(w http.ResponseWriter, r *http.Request) {
+
+	// retrieving the form data
+	var form userLoginForm
+	err := app.decodePostForm(r, &form)
+	if err != nil {
+		app.clientError(w, r, http.StatusBadRequest)
+		return
+	}
+
+	// checking the data from the user
+	form.ValidateEmail(form.Email)
+	form.StringCheck(form.Password, 1, 72, true, "password")
+	if !form.Valid() {
+		app.failedValidationError(w, r, form, &form.Validator, "login.tmpl")
+		return
+	}
+
+	// checking the credentials
+	user, err := app.Models.User.Authenticate(form.Email, form.Password)
+	if err != nil {
+		switch {
+		case errors.Is(err, data.ErrInvalidCredentials):
+			form.AddNonFieldError("Email or password is incorrect")
+			app.failedValidationError(w, r, form, &form.Validator, "login.tmpl")
+		default:
+			app.serverError(w, r, err)
+		}
+		return
+	}
+
+	// renewing the session token to prevent session fixation
+	err = app.sessionManager.RenewToken(r.Context())
+	if err != nil {
+		app.serverError(w, r, err)
+		return
+	}
+	app.sessionManager.Put(r.Context(), authenticatedUserIDSessionManager, int(user.ID))
+	app.sessionManager.Put(r.Context(), userRoleSessionManager, user.Role)
+	app.sessionManager.Put(r.Context(), userVersionSessionManager, user.Version)
+
+	// redirecting the user to the page they wanted to access
+	path := app.sessionManager.PopString(r.Context(), redirectPathSessionManager)
+	if path == "" {
+		path = "/"
+	}
+	http.Redirect(w, r, path, http.StatusSeeOther)
+}
+
+// logoutPost handler - removes the user from the session
+func (app *application) logoutPost(w http.ResponseWriter, r *http.Request) {
+
+	err := app.logout(r)
+	if err != nil {
+		app.serverError(w, r, err)
+		return
+	}
+
+	app.sessionManager.Put(r.Context(), "flash", "You've been logged out successfully!")
+	http.Redirect(w, r, "/login", http.StatusSeeOther)
+}
+
+// register handler - renders the registration page
+func (app *application) register(w http.ResponseWriter, r *http.Request) {
+
+	if !app.checkRegistrationOpen(w, r) {
+		return
+	}
+
+	// retrieving basic template data
+	tmplData := app.newTemplateData(r)
+	tmplData.Title = "Home IoT - Register"
+	tmplData.Form = userRegisterForm{Role: data.ROLE_GUEST}
+
+	// rendering the template
+	app.render(w, r, http.StatusOK, "register.tmpl", tmplData)
+}
+
+// registerPost handler - creates a new user account
+func (app *application) registerPost(w http.ResponseWriter, r *http.Request) {
+
+	if !app.checkRegistrationOpen(w, r) {
+		return
+	}
+
+	// retrieving the form data
+	var form userRegisterForm
+	err := app.decodePostForm(r, &form)
+	if err != nil {
+		app.clientError(w, r, http.StatusBadRequest)
+		return
+	}
+
+	user := &data.User{
+		Name:  form.Name,
+		Email: form.Email,
+		Role:  form.Role,
+	}
+
+	// the first account administers the system, the following ones are guests unless an admin says otherwise
+	if !app.isAuthenticated(r) {
+		user.Role = data.ROLE_ADMIN
+	} else if user.Role == "" {
+		user.Role = data.ROLE_GUEST
+	}
+
+	// checking the data from the user
+	data.ValidateUser(&form.Validator, user)
+	form.ValidateRegisterPassword(form.Password, form.ConfirmPassword)
+	if !form.Valid() {
+		app.failedValidationError(w, r, form, &form.Validator, "register.tmpl")
+		return
+	}
+
+	// creating the user, the first one only if no other user was created meanwhile
+	if app.isAuthenticated(r) {
+		err = app.Models.User.Insert(user, form.Password)
+	} else {
+		err = app.Models.User.InsertFirst(user, form.Password)
+	}
+	if err != nil {
+		switch {
+		case errors.Is(err, data.ErrRegistrationClosed):
+			app.sessionManager.Put(r.Context(), "flash", "You must be logged in to create an account.")
+			http.Redirect(w, r, "/login", http.StatusSeeOther)
+		case errors.Is(err, data.ErrDuplicateEmail):
+			form.AddFieldError("email", "Email address is already in use")
+			app.failedValidationError(w, r, form, &form.Validator, "register.tmpl")
+		default:
+			app.serverError(w, r, err)
+		}
+		return
+	}
+
+	// an authenticated user stays on the dashboard, the first user is sent to the login page
+	if app.isAuthenticated(r) {
+		app.sessionManager.Put(r.Context(), "flash", "The account has been created successfully!")
+		http.Redirect(w, r, "/", http.StatusSeeOther)
+		return
+	}
+
+	app.sessionManager.Put(r.Context(), "flash", "Your account has been created, you can now log in!")
+	http.Redirect(w, r, "/login", http.StatusSeeOther)
+}
+
+// checkRegistrationOpen checks whether the current visitor may create an account.
+// Anyone may create the first account, the following ones are created by admins.
+// It writes the error or redirection and returns false otherwise.
+func (app *application) checkRegistrationOpen(w http.ResponseWriter, r *http.Request) bool {
+	if app.isAuthenticated(r) {
+		return app.authorizePage(w, r, data.ACTION_CONFIGURE, 0)
+	}
+
+	count, err := app.Models.User.Count()
+	if err != nil {
+		app.serverError(w, r, err)
+		return false
+	}
+	if count > 0 {
+		app.sessionManager.Put(r.Context(), "flash", "You must be logged in to create an account.")
+		http.Redirect(w, r, "/login", http.StatusSeeOther)
+		return false
+	}
+
+	return true
+}
+
+// forgotPassword handler - renders the page to request a password reset
+func (app *application) forgotPassword(w http.ResponseWriter, r *http.Request) {
+
+	// retrieving basic template data
+	tmplData := app.newTemplateData(r)
+	tmplData.Title = "Home IoT - Forgot password"
+	tmplData.Form = forgotPasswordForm{}
+
+	// rendering the template
+	app.render(w, r, http.StatusOK, "forgot-password.tmpl", tmplData)
+}
+
+// forgotPasswordPost handler - emails a password reset link to the user
+func (app *application) forgotPasswordPost(w http.ResponseWriter, r *http.Request) {
+
+	// retrieving the form data
+	var form forgotPasswordForm
+	err := app.decodePostForm(r, &form)
+	if err != nil {
+		app.clientError(w, r, http.StatusBadRequest)
+		return
+	}
+
+	// checking the data from the user
+	form.ValidateEmail(form.Email)
+	if !form.Valid() {
+		app.failedValidationError(w, r, form, &form.Validator, "forgot-password.tmpl")
+		return
+	}
+
+	// the response is the same whether the account exists or not, so that emails cannot be enumerated
+	flash := "If an account exists with this email, a link to reset your password has been sent."
+
+	user, err := app.Models.User.GetByEmail(form.Email)
+	if err != nil {
+		if !errors.Is(err, data.ErrRecordNotFound) {
+			app.serverError(w, r, err)
+			return
+		}
+		app.sessionManager.Put(r.Context(), "flash", flash)
+		http.Redirect(w, r, "/login", http.StatusSeeOther)
+		return
+	}
+
+	token, err := app.Models.Token.New(user.ID, passwordResetTTL, data.SCOPE_PASSWORD_RESET)
+	if err != nil {
+		app.serverError(w, r, err)
+		return
+	}
+
+	mailData := map[string]any{
+		"Name":     user.Name,
+		"ResetURL": fmt.Sprintf("%s/reset-password?token=%s", app.config.baseURL, url.QueryEscape(token.Plaintext)),
+		"Expiry":   passwordResetTTL.String(),
+		"Email":    app.config.smtp.sender,
+	}
+
+	// sending the email in the background
+	app.background(func() {
+		err := app.mailer.Send(user.Email, "password-reset.tmpl", mailData)
+		if err != nil {
+			app.logger.Error(fmt.Errorf("error sending password reset email: %w", err).Error())
+		}
+	})
+
+	app.sessionManager.Put(r.Context(), "flash", flash)
+	http.Redirect(w, r, "/login", http.StatusSeeOther)
+}
+
+// resetPassword handler - renders the page to choose a new password
+func (app *application) resetPassword(w http.ResponseWriter, r *http.Request) {
+
+	// retrieving basic template data
+	tmplData := app.newTemplateData(r)
+	tmplData.Title = "Home IoT - Reset password"
+	tmplData.ResetToken = r.URL.Query().Get("token")
+
+	var form resetPasswordForm
+	form.ValidateToken(tmplData.ResetToken)
+	if !form.Valid() {
+		tmplData.FieldErrors = form.FieldErrors
+	}
+	tmplData.Form = form
+
+	// rendering the template
+	app.render(w, r, http.StatusOK, "reset-password.tmpl", tmplData)
+}
+
+// resetPasswordPost handler - sets the new password of the user owning the token
+func (app *application) resetPasswordPost(w http.ResponseWriter, r *http.Request) {
+
+	// retrieving the form data
+	var form resetPasswordForm
+	err := app.decodePostForm(r, &form)
+	if err != nil {
+		app.clientError(w, r, http.StatusBadRequest)
+		return
+	}
+
+	// checking the data from the user
+	form.ValidateToken(form.Token)
+	form.ValidateNewPassword(form.NewPassword, form.ConfirmPassword)
+	if !form.Valid() {
+		app.failedResetPassword(w, r, form)
+		return
+	}
+
+	// changing the password of the user owning the token, which can only be used once,
+	// this invalidates the sessions of the user
+	_, err = app.Models.User.ResetPassword(form.Token, form.NewPassword)
+	if err != nil {
+		switch {
+		case errors.Is(err, data.ErrRecordNotFound):
+			form.AddFieldError("token", "invalid or expired link")
+			app.failedResetPassword(w, r, form)
+		default:
+			app.serverError(w, r, err)
+		}
+		return
+	}
+
+	err = app.logout(r)
+	if err != nil {
+		app.serverError(w, r, err)
+		return
+	}
+
+	app.sessionManager.Put(r.Context(), "flash", "Your password has been changed, you can now log in!")
+	http.Redirect(w, r, "/login", http.StatusSeeOther)
+}
+
+// failedResetPassword renders the reset password page again with the validation errors.
+func (app *application) failedResetPassword(w http.ResponseWriter, r *http.Request, form resetPasswordForm) {
+	tmplData := app.newTemplateData(r)
+	tmplData.Title = "Home IoT - Reset password"
+	tmplData.ResetToken = form.Token
+	tmplData.Form = form
+	tmplData.FieldErrors = form.FieldErrors
+	tmplData.NonFieldErrors = form.NonFieldErrors
+
+	app.render(w, r, http.StatusUnprocessableEntity, "reset-password.tmpl", tmplData)
+}
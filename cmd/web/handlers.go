@@ -2,8 +2,18 @@ package main
 
 import (
 	"encoding/json"
+	"errors"
 	"fmt"
+	"log/slog"
 	"net/http"
+	"slices"
+	"strconv"
+	"time"
+
+	"HomeIoT/internal/data"
+	"HomeIoT/internal/validator"
+
+	"github.com/alexedwards/flow"
 )
 
 func (app *application) notFound(w http.ResponseWriter, r *http.Request) {
@@ -30,14 +40,23 @@ func (app *application) methodNotAllowed(w http.ResponseWriter, r *http.Request)
 	app.render(w, r, http.StatusMethodNotAllowed, "error.tmpl", tmplData)
 }
 
-func (app *application) index(w http.ResponseWriter, r *http.Request) {
+// Healthcheck handler - reports the state of the server, of its connection to the MQTT broker and of the ingestion of the readings and of its device cache
+func (app *application) healthcheck(w http.ResponseWriter, r *http.Request) {
 
-	// retrieving basic template data
-	tmplData := app.newTemplateData(r)
-	tmplData.Title = "Home IoT - Home"
+	broker := app.Models.Data.Broker.Health()
 
-	// rendering the template
-	app.render(w, r, http.StatusOK, "home.tmpl", tmplData)
+	// the server cannot ingest nor command anything without the broker
+	status := http.StatusOK
+	env := envelope{"status": "available", "environment": app.config.env, "broker": broker, "ingestion": app.Models.Data.Ingester.Stats(), "device_cache": app.Models.Device.Cache.Stats()}
+	if !broker.Connected {
+		status = http.StatusServiceUnavailable
+		env["status"] = "degraded"
+	}
+
+	err := app.writeJSON(w, status, env, nil)
+	if err != nil {
+		app.serverErrorJSON(w, r, err)
+	}
 }
 
 // Dashboard handler - renders the IoT dashboard page
@@ -47,74 +66,267 @@ func (app *application) dashboard(w http.ResponseWriter, r *http.Request) {
 		app.serverError(w, r, err)
 		return
 	}
+
+	// Only display the devices the user may view
+	devices, err = app.Models.Policy.FilterDevices(app.contextGetUser(r), devices)
+	if err != nil {
+		app.serverError(w, r, err)
+		return
+	}
+
 	tmplData := app.newTemplateData(r)
+	tmplData.Title = "Home IoT - Dashboard"
 	tmplData.Devices = devices
 
-	app.render(w, r, http.StatusOK, "home.tmpl", tmplData)
+	app.render(w, r, http.StatusOK, "dashboard.tmpl", tmplData)
 }
 
-// CommandDevice handler - allows sending a command to a specific IoT device
+// maxCommandWait bounds the wait for the acknowledgement of a command, below the server write timeout.
+const maxCommandWait = 8 * time.Second
+
+/**
+ * CommandDevice handler - sends a command to a module of a specific IoT device.
+ * With the "wait" query parameter, the response is delayed until the device acknowledges the command,
+ * otherwise it returns the command ID to poll.
+ */
 func (app *application) commandDevice(w http.ResponseWriter, r *http.Request) {
-	// Ensure only POST requests are allowed
-	if r.Method != http.MethodPost {
-		app.methodNotAllowed(w, r)
+
+	// Parse the device command from the request body
+	var input struct {
+		Value any `json:"value"`
+	}
+
+	err := app.readJSON(w, r, &input)
+	if err != nil {
+		app.badRequestJSON(w, r, err)
 		return
 	}
 
-	// Parse device command from request body
-	type CommandRequest struct {
-		DeviceID string `json:"device_id"`
-		Command  string `json:"command"`
+	// Retrieve the location, device and module from the path
+	locationID, err := strconv.ParseUint(flow.Param(r.Context(), "locationID"), 10, 64)
+	if err != nil {
+		app.notFoundJSON(w, r, "location not found")
+		return
 	}
+	deviceID := flow.Param(r.Context(), "deviceID")
+	moduleName := flow.Param(r.Context(), "information")
 
-	var cmdReq CommandRequest
-	err := json.NewDecoder(r.Body).Decode(&cmdReq)
+	// Resolve the device
+	device, err := app.Models.Device.GetByID(deviceID)
 	if err != nil {
-		http.Error(w, "Invalid request format", http.StatusBadRequest)
+		switch {
+		case errors.Is(err, data.ErrRecordNotFound):
+			app.notFoundJSON(w, r, fmt.Sprintf("device %s not found", deviceID))
+		default:
+			app.serverErrorJSON(w, r, err)
+		}
+		return
+	}
+	if device.LocationID != uint(locationID) {
+		app.notFoundJSON(w, r, fmt.Sprintf("device %s not found in location %d", deviceID, locationID))
 		return
 	}
 
-	// Simulate sending the command to the device (e.g., via MQTT, API call, etc.)
-	// For now, we just log it
-	app.logger.Debug(fmt.Sprintf("Sending command '%s' to device '%s'", cmdReq.Command, cmdReq.DeviceID))
+	// Check the user may command the devices of this location
+	if !app.authorize(w, r, data.ACTION_COMMAND, device.LocationID) {
+		return
+	}
 
-	// Send response
-	w.Header().Set("Content-Type", "application/json")
-	w.WriteHeader(http.StatusOK)
-	err = json.NewEncoder(w).Encode(map[string]string{"status": "success", "message": "Command sent"})
+	// Resolve the module
+	idx := slices.IndexFunc(device.Modules, func(module data.Module) bool {
+		return module.Name == moduleName
+	})
+	if idx < 0 {
+		app.notFoundJSON(w, r, fmt.Sprintf("module %s not found on device %s", moduleName, deviceID))
+		return
+	}
+	module := device.Modules[idx]
+
+	// Validate the value
+	v := validator.New()
+	v.Check(input.Value != nil, "value", "must be provided")
+	if !v.Valid() {
+		app.failedValidationJSON(w, r, v)
+		return
+	}
+
+	// Optional wait for the acknowledgement of the device
+	wait, err := app.readWait(r)
 	if err != nil {
+		app.badRequestJSON(w, r, err)
+		return
+	}
+
+	// Send the command to the device
+	app.logger.Debug(fmt.Sprintf("Sending command '%v' to module '%s' of device '%s'", input.Value, module.Name, device.ID))
+
+	command, err := app.Models.ModuleModels.Send(r.Context(), module, input.Value)
+	queued := errors.Is(err, data.ErrPublishQueued)
+	if err != nil && !queued {
+		switch {
+		case errors.Is(err, data.ErrInvalidValue):
+			v.AddFieldError("value", fmt.Sprintf("invalid value for module %s", module.Name))
+			app.failedValidationJSON(w, r, v)
+		case errors.Is(err, data.ErrReadOnlyModule):
+			v.AddFieldError("value", fmt.Sprintf("module %s is read-only", module.Name))
+			app.failedValidationJSON(w, r, v)
+		case errors.Is(err, data.ErrUnknownModule):
+			app.notFoundJSON(w, r, fmt.Sprintf("module %s cannot be commanded", module.Name))
+		default:
+			app.publishErrorJSON(w, r, err)
+		}
 		return
 	}
+
+	// the queued command is sent when the broker is reachable again, there is no acknowledgement to wait for yet
+	if !queued {
+		command, err = app.waitCommand(r, command, wait)
+		if err != nil {
+			app.serverErrorJSON(w, r, err)
+			return
+		}
+	}
+
+	res := envelope{"device_id": device.ID, "module": module.Name, "value": input.Value, "command": newCommandResponse(command)}
+	switch {
+	case queued:
+		res["status"], res["message"] = "queued", "Broker unreachable, command queued"
+	case command.Status == data.COMMAND_ACKED:
+		res["status"], res["message"] = "success", "Command acknowledged"
+	case command.Status == data.COMMAND_FAILED:
+		res["status"], res["message"] = "failed", "Command failed on the device"
+	case command.Status == data.COMMAND_TIMED_OUT:
+		res["status"], res["message"] = "timed_out", "Command not acknowledged by the device"
+	default:
+		res["status"], res["message"] = "pending", "Command sent, waiting for the acknowledgement"
+	}
+
+	// Send response
+	err = app.writeJSON(w, commandStatus(command), res, nil)
+	if err != nil {
+		app.serverErrorJSON(w, r, err)
+	}
 }
 
 // GetDeviceInfo handler - retrieves device details
 func (app *application) getDeviceInfo(w http.ResponseWriter, r *http.Request) {
-	// Ensure only GET requests are allowed
-	if r.Method != http.MethodGet {
-		app.methodNotAllowed(w, r)
+
+	// Retrieve the location and device from the path
+	locationID, err := strconv.ParseUint(flow.Param(r.Context(), "locationID"), 10, 64)
+	if err != nil {
+		app.notFoundJSON(w, r, "location not found")
 		return
 	}
+	deviceID := flow.Param(r.Context(), "deviceID")
 
-	// Get device ID from query parameters
-	deviceID := r.URL.Query().Get("device_id")
-	if deviceID == "" {
-		http.Error(w, "Missing device_id parameter", http.StatusBadRequest)
+	// Fetch the device with its location and modules
+	device, err := app.Models.Device.GetByID(deviceID)
+	if err != nil {
+		switch {
+		case errors.Is(err, data.ErrRecordNotFound):
+			app.notFoundJSON(w, r, fmt.Sprintf("device %s not found", deviceID))
+		default:
+			app.serverErrorJSON(w, r, err)
+		}
+		return
+	}
+	if device.LocationID != uint(locationID) {
+		app.notFoundJSON(w, r, fmt.Sprintf("device %s not found in location %d", deviceID, locationID))
 		return
 	}
 
-	// Simulated device info
-	deviceInfo := map[string]interface{}{
-		"device_id": deviceID,
-		"name":      "Smart Light",
-		"status":    "Online",
-		"battery":   "85%",
+	// Check the user may view this location
+	if !app.authorize(w, r, data.ACTION_VIEW, device.LocationID) {
+		return
 	}
 
-	// Send device info as JSON response
-	w.Header().Set("Content-Type", "application/json")
-	w.WriteHeader(http.StatusOK)
-	err := json.NewEncoder(w).Encode(deviceInfo)
+	// Send device info as JSON response, with its online status and last seen time
+	err = app.writeJSON(w, http.StatusOK, envelope{"device": app.newDeviceResponse(device)}, nil)
 	if err != nil {
+		app.serverErrorJSON(w, r, err)
+	}
+}
+
+// Events handler - streams the accepted readings and new devices as Server-Sent Events
+func (app *application) events(w http.ResponseWriter, r *http.Request) {
+
+	// Get the optional filters from query parameters
+	qs := r.URL.Query()
+	deviceID := qs.Get("device")
+
+	var locationID uint64
+	if location := qs.Get("location"); location != "" {
+		var err error
+		locationID, err = strconv.ParseUint(location, 10, 64)
+		if err != nil {
+			app.badRequestJSON(w, r, errors.New("location must be a location ID"))
+			return
+		}
+	}
+
+	// Only stream the events of the locations the user may view
+	allLocations, viewable, err := app.Models.Policy.ViewableLocations(app.contextGetUser(r))
+	if err != nil {
+		app.serverErrorJSON(w, r, err)
+		return
+	}
+
+	// the stream lives longer than the server write timeout
+	rc := http.NewResponseController(w)
+	err = rc.SetWriteDeadline(time.Time{})
+	if err != nil {
+		app.serverErrorJSON(w, r, err)
 		return
 	}
+
+	sub := app.Models.Events.Subscribe(64, func(event data.Event) bool {
+		if deviceID != "" && event.DeviceID != deviceID {
+			return false
+		}
+		if locationID != 0 && event.LocationID != uint(locationID) {
+			return false
+		}
+		return allLocations || slices.Contains(viewable, event.LocationID)
+	})
+	defer sub.Close()
+
+	w.Header().Set("Content-Type", "text/event-stream")
+	w.Header().Set("Cache-Control", "no-cache")
+	w.Header().Set("Connection", "keep-alive")
+	w.WriteHeader(http.StatusOK)
+	_ = rc.Flush()
+
+	// keeping the connection open through proxies
+	heartbeat := time.NewTicker(25 * time.Second)
+	defer heartbeat.Stop()
+
+	for {
+		select {
+		case <-r.Context().Done():
+			return
+
+		case <-heartbeat.C:
+			_, err = fmt.Fprint(w, ": heartbeat\n\n")
+
+		case event, ok := <-sub.C:
+			if !ok {
+				return
+			}
+			var payload []byte
+			payload, err = json.Marshal(event)
+			if err != nil {
+				app.logger.Error(err.Error())
+				continue
+			}
+			_, err = fmt.Fprintf(w, "event: %s\ndata: %s\n\n", event.Type, payload)
+		}
+
+		if err == nil {
+			err = rc.Flush()
+		}
+		if err != nil {
+			app.logger.Debug("closing event stream", slog.String("error", err.Error()))
+			return
+		}
+	}
 }
@@ -2,17 +2,21 @@ package main
 
 import (
 	"bytes"
+	"context"
 	"crypto/rand"
 	"encoding/hex"
 	"encoding/json"
 	"errors"
 	"fmt"
+	"io"
 	"log/slog"
 	"net/http"
 	"runtime/debug"
 	"strconv"
+	"strings"
 	"time"
 	
+	"HomeIoT/internal/data"
 	"HomeIoT/internal/validator"
 	
 	"github.com/alexedwards/flow"
@@ -151,6 +155,8 @@ func (app *application) failedValidationError(w http.ResponseWriter, r *http.Req
 	tmplData := app.newTemplateData(r)
 	
 	tmplData.Form = form
+	tmplData.FieldErrors = v.FieldErrors
+	tmplData.NonFieldErrors = v.NonFieldErrors
 	
 	// render the template
 	app.render(w, r, http.StatusUnprocessableEntity, page, tmplData)
@@ -289,6 +295,39 @@ func (app *application) getUserID(r *http.Request) int {
 	return id
 }
 
+// contextGetUser retrieves the authenticated user from the request context.
+//
+// Parameters:
+//
+//	r - The HTTP request
+//
+// Returns:
+//
+//	*data.User - The authenticated user, or nil if the request is not authenticated
+func (app *application) contextGetUser(r *http.Request) *data.User {
+	user, ok := r.Context().Value(userContextKey).(*data.User)
+	if !ok {
+		return nil
+	}
+	return user
+}
+
+// contextSetUser stores the authenticated user in the request context.
+//
+// Parameters:
+//
+//	r - The HTTP request
+//	user - The authenticated user
+//
+// Returns:
+//
+//	*http.Request - A copy of the request with the user in its context
+func (app *application) contextSetUser(r *http.Request, user *data.User) *http.Request {
+	ctx := context.WithValue(r.Context(), userContextKey, user)
+	ctx = context.WithValue(ctx, isAuthenticatedContextKey, true)
+	return r.WithContext(ctx)
+}
+
 // getUserRole retrieves the user role from the session.
 //
 // Parameters:
@@ -326,6 +365,10 @@ func (app *application) newTemplateData(r *http.Request) templateData {
 		Flash:       app.sessionManager.PopString(r.Context(), "flash"),
 		Nonce:       nonce,
 		CSRFToken:   nosurf.Token(r),
+
+		IsAuthenticated: app.isAuthenticated(r),
+		UserRole:        app.getUserRole(r),
+
 		Error: struct {
 			Title   string
 			Message string
@@ -402,3 +445,471 @@ func getPathID(r *http.Request) (int, error) {
 	// return the integer id
 	return id, nil
 }
+
+// writeJSON writes a JSON response with the given status and data.
+//
+// Parameters:
+//
+//	w - The HTTP response writer
+//	status - The HTTP status code
+//	data - The data to send in the response
+//	headers - Additional headers to set in the response
+//
+// Returns:
+//
+//	error - If any error occurs during the process
+func (app *application) writeJSON(w http.ResponseWriter, status int, data envelope, headers http.Header) error {
+
+	// marshalling the data
+	js, err := json.Marshal(data)
+	if err != nil {
+		return err
+	}
+	js = append(js, '\n')
+
+	// setting the additional headers
+	for key, value := range headers {
+		w.Header()[key] = value
+	}
+
+	// setting the Content-Type header to JSON
+	w.Header().Set("Content-Type", "application/json")
+
+	// writing the status and the JSON data
+	w.WriteHeader(status)
+	_, err = w.Write(js)
+
+	return err
+}
+
+// readJSON decodes the JSON request body into a struct.
+//
+// Parameters:
+//
+//	w - The HTTP response writer
+//	r - The HTTP request
+//	dst - The destination struct to decode the JSON body into
+//
+// Returns:
+//
+//	error - If any error occurs during the decoding process
+func (app *application) readJSON(w http.ResponseWriter, r *http.Request, dst any) error {
+
+	// limiting the size of the request body to 1MB
+	r.Body = http.MaxBytesReader(w, r.Body, 1_048_576)
+
+	dec := json.NewDecoder(r.Body)
+	dec.DisallowUnknownFields()
+
+	err := dec.Decode(dst)
+	if err != nil {
+		var syntaxError *json.SyntaxError
+		var unmarshalTypeError *json.UnmarshalTypeError
+		var maxBytesError *http.MaxBytesError
+
+		switch {
+		case errors.As(err, &syntaxError):
+			return fmt.Errorf("body contains badly-formed JSON (at character %d)", syntaxError.Offset)
+		case errors.Is(err, io.ErrUnexpectedEOF):
+			return errors.New("body contains badly-formed JSON")
+		case errors.As(err, &unmarshalTypeError):
+			if unmarshalTypeError.Field != "" {
+				return fmt.Errorf("body contains incorrect JSON type for field %q", unmarshalTypeError.Field)
+			}
+			return fmt.Errorf("body contains incorrect JSON type (at character %d)", unmarshalTypeError.Offset)
+		case errors.Is(err, io.EOF):
+			return errors.New("body must not be empty")
+		case strings.HasPrefix(err.Error(), "json: unknown field "):
+			fieldName := strings.TrimPrefix(err.Error(), "json: unknown field ")
+			return fmt.Errorf("body contains unknown key %s", fieldName)
+		case errors.As(err, &maxBytesError):
+			return fmt.Errorf("body must not be larger than %d bytes", maxBytesError.Limit)
+		default:
+			return err
+		}
+	}
+
+	// making sure the body only contains a single JSON value
+	err = dec.Decode(&struct{}{})
+	if !errors.Is(err, io.EOF) {
+		return errors.New("body must only contain a single JSON value")
+	}
+
+	return nil
+}
+
+// errorJSON sends a JSON error response.
+//
+// Parameters:
+//
+//	w - The HTTP response writer
+//	r - The HTTP request
+//	status - The HTTP status code
+//	message - The error message or structure to send in the response
+func (app *application) errorJSON(w http.ResponseWriter, r *http.Request, status int, message any) {
+	err := app.writeJSON(w, status, envelope{"error": message}, nil)
+	if err != nil {
+		app.logger.Error(err.Error(), slog.String("method", r.Method), slog.String("URI", r.URL.RequestURI()))
+		w.WriteHeader(http.StatusInternalServerError)
+	}
+}
+
+// serverErrorJSON logs the error and sends a generic JSON error response.
+//
+// Parameters:
+//
+//	w - The HTTP response writer
+//	r - The HTTP request
+//	err - The error that occurred
+func (app *application) serverErrorJSON(w http.ResponseWriter, r *http.Request, err error) {
+	app.logger.Error(err.Error(), slog.String("method", r.Method), slog.String("URI", r.URL.RequestURI()), slog.String("trace", string(debug.Stack())))
+	app.errorJSON(w, r, http.StatusInternalServerError, "the server encountered a problem and could not process your request")
+}
+
+// notFoundJSON sends a 404 JSON error response.
+//
+// Parameters:
+//
+//	w - The HTTP response writer
+//	r - The HTTP request
+//	message - The error message to send in the response
+func (app *application) notFoundJSON(w http.ResponseWriter, r *http.Request, message string) {
+	app.errorJSON(w, r, http.StatusNotFound, message)
+}
+
+// publishErrorJSON sends the JSON error response matching a failed publish to the MQTT broker.
+//
+// Parameters:
+//
+//	w - The HTTP response writer
+//	r - The HTTP request
+//	err - The error returned by the publish
+func (app *application) publishErrorJSON(w http.ResponseWriter, r *http.Request, err error) {
+	app.logger.Error(err.Error(), slog.String("method", r.Method), slog.String("URI", r.URL.RequestURI()))
+
+	switch {
+	case errors.Is(err, data.ErrPublishQueueFull):
+		app.errorJSON(w, r, http.StatusServiceUnavailable, "the broker is unreachable and too many commands are waiting, try again later")
+	case errors.Is(err, context.DeadlineExceeded):
+		app.errorJSON(w, r, http.StatusGatewayTimeout, "the broker did not acknowledge the command in time")
+	default:
+		app.errorJSON(w, r, http.StatusBadGateway, "the command could not be sent to the broker")
+	}
+}
+
+// badRequestJSON sends a 400 JSON error response.
+//
+// Parameters:
+//
+//	w - The HTTP response writer
+//	r - The HTTP request
+//	err - The error describing what is wrong with the request
+func (app *application) badRequestJSON(w http.ResponseWriter, r *http.Request, err error) {
+	app.errorJSON(w, r, http.StatusBadRequest, err.Error())
+}
+
+// failedValidationJSON sends a 422 JSON response with the validation errors.
+//
+// Parameters:
+//
+//	w - The HTTP response writer
+//	r - The HTTP request
+//	v - The validator instance
+func (app *application) failedValidationJSON(w http.ResponseWriter, r *http.Request, v *validator.Validator) {
+	app.errorJSON(w, r, http.StatusUnprocessableEntity, json.RawMessage(v.Errors()))
+}
+
+// newDeviceResponse converts a device into its JSON representation.
+//
+// Parameters:
+//
+//	device - The device with its location and modules loaded
+//
+// Returns:
+//
+//	deviceResponse - The JSON representation of the device
+func (app *application) newDeviceResponse(device *data.Device) deviceResponse {
+
+	res := deviceResponse{
+		ID:        device.ID,
+		Name:      device.Name,
+		Type:      device.Type,
+		Location:  newLocationResponse(&device.Location),
+		Modules:   make([]moduleResponse, 0, len(device.Modules)),
+		Status:    device.Status(),
+		LastSeen:  device.LastSeenAt,
+		CreatedAt: device.CreatedAt,
+		UpdatedAt: device.UpdatedAt,
+	}
+
+	for _, module := range device.Modules {
+		res.Modules = append(res.Modules, app.newModuleResponse(module))
+	}
+
+	return res
+}
+
+// newModuleResponse converts a module into its JSON representation with its typed reported and desired values.
+//
+// Parameters:
+//
+//	module - The module to convert
+//
+// Returns:
+//
+//	moduleResponse - The JSON representation of the module
+func (app *application) newModuleResponse(module data.Module) moduleResponse {
+
+	res := moduleResponse{
+		ID:         module.ID,
+		Name:       module.Name,
+		Value:      module.Value,
+		ReportedAt: module.ReportedAt,
+		DesiredAt:  module.DesiredAt,
+		InSync:     module.InSync(),
+		UpdatedAt:  module.UpdatedAt,
+	}
+	if module.Desired != nil {
+		res.Desired = *module.Desired
+	}
+	if moduleType, err := data.LookupModuleType(module.Name); err == nil {
+		res.Unit, res.Writable = moduleType.Unit, moduleType.Writable
+	}
+
+	// using the typed values when the module values can be converted
+	iModule, err := module.ToIModule()
+	if err != nil {
+		app.logger.Warn("could not convert module value", slog.String("module", module.Name), slog.String("value", module.Value), slog.String("error", err.Error()))
+	} else {
+		res.Value = iModule.GetValue()
+	}
+	if module.Desired != nil {
+		iModule, err = (&data.Module{Name: module.Name, Value: *module.Desired}).ToIModule()
+		if err == nil {
+			res.Desired = iModule.GetValue()
+		}
+	}
+
+	return res
+}
+
+// newSceneResponse converts a scene into its JSON representation, the values being typed when possible.
+func newSceneResponse(scene *data.Scene) sceneResponse {
+
+	res := sceneResponse{
+		ID:        scene.ID,
+		Name:      scene.Name,
+		Targets:   make([]sceneTargetResponse, 0, len(scene.Targets)),
+		CreatedAt: scene.CreatedAt,
+		UpdatedAt: scene.UpdatedAt,
+	}
+
+	for _, target := range scene.Targets {
+		var value any = target.Value
+		iModule, err := (&data.Module{Name: target.ModuleName, Value: target.Value}).ToIModule()
+		if err == nil {
+			value = iModule.GetValue()
+		}
+		res.Targets = append(res.Targets, sceneTargetResponse{
+			DeviceID: target.DeviceID,
+			Module:   target.ModuleName,
+			Value:    value,
+		})
+	}
+
+	return res
+}
+
+// newCommandResponse converts a command into its JSON representation, the value being typed when possible.
+func newCommandResponse(command *data.Command) commandResponse {
+
+	var value any = command.Value
+	iModule, err := (&data.Module{Name: command.Module, Value: command.Value}).ToIModule()
+	if err == nil {
+		value = iModule.GetValue()
+	}
+
+	return commandResponse{
+		ID:        command.ID,
+		DeviceID:  command.DeviceID,
+		Module:    command.Module,
+		Value:     value,
+		Status:    command.Status,
+		Attempts:  command.Attempts,
+		Error:     command.Error,
+		CreatedAt: command.CreatedAt,
+		AckedAt:   command.AckedAt,
+	}
+}
+
+// readWait reads the "wait" query parameter: a duration (e.g. "3s"), or "true" for maxCommandWait.
+// The wait is capped to maxCommandWait so that the response is written before the server write timeout.
+func (app *application) readWait(r *http.Request) (time.Duration, error) {
+	wait := r.URL.Query().Get("wait")
+	switch wait {
+	case "", "false":
+		return 0, nil
+	case "true":
+		return maxCommandWait, nil
+	}
+
+	duration, err := time.ParseDuration(wait)
+	if err != nil || duration < 0 {
+		return 0, errors.New(`wait must be a duration (e.g. "3s") or true`)
+	}
+	return min(duration, maxCommandWait), nil
+}
+
+// waitCommand waits for the acknowledgement of a pending command during the requested wait, if any.
+func (app *application) waitCommand(r *http.Request, command *data.Command, wait time.Duration) (*data.Command, error) {
+	if wait <= 0 || command.Status != data.COMMAND_PENDING {
+		return command, nil
+	}
+
+	ctx, cancel := context.WithTimeout(r.Context(), wait)
+	defer cancel()
+
+	return app.Models.Command.Wait(ctx, command.ID)
+}
+
+// commandStatus returns the HTTP status reflecting the state of a command: 202 while it is waiting for its acknowledgement.
+func commandStatus(command *data.Command) int {
+	switch command.Status {
+	case data.COMMAND_ACKED:
+		return http.StatusOK
+	case data.COMMAND_FAILED:
+		return http.StatusBadGateway
+	case data.COMMAND_TIMED_OUT:
+		return http.StatusGatewayTimeout
+	default:
+		return http.StatusAccepted
+	}
+}
+
+// newLocationResponse converts a location into its JSON representation.
+//
+// Parameters:
+//
+//	location - The location to convert
+//
+// Returns:
+//
+//	locationResponse - The JSON representation of the location
+func newLocationResponse(location *data.Location) locationResponse {
+	return locationResponse{
+		ID:   location.ID,
+		Name: location.Name,
+		Type: location.Type,
+	}
+}
+
+// authorize checks that the authenticated user may perform an action on a location.
+// Denied requests are logged and get a 403 JSON response.
+//
+// Parameters:
+//
+//	w - The HTTP response writer
+//	r - The HTTP request
+//	action - The action to perform (data.ACTION_VIEW, data.ACTION_COMMAND or data.ACTION_CONFIGURE)
+//	locationID - The location concerned by the action, or 0 if the action is global
+//
+// Returns:
+//
+//	bool - True if the user may perform the action, false if the response has been written
+func (app *application) authorize(w http.ResponseWriter, r *http.Request, action string, locationID uint) bool {
+	user := app.contextGetUser(r)
+
+	ok, err := app.Models.Policy.Can(user, action, locationID)
+	if err != nil {
+		app.serverErrorJSON(w, r, err)
+		return false
+	}
+	if !ok {
+		app.logForbidden(r, user, action, locationID)
+		app.errorJSON(w, r, http.StatusForbidden, "you are not allowed to perform this action")
+		return false
+	}
+
+	return true
+}
+
+// authorizePage checks that the authenticated user may perform an action on a location.
+// Denied requests are logged and get the 403 error page.
+//
+// Parameters:
+//
+//	w - The HTTP response writer
+//	r - The HTTP request
+//	action - The action to perform (data.ACTION_VIEW, data.ACTION_COMMAND or data.ACTION_CONFIGURE)
+//	locationID - The location concerned by the action, or 0 if the action is global
+//
+// Returns:
+//
+//	bool - True if the user may perform the action, false if the response has been written
+func (app *application) authorizePage(w http.ResponseWriter, r *http.Request, action string, locationID uint) bool {
+	user := app.contextGetUser(r)
+
+	ok, err := app.Models.Policy.Can(user, action, locationID)
+	if err != nil {
+		app.serverError(w, r, err)
+		return false
+	}
+	if !ok {
+		app.logForbidden(r, user, action, locationID)
+		app.clientError(w, r, http.StatusForbidden)
+		return false
+	}
+
+	return true
+}
+
+// logForbidden logs a request denied by the access policy.
+//
+// Parameters:
+//
+//	r - The HTTP request
+//	user - The authenticated user
+//	action - The denied action
+//	locationID - The location concerned by the action, or 0 if the action is global
+func (app *application) logForbidden(r *http.Request, user *data.User, action string, locationID uint) {
+	var userID uint
+	var role string
+	if user != nil {
+		userID, role = user.ID, user.Role
+	}
+	app.logger.Warn("access denied", slog.Any("user_id", userID), slog.String("role", role), slog.String("action", action), slog.Any("location_id", locationID), slog.String("method", r.Method), slog.String("URI", r.URL.RequestURI()))
+}
+
+// newUserResponse converts a user into its JSON representation.
+//
+// Parameters:
+//
+//	user - The user to convert
+//
+// Returns:
+//
+//	userResponse - The JSON representation of the user
+func newUserResponse(user *data.User) userResponse {
+	return userResponse{
+		ID:    user.ID,
+		Name:  user.Name,
+		Email: user.Email,
+		Role:  user.Role,
+	}
+}
+
+// newGrantResponse converts a location grant into its JSON representation.
+//
+// Parameters:
+//
+//	grant - The grant with its location loaded
+//
+// Returns:
+//
+//	grantResponse - The JSON representation of the grant
+func newGrantResponse(grant *data.LocationGrant) grantResponse {
+	return grantResponse{
+		Location:   newLocationResponse(&grant.Location),
+		CanCommand: grant.CanCommand,
+	}
+}
@@ -3,11 +3,14 @@ package main
 import (
 	"fmt"
 	"log/slog"
+	"net/url"
 	"os"
 	"strconv"
+	"strings"
 	"sync"
 	"time"
 
+	"HomeIoT/internal/automation"
 	"HomeIoT/internal/data"
 	"HomeIoT/internal/mailer"
 
@@ -32,13 +35,31 @@ func main() {
 		os.Exit(1)
 	}
 	cfg.env = os.Getenv("ENVIRONMENT")
+	cfg.baseURL = strings.TrimSuffix(os.Getenv("BASE_URL"), "/")
+	// the links sent by email are never built from the Host header of the requests, which the clients choose
+	if baseURL, err := url.Parse(cfg.baseURL); err != nil || baseURL.Host == "" || (baseURL.Scheme != "https" && baseURL.Scheme != "http") {
+		fmt.Println("BASE_URL must be the public URL of the application, e.g. https://home.example.com")
+		os.Exit(1)
+	}
 
 	// Database config
 	cfg.db.dsn = os.Getenv("DATABASE_DSN")
 
 	// MQTT config
+	cfg.broker.scheme = os.Getenv("BROKER_SCHEME")
 	cfg.broker.host = os.Getenv("BROKER_HOST")
+	cfg.broker.path = os.Getenv("BROKER_PATH")
+	cfg.broker.clientID = os.Getenv("BROKER_CLIENT_ID")
+	cfg.broker.username = os.Getenv("BROKER_USERNAME")
+	cfg.broker.password = os.Getenv("BROKER_PASSWORD")
+	cfg.broker.caFile = os.Getenv("BROKER_CA_FILE")
+	cfg.broker.certFile = os.Getenv("BROKER_CERT_FILE")
+	cfg.broker.keyFile = os.Getenv("BROKER_KEY_FILE")
 	cfg.broker.subscriptionChannel = os.Getenv("BROKER_SUBSCRIPTION_CHANNEL")
+	cfg.broker.statusTopic = os.Getenv("BROKER_STATUS_TOPIC")
+	if cfg.broker.statusTopic == "" {
+		cfg.broker.statusTopic = data.DefaultHubStatusTopic
+	}
 	cfg.broker.port, err = strconv.ParseInt(os.Getenv("BROKER_PORT"), 10, 64)
 	if err != nil {
 		fmt.Println("MQTT Broker port is not a number")
@@ -50,6 +71,30 @@ func main() {
 		os.Exit(1)
 	}
 	cfg.broker.qos = byte(intQos)
+	cfg.broker.queueSize = data.DefaultOutboundQueueSize
+	if size := os.Getenv("BROKER_QUEUE_SIZE"); size != "" {
+		cfg.broker.queueSize, err = strconv.Atoi(size)
+		if err != nil || cfg.broker.queueSize < 0 {
+			fmt.Println("MQTT Broker queue size is not a valid number")
+			os.Exit(1)
+		}
+	}
+	cfg.broker.connectRetryInterval = data.DefaultConnectRetryInterval
+	if interval := os.Getenv("BROKER_CONNECT_RETRY_INTERVAL"); interval != "" {
+		cfg.broker.connectRetryInterval, err = time.ParseDuration(interval)
+		if err != nil || cfg.broker.connectRetryInterval <= 0 {
+			fmt.Println("MQTT Broker connect retry interval is not a valid duration")
+			os.Exit(1)
+		}
+	}
+	cfg.broker.maxReconnectInterval = data.DefaultMaxReconnectInterval
+	if interval := os.Getenv("BROKER_RECONNECT_MAX_INTERVAL"); interval != "" {
+		cfg.broker.maxReconnectInterval, err = time.ParseDuration(interval)
+		if err != nil || cfg.broker.maxReconnectInterval <= 0 {
+			fmt.Println("MQTT Broker max reconnect interval is not a valid duration")
+			os.Exit(1)
+		}
+	}
 
 	// SMTP config
 	cfg.smtp.sender = os.Getenv("SMTP_SENDER")
@@ -62,6 +107,83 @@ func main() {
 		os.Exit(1)
 	}
 
+	// Devices config
+	cfg.heartbeats, err = automation.ParseHeartbeats(os.Getenv("DEVICE_HEARTBEAT_TIMEOUT"), os.Getenv("DEVICE_HEARTBEAT_TIMEOUTS"))
+	if err != nil {
+		fmt.Println(err.Error())
+		os.Exit(1)
+	}
+	cfg.setupDelay = data.DefaultSetupDelay
+	if delay := os.Getenv("DEVICE_SETUP_DELAY"); delay != "" {
+		cfg.setupDelay, err = time.ParseDuration(delay)
+		if err != nil || cfg.setupDelay < 0 {
+			fmt.Println("Device setup delay is not a valid duration")
+			os.Exit(1)
+		}
+	}
+
+	// Commands config
+	cfg.commands.ackTimeout = automation.DefaultAckTimeout
+	if timeout := os.Getenv("COMMAND_ACK_TIMEOUT"); timeout != "" {
+		cfg.commands.ackTimeout, err = time.ParseDuration(timeout)
+		if err != nil || cfg.commands.ackTimeout <= 0 {
+			fmt.Println("Command ack timeout is not a valid duration")
+			os.Exit(1)
+		}
+	}
+	cfg.commands.maxAttempts = automation.DefaultMaxAttempts
+	if attempts := os.Getenv("COMMAND_MAX_ATTEMPTS"); attempts != "" {
+		cfg.commands.maxAttempts, err = strconv.Atoi(attempts)
+		if err != nil || cfg.commands.maxAttempts < 1 {
+			fmt.Println("Command max attempts is not a valid number")
+			os.Exit(1)
+		}
+	}
+	cfg.commands.retention = automation.DefaultCommandRetention
+	if retention := os.Getenv("COMMAND_RETENTION"); retention != "" {
+		cfg.commands.retention, err = time.ParseDuration(retention)
+		if err != nil || cfg.commands.retention <= 0 {
+			fmt.Println("Command retention is not a valid duration")
+			os.Exit(1)
+		}
+	}
+
+	// Ingestion config
+	cfg.ingest = data.IngestConfig{
+		Workers:       data.DefaultIngestWorkers,
+		QueueSize:     data.DefaultIngestQueueSize,
+		BatchSize:     data.DefaultIngestBatchSize,
+		FlushInterval: data.DefaultIngestFlushInterval,
+	}
+	if workers := os.Getenv("INGEST_WORKERS"); workers != "" {
+		cfg.ingest.Workers, err = strconv.Atoi(workers)
+		if err != nil || cfg.ingest.Workers < 1 {
+			fmt.Println("Number of ingestion workers is not a valid number")
+			os.Exit(1)
+		}
+	}
+	if queueSize := os.Getenv("INGEST_QUEUE_SIZE"); queueSize != "" {
+		cfg.ingest.QueueSize, err = strconv.Atoi(queueSize)
+		if err != nil || cfg.ingest.QueueSize < 1 {
+			fmt.Println("Ingestion queue size is not a valid number")
+			os.Exit(1)
+		}
+	}
+	if batchSize := os.Getenv("INGEST_BATCH_SIZE"); batchSize != "" {
+		cfg.ingest.BatchSize, err = strconv.Atoi(batchSize)
+		if err != nil || cfg.ingest.BatchSize < 1 {
+			fmt.Println("Ingestion batch size is not a valid number")
+			os.Exit(1)
+		}
+	}
+	if interval := os.Getenv("INGEST_FLUSH_INTERVAL"); interval != "" {
+		cfg.ingest.FlushInterval, err = time.ParseDuration(interval)
+		if err != nil || cfg.ingest.FlushInterval <= 0 {
+			fmt.Println("Ingestion flush interval is not a valid duration")
+			os.Exit(1)
+		}
+	}
+
 	// setting the logging level according to the environment
 	var opts *slog.HandlerOptions
 
@@ -101,7 +223,7 @@ func main() {
 	//err = db.AutoMigrate(&data.Data{}, &data.Module{})
 
 	// Migrer les modèles
-	db.AutoMigrate(&data.Data{}, &data.Module{})
+	db.AutoMigrate(&data.Data{}, &data.Module{}, &data.User{}, &data.LocationGrant{}, &data.Token{}, &data.Rule{}, &data.RuleCondition{}, &data.RuleAction{}, &data.RuleRun{}, &data.Alarm{}, &data.AlertRecipient{}, &data.StatusNotification{}, &data.Schedule{}, &data.ScheduleRun{}, &data.Scene{}, &data.SceneTarget{}, &data.Command{})
 
 	// Créer la table intermédiaire devices_modules
 	//if !db.Migrator().HasTable("devices_modules") {
@@ -134,8 +256,28 @@ func main() {
 	sessionManager.Lifetime = 24 * time.Hour
 	sessionManager.Cookie.Secure = true
 
-	// connecting to the broker
-	broker := data.NewBroker(cfg.broker.host, cfg.broker.port, cfg.broker.qos)
+	// connecting to the broker, retried in the background until it is reachable
+	broker, err := data.NewBroker(data.BrokerConfig{
+		Scheme:               cfg.broker.scheme,
+		Host:                 cfg.broker.host,
+		Port:                 cfg.broker.port,
+		Path:                 cfg.broker.path,
+		QoS:                  cfg.broker.qos,
+		StatusTopic:          cfg.broker.statusTopic,
+		ClientID:             cfg.broker.clientID,
+		Username:             cfg.broker.username,
+		Password:             cfg.broker.password,
+		CAFile:               cfg.broker.caFile,
+		CertFile:             cfg.broker.certFile,
+		KeyFile:              cfg.broker.keyFile,
+		QueueSize:            cfg.broker.queueSize,
+		ConnectRetryInterval: cfg.broker.connectRetryInterval,
+		MaxReconnectInterval: cfg.broker.maxReconnectInterval,
+	}, logger)
+	if err != nil {
+		logger.Error(err.Error())
+		os.Exit(1)
+	}
 
 	app := &application{
 		logger:         logger,
@@ -144,15 +286,64 @@ func main() {
 		templateCache:  templateCache,
 		formDecoder:    formDecoder,
 		config:         &cfg,
-		Models:         data.NewModels(db, broker, logger),
+		Models:         data.NewModels(db, broker, logger, cfg.ingest, cfg.setupDelay),
 		wg:             new(sync.WaitGroup),
 	}
 
-	// subscribing to the MQTT Broker
+	// evaluating the automation rules on the incoming readings
+	app.ruleEngine = &automation.RuleEngine{
+		Models:     app.Models,
+		Mailer:     app.mailer,
+		Logger:     logger,
+		Sender:     cfg.smtp.sender,
+		Background: app.background,
+	}
+	app.background(app.ruleEngine.Run)
+
+	// alerting the recipients of the presences detected while the home is armed
+	app.alertNotifier = &automation.AlertNotifier{
+		Models:     app.Models,
+		Mailer:     app.mailer,
+		Logger:     logger,
+		Sender:     cfg.smtp.sender,
+		Background: app.background,
+	}
+	app.background(app.alertNotifier.Run)
+
+	// running the scheduled commands, stopped on shutdown
+	app.scheduler = automation.NewScheduler(app.Models, logger, app.background)
+	app.background(app.scheduler.Run)
+
+	// setting offline the devices without heartbeat, stopped on shutdown
+	app.deviceMonitor = automation.NewDeviceMonitor(app.Models, app.mailer, logger, cfg.heartbeats, cfg.smtp.sender, app.background)
+	app.background(app.deviceMonitor.Run)
+
+	// retrying the commands not acknowledged by the devices, stopped on shutdown
+	app.commandTracker = automation.NewCommandTracker(app.Models, logger, cfg.commands.ackTimeout, cfg.commands.maxAttempts, cfg.commands.retention)
+	app.background(app.commandTracker.Run)
+
+	// making sure the system can be administered
+	err = app.Models.User.EnsureAdmin()
+	if err != nil {
+		logger.Error(err.Error())
+		os.Exit(1)
+	}
+
+	// storing the readings out of the MQTT handlers, stopped on shutdown once the queued readings are stored
+	app.background(app.Models.Data.Ingester.Run)
+
+	// replying the setup to the devices which start, stopped on shutdown
+	app.background(app.Models.Data.Startups.Run)
+
+	// subscribing to the MQTT Broker, the status topics of the devices included
 	app.Models.Data.Sub(app.config.broker.subscriptionChannel)
 
 	// Running the server
 	err = app.serve()
+
+	// publishing the hub status as offline once the background tasks are done
+	broker.Close()
+
 	if err != nil {
 		logger.Error(err.Error())
 		os.Exit(1)
@@ -2,9 +2,13 @@ package main
 
 import (
 	"context"
+	"errors"
 	"fmt"
 	"log/slog"
 	"net/http"
+	"strings"
+	
+	"HomeIoT/internal/data"
 	
 	"github.com/justinas/nosurf"
 )
@@ -12,6 +16,8 @@ import (
 const (
 	authenticatedUserIDSessionManager = "authenticated_user_id"
 	userRoleSessionManager            = "user_role"
+	redirectPathSessionManager        = "redirect_path"
+	userVersionSessionManager         = "user_version"
 )
 
 // commonHeaders middleware sets common HTTP headers and generates a nonce for script security.
@@ -120,3 +126,146 @@ func noSurf(next http.Handler) http.Handler {
 	
 	return csrfHandler
 }
+
+// authenticate middleware retrieves the user from the session and stores it in the request context.
+//
+// Parameters:
+//
+//	next - The next handler in the chain
+//
+// Returns:
+//
+//	http.Handler - A new handler that authenticates the request
+func (app *application) authenticate(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		
+		// checking if the session holds a user
+		id := app.getUserID(r)
+		if id == 0 {
+			next.ServeHTTP(w, r)
+			return
+		}
+		
+		// checking that the user still exists
+		user, err := app.Models.User.Get(uint(id))
+		if err != nil {
+			if !errors.Is(err, data.ErrRecordNotFound) {
+				app.serverError(w, r, err)
+				return
+			}
+			app.sessionManager.Remove(r.Context(), authenticatedUserIDSessionManager)
+			next.ServeHTTP(w, r)
+			return
+		}
+		
+		// the sessions opened before a password change are no longer valid
+		if version, _ := app.sessionManager.Get(r.Context(), userVersionSessionManager).(int); version != user.Version {
+			err = app.logout(r)
+			if err != nil {
+				app.serverError(w, r, err)
+				return
+			}
+			next.ServeHTTP(w, r)
+			return
+		}
+		
+		// keeping the role in the session up to date if an admin changed it
+		if app.getUserRole(r) != user.Role {
+			app.sessionManager.Put(r.Context(), userRoleSessionManager, user.Role)
+		}
+		
+		next.ServeHTTP(w, app.contextSetUser(r, user))
+	})
+}
+
+// authenticateAPI middleware authenticates the API requests with their HTTP Basic credentials.
+// The session cookie is not accepted: the API is not protected against CSRF, any site visited by a logged-in user could use it.
+//
+// Parameters:
+//
+//	next - The next handler in the chain
+//
+// Returns:
+//
+//	http.Handler - A new handler that authenticates the request
+func (app *application) authenticateAPI(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		
+		// scripts and the mobile app use Basic credentials instead of a session cookie
+		email, password, ok := r.BasicAuth()
+		if !ok {
+			// left anonymous, requireAuthenticationJSON rejects the request
+			next.ServeHTTP(w, r)
+			return
+		}
+		
+		user, err := app.Models.User.Authenticate(email, password)
+		if err != nil {
+			switch {
+			case errors.Is(err, data.ErrInvalidCredentials):
+				w.Header().Set("WWW-Authenticate", `Basic realm="Home IoT", charset="UTF-8"`)
+				app.errorJSON(w, r, http.StatusUnauthorized, "invalid authentication credentials")
+			default:
+				app.serverErrorJSON(w, r, err)
+			}
+			return
+		}
+		
+		next.ServeHTTP(w, app.contextSetUser(r, user))
+	})
+}
+
+// requireAuthentication middleware redirects the unauthenticated users to the login page.
+//
+// Parameters:
+//
+//	next - The next handler in the chain
+//
+// Returns:
+//
+//	http.Handler - A new handler that only lets authenticated users through
+func (app *application) requireAuthentication(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		
+		if !app.isAuthenticated(r) {
+			
+			// AJAX requests get a JSON error instead of a redirection
+			accept := r.Header.Get("Accept")
+			if r.Method != http.MethodGet || strings.Contains(accept, "application/json") || strings.Contains(accept, "text/event-stream") {
+				app.errorJSON(w, r, http.StatusUnauthorized, "you must be authenticated to access this resource")
+				return
+			}
+			
+			app.sessionManager.Put(r.Context(), redirectPathSessionManager, r.URL.RequestURI())
+			http.Redirect(w, r, "/login", http.StatusSeeOther)
+			return
+		}
+		
+		// the pages of authenticated users must not be stored in the browser cache
+		w.Header().Add("Cache-Control", "no-store")
+		
+		next.ServeHTTP(w, r)
+	})
+}
+
+// requireAuthenticationJSON middleware rejects the unauthenticated API requests.
+//
+// Parameters:
+//
+//	next - The next handler in the chain
+//
+// Returns:
+//
+//	http.Handler - A new handler that only lets authenticated users through
+func (app *application) requireAuthenticationJSON(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		
+		if !app.isAuthenticated(r) {
+			w.Header().Set("WWW-Authenticate", `Basic realm="Home IoT", charset="UTF-8"`)
+			app.errorJSON(w, r, http.StatusUnauthorized, "you must be authenticated to access this resource")
+			return
+		}
+		
+		next.ServeHTTP(w, r)
+	})
+}
@@ -4,7 +4,9 @@ import (
 	"html/template"
 	"log/slog"
 	"sync"
+	"time"
 
+	"HomeIoT/internal/automation"
 	"HomeIoT/internal/data"
 	"HomeIoT/internal/mailer"
 	"HomeIoT/internal/validator"
@@ -15,13 +17,26 @@ import (
 
 // config represents the configuration variables for the application.
 type config struct {
-	port   int64
-	env    string
-	broker struct {
-		host                string
-		port                int64
-		subscriptionChannel string
-		qos                 byte
+	port    int64
+	env     string
+	baseURL string
+	broker  struct {
+		scheme               string
+		host                 string
+		port                 int64
+		path                 string
+		subscriptionChannel  string
+		statusTopic          string
+		clientID             string
+		username             string
+		password             string
+		caFile               string
+		certFile             string
+		keyFile              string
+		connectRetryInterval time.Duration
+		maxReconnectInterval time.Duration
+		queueSize            int
+		qos                  byte
 	}
 	db struct {
 		dsn string
@@ -33,6 +48,14 @@ type config struct {
 		password string
 		sender   string
 	}
+	heartbeats automation.Heartbeats
+	setupDelay time.Duration
+	commands   struct {
+		ackTimeout  time.Duration
+		maxAttempts int
+		retention   time.Duration
+	}
+	ingest data.IngestConfig
 }
 
 // application represents the application configuration.
@@ -43,6 +66,11 @@ type application struct {
 	formDecoder    *form.Decoder
 	sessionManager *scs.SessionManager
 	Models         data.Models
+	ruleEngine     *automation.RuleEngine
+	alertNotifier  *automation.AlertNotifier
+	scheduler      *automation.Scheduler
+	deviceMonitor  *automation.DeviceMonitor
+	commandTracker *automation.CommandTracker
 	config         *config
 	wg             *sync.WaitGroup
 }
@@ -57,11 +85,26 @@ type templateData struct {
 	CSRFToken   string
 	ResetToken  string
 
+	IsAuthenticated bool
+	UserRole        string
+
 	Devices   []*data.Device
 	Locations []*data.Location
 	Device    *data.Device
 	Location  *data.Location
 
+	Rules      []*data.Rule
+	Rule       *data.Rule
+	RuleRuns   []*data.RuleRun
+	Evaluation *automation.Evaluation
+
+	Alarm           *data.Alarm
+	AlertRecipients []*data.AlertRecipient
+
+	Schedules    []*data.Schedule
+	Schedule     *data.Schedule
+	ScheduleRuns []*data.ScheduleRun
+
 	Error struct {
 		Title   string
 		Message string
@@ -73,9 +116,158 @@ type templateData struct {
 // envelope is a data type for JSON responses.
 type envelope map[string]any
 
+// locationResponse represents a location in the JSON responses.
+type locationResponse struct {
+	ID   uint   `json:"id"`
+	Name string `json:"name"`
+	Type string `json:"type"`
+}
+
+// moduleResponse represents a module with its typed reported and desired values in the JSON responses.
+type moduleResponse struct {
+	ID         uint       `json:"id"`
+	Name       string     `json:"name"`
+	Value      any        `json:"value"`
+	Unit       string     `json:"unit,omitempty"`
+	Writable   bool       `json:"writable"`
+	ReportedAt *time.Time `json:"reported_at"`
+	Desired    any        `json:"desired"`
+	DesiredAt  *time.Time `json:"desired_at"`
+	InSync     bool       `json:"in_sync"`
+	UpdatedAt  time.Time  `json:"updated_at"`
+}
+
+// deviceResponse represents a device with its location and modules in the JSON responses.
+type deviceResponse struct {
+	ID        string           `json:"id"`
+	Name      string           `json:"name"`
+	Type      string           `json:"type"`
+	Location  locationResponse `json:"location"`
+	Modules   []moduleResponse `json:"modules"`
+	Status    string           `json:"status"`
+	LastSeen  *time.Time       `json:"last_seen"`
+	CreatedAt time.Time        `json:"created_at"`
+	UpdatedAt time.Time        `json:"updated_at"`
+}
+
+// userResponse represents a user in the JSON responses.
+type userResponse struct {
+	ID    uint   `json:"id"`
+	Name  string `json:"name"`
+	Email string `json:"email"`
+	Role  string `json:"role"`
+}
+
+// grantResponse represents the access of a guest to a location in the JSON responses.
+type grantResponse struct {
+	Location   locationResponse `json:"location"`
+	CanCommand bool             `json:"can_command"`
+}
+
+// sceneTargetResponse represents a module value of a scene in the JSON responses.
+type sceneTargetResponse struct {
+	DeviceID string `json:"device_id"`
+	Module   string `json:"module"`
+	Value    any    `json:"value"`
+}
+
+// sceneResponse represents a scene and its targets in the JSON responses.
+type sceneResponse struct {
+	ID        uint                  `json:"id"`
+	Name      string                `json:"name"`
+	Targets   []sceneTargetResponse `json:"targets"`
+	CreatedAt time.Time             `json:"created_at"`
+	UpdatedAt time.Time             `json:"updated_at"`
+}
+
+// commandResponse represents a command sent to a module and the state of its acknowledgement in the JSON responses.
+type commandResponse struct {
+	ID        string     `json:"id"`
+	DeviceID  string     `json:"device_id"`
+	Module    string     `json:"module"`
+	Value     any        `json:"value"`
+	Status    string     `json:"status"`
+	Attempts  int        `json:"attempts"`
+	Error     string     `json:"error,omitempty"`
+	CreatedAt time.Time  `json:"created_at"`
+	AckedAt   *time.Time `json:"acked_at,omitempty"`
+}
+
 // userLoginForm represents the form used for user login.
 type userLoginForm struct {
 	Email               string `form:"email"`
 	Password            string `form:"password"`
 	validator.Validator `form:"-"`
 }
+
+// userRegisterForm represents the form used for user registration.
+type userRegisterForm struct {
+	Name                string `form:"name"`
+	Email               string `form:"email"`
+	Password            string `form:"password"`
+	ConfirmPassword     string `form:"confirm_password"`
+	Role                string `form:"role"`
+	validator.Validator `form:"-"`
+}
+
+// forgotPasswordForm represents the form used to request a password reset.
+type forgotPasswordForm struct {
+	Email               string `form:"email"`
+	validator.Validator `form:"-"`
+}
+
+// resetPasswordForm represents the form used to choose a new password.
+type resetPasswordForm struct {
+	Token               string `form:"token"`
+	NewPassword         string `form:"new_password"`
+	ConfirmPassword     string `form:"confirm_password"`
+	validator.Validator `form:"-"`
+}
+
+// ruleForm represents the form used to create or edit an automation rule.
+// Blank condition and action rows are ignored.
+type ruleForm struct {
+	Name                string              `form:"name"`
+	Match               string              `form:"match"`
+	Enabled             bool                `form:"enabled"`
+	DryRun              bool                `form:"dry_run"`
+	Conditions          []ruleConditionForm `form:"conditions"`
+	Actions             []ruleActionForm    `form:"actions"`
+	validator.Validator `form:"-"`
+}
+
+// ruleConditionForm represents a condition row of the rule form.
+// Target is either "<deviceID>/<module>" or "<deviceID>".
+type ruleConditionForm struct {
+	Target   string `form:"target"`
+	Operator string `form:"operator"`
+	Value    string `form:"value"`
+}
+
+// ruleActionForm represents an action row of the rule form.
+type ruleActionForm struct {
+	Type      string `form:"type"`
+	Target    string `form:"target"`
+	Value     string `form:"value"`
+	Recipient string `form:"recipient"`
+}
+
+// alertRecipientForm represents the form used to add an alert recipient.
+type alertRecipientForm struct {
+	Email               string `form:"email"`
+	Cooldown            int    `form:"cooldown"`
+	validator.Validator `form:"-"`
+}
+
+// scheduleForm represents the form used to create or edit a schedule.
+// Target is either "<deviceID>/<module>", "<deviceID>" or empty for every device.
+type scheduleForm struct {
+	Name                string `form:"name"`
+	Spec                string `form:"spec"`
+	Enabled             bool   `form:"enabled"`
+	MissedPolicy        string `form:"missed_policy"`
+	ActionType          string `form:"action_type"`
+	Target              string `form:"target"`
+	Value               string `form:"value"`
+	validator.Validator `form:"-"`
+}
@@ -33,25 +33,134 @@ func (app *application) routes() http.Handler {
 	
 	router.Handle("/static/...", http.StripPrefix("/static/", http.FileServerFS(staticFs)), http.MethodGet) // static files
 	
-	router.Use(app.recoverPanic, app.logRequest, commonHeaders, app.sessionManager.LoadAndSave, noSurf)
+	router.Use(app.recoverPanic, app.logRequest, commonHeaders, app.sessionManager.LoadAndSave)
 	
-	// ###########################################################
-	// #						COMMON						 	 #
-	// ###########################################################
-	
-	router.HandleFunc("/", app.dashboard, http.MethodGet) // dashboard page
+	router.HandleFunc("/healthcheck", app.healthcheck, http.MethodGet) // server and broker health
 	
 	// ###########################################################
-	// #					   COMMANDS						 	 #
+	// #						API V1						 	 #
 	// ###########################################################
 	
-	router.HandleFunc("/:location/:locationID/:device/:deviceID/:information", app.commandDevice, http.MethodPost) // command relay route
-	
-	// ###########################################################
-	// #						AJAX							 #
-	// ###########################################################
+	// the API is used by scripts and the mobile app with Basic credentials only, so it is not protected by the CSRF middleware
+	router.Group(func(api *flow.Mux) {
+		
+		api.Use(app.authenticateAPI, app.requireAuthenticationJSON)
+		
+		// locations
+		api.HandleFunc("/api/v1/locations", app.listLocationsAPI, http.MethodGet)
+		api.HandleFunc("/api/v1/locations", app.createLocationAPI, http.MethodPost)
+		api.HandleFunc("/api/v1/locations/:id|^[0-9]+$", app.showLocationAPI, http.MethodGet)
+		api.HandleFunc("/api/v1/locations/:id|^[0-9]+$", app.updateLocationAPI, http.MethodPatch)
+		api.HandleFunc("/api/v1/locations/:id|^[0-9]+$", app.deleteLocationAPI, http.MethodDelete)
+		
+		// devices
+		api.HandleFunc("/api/v1/devices", app.listDevicesAPI, http.MethodGet)
+		api.HandleFunc("/api/v1/devices", app.createDeviceAPI, http.MethodPost)
+		api.HandleFunc("/api/v1/devices/:id", app.showDeviceAPI, http.MethodGet)
+		api.HandleFunc("/api/v1/devices/:id", app.updateDeviceAPI, http.MethodPatch)
+		api.HandleFunc("/api/v1/devices/:id", app.deleteDeviceAPI, http.MethodDelete)
+		api.HandleFunc("/api/v1/devices/:id/reset", app.resetDeviceAPI, http.MethodPost)
+		
+		// modules
+		api.HandleFunc("/api/v1/devices/:id/modules", app.listModulesAPI, http.MethodGet)
+		api.HandleFunc("/api/v1/devices/:id/modules", app.createModuleAPI, http.MethodPost)
+		api.HandleFunc("/api/v1/modules/:id|^[0-9]+$", app.showModuleAPI, http.MethodGet)
+		api.HandleFunc("/api/v1/modules/:id|^[0-9]+$", app.updateModuleAPI, http.MethodPatch)
+		api.HandleFunc("/api/v1/modules/:id|^[0-9]+$", app.deleteModuleAPI, http.MethodDelete)
+		
+		// commands
+		api.HandleFunc("/api/v1/commands/:id|^[0-9a-f]{32}$", app.showCommandAPI, http.MethodGet)
+		
+		// history
+		api.HandleFunc("/api/v1/devices/:id/modules/:module/history", app.moduleHistoryAPI, http.MethodGet)
+		
+		// users & grants
+		api.HandleFunc("/api/v1/users", app.listUsersAPI, http.MethodGet)
+		api.HandleFunc("/api/v1/users/:id|^[0-9]+$/role", app.updateUserRoleAPI, http.MethodPut)
+		api.HandleFunc("/api/v1/users/:id|^[0-9]+$/grants", app.listGrantsAPI, http.MethodGet)
+		api.HandleFunc("/api/v1/users/:id|^[0-9]+$/grants", app.setGrantAPI, http.MethodPut)
+		api.HandleFunc("/api/v1/users/:id|^[0-9]+$/grants/:locationID|^[0-9]+$", app.deleteGrantAPI, http.MethodDelete)
+		
+		// scenes
+		api.HandleFunc("/api/v1/scenes", app.listScenesAPI, http.MethodGet)
+		api.HandleFunc("/api/v1/scenes", app.createSceneAPI, http.MethodPost)
+		api.HandleFunc("/api/v1/scenes/capture", app.captureSceneAPI, http.MethodPost)
+		api.HandleFunc("/api/v1/scenes/:id|^[0-9]+$", app.showSceneAPI, http.MethodGet)
+		api.HandleFunc("/api/v1/scenes/:id|^[0-9]+$", app.updateSceneAPI, http.MethodPatch)
+		api.HandleFunc("/api/v1/scenes/:id|^[0-9]+$", app.deleteSceneAPI, http.MethodDelete)
+		api.HandleFunc("/api/v1/scenes/:id|^[0-9]+$/apply", app.applySceneAPI, http.MethodPost)
+	})
 	
-	router.HandleFunc("/:location/:locationID/:device/:deviceID", app.getDeviceInfo, http.MethodGet) // device info route
+	router.Group(func(web *flow.Mux) {
+		
+		web.Use(noSurf, app.authenticate)
+		
+		// ###########################################################
+		// #						USERS						 	 #
+		// ###########################################################
+		
+		web.HandleFunc("/login", app.login, http.MethodGet)            // login page
+		web.HandleFunc("/login", app.loginPost, http.MethodPost)       // login route
+		web.HandleFunc("/register", app.register, http.MethodGet)      // registration page
+		web.HandleFunc("/register", app.registerPost, http.MethodPost) // registration route
+		
+		web.HandleFunc("/forgot-password", app.forgotPassword, http.MethodGet)      // forgot password page
+		web.HandleFunc("/forgot-password", app.forgotPasswordPost, http.MethodPost) // password reset request route
+		web.HandleFunc("/reset-password", app.resetPassword, http.MethodGet)        // reset password page
+		web.HandleFunc("/reset-password", app.resetPasswordPost, http.MethodPost)   // reset password route
+		
+		web.Group(func(protected *flow.Mux) {
+			
+			protected.Use(app.requireAuthentication)
+			
+			protected.HandleFunc("/logout", app.logoutPost, http.MethodPost) // logout route
+			
+			// ###########################################################
+			// #						COMMON						 	 #
+			// ###########################################################
+			
+			protected.HandleFunc("/", app.dashboard, http.MethodGet)    // dashboard page
+			protected.HandleFunc("/events", app.events, http.MethodGet) // live updates stream
+			
+			// ###########################################################
+			// #					   COMMANDS						 	 #
+			// ###########################################################
+			
+			protected.HandleFunc("/:location/:locationID|^[0-9]+$/:device/:deviceID/:information", app.commandDevice, http.MethodPost) // command relay route
+			protected.HandleFunc("/commands/:id|^[0-9a-f]{32}$", app.showCommandAPI, http.MethodGet)                                   // command acknowledgement route
+			
+			// ###########################################################
+			// #					  AUTOMATIONS					 	 #
+			// ###########################################################
+			
+			protected.HandleFunc("/rules", app.rules, http.MethodGet)                               // automation rules page
+			protected.HandleFunc("/rules/create", app.ruleCreate, http.MethodGet)                   // rule creation page
+			protected.HandleFunc("/rules/create", app.ruleCreatePost, http.MethodPost)              // rule creation route
+			protected.HandleFunc("/rules/:id|^[0-9]+$", app.ruleEdit, http.MethodGet)               // rule edition page
+			protected.HandleFunc("/rules/:id|^[0-9]+$", app.ruleEditPost, http.MethodPost)          // rule edition route
+			protected.HandleFunc("/rules/:id|^[0-9]+$/delete", app.ruleDeletePost, http.MethodPost) // rule deletion route
+			protected.HandleFunc("/rules/:id|^[0-9]+$/test", app.ruleTest, http.MethodGet)          // rule dry evaluation page
+			
+			protected.HandleFunc("/schedules", app.schedules, http.MethodGet)                               // schedules page
+			protected.HandleFunc("/schedules/create", app.scheduleCreate, http.MethodGet)                   // schedule creation page
+			protected.HandleFunc("/schedules/create", app.scheduleCreatePost, http.MethodPost)              // schedule creation route
+			protected.HandleFunc("/schedules/:id|^[0-9]+$", app.scheduleEdit, http.MethodGet)               // schedule edition page
+			protected.HandleFunc("/schedules/:id|^[0-9]+$", app.scheduleEditPost, http.MethodPost)          // schedule edition route
+			protected.HandleFunc("/schedules/:id|^[0-9]+$/delete", app.scheduleDeletePost, http.MethodPost) // schedule deletion route
+			
+			protected.HandleFunc("/alerts", app.alerts, http.MethodGet)                                                   // alerts page
+			protected.HandleFunc("/alerts/arm", app.alertsArmPost, http.MethodPost)                                       // arming route
+			protected.HandleFunc("/alerts/disarm", app.alertsDisarmPost, http.MethodPost)                                 // disarming route
+			protected.HandleFunc("/alerts/recipients", app.alertRecipientCreatePost, http.MethodPost)                     // alert recipient creation route
+			protected.HandleFunc("/alerts/recipients/:id|^[0-9]+$/delete", app.alertRecipientDeletePost, http.MethodPost) // alert recipient deletion route
+			
+			// ###########################################################
+			// #						AJAX							 #
+			// ###########################################################
+			
+			protected.HandleFunc("/:location/:locationID|^[0-9]+$/:device/:deviceID", app.getDeviceInfo, http.MethodGet) // device info route
+		})
+	})
 	
 	return router
 }
@@ -36,6 +36,24 @@ func (app *application) serve() error {
 		WriteTimeout:      10 * time.Second,
 	}
 	
+	// closing the event streams so that they don't hold the shutdown
+	srv.RegisterOnShutdown(app.Models.Events.Close)
+	
+	// stopping the scheduler, the runs in progress are waited for with the background tasks
+	srv.RegisterOnShutdown(app.scheduler.Stop)
+	
+	// stopping the device monitor, the emails being sent are waited for with the background tasks
+	srv.RegisterOnShutdown(app.deviceMonitor.Stop)
+	
+	// stopping the command tracker, the pending commands are checked again on the next start
+	srv.RegisterOnShutdown(app.commandTracker.Stop)
+	
+	// stopping the ingestion, the queued readings are stored with the background tasks
+	srv.RegisterOnShutdown(app.Models.Data.Ingester.Stop)
+	
+	// stopping the startup worker, the setup replies still waiting for their delay are cancelled
+	srv.RegisterOnShutdown(app.Models.Data.Startups.Stop)
+	
 	// setting the error channel to shut the server down
 	shutdownError := make(chan error)
 	
@@ -6,6 +6,7 @@ import (
 	"path/filepath"
 	"time"
 	
+	"HomeIoT/internal/data"
 	"HomeIoT/ui"
 )
 
@@ -16,6 +17,8 @@ var functions = template.FuncMap{
 	"increment":         increment,
 	"decrement":         decrement,
 	"transactionStatus": transactionStatus,
+	"isWritable":        data.IsWritable,
+	"moduleKind":        moduleKind,
 }
 
 func transactionStatus(transactionStatus any, status string) string {
@@ -81,6 +84,20 @@ func decrement(n int) int {
 	return n - 1
 }
 
+// moduleKind returns the kind of value a module holds.
+//
+// Parameters:
+//
+//	name - The name of the module
+//
+// Returns:
+//
+//	string - The kind of the module (see data.KIND_BOOLEAN), or an empty string for an unknown module
+func moduleKind(name string) string {
+	kind, _ := data.ModuleKind(name)
+	return kind
+}
+
 // newTemplateCache creates a template cache from the templates in the ui.Files file system.
 //
 // Returns:
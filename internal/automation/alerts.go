@@ -0,0 +1,101 @@
+package automation
+
+import (
+	"fmt"
+	"log/slog"
+	"time"
+
+	"HomeIoT/internal/data"
+	"HomeIoT/internal/mailer"
+)
+
+// alertEventsBuffer is the number of presence readings waiting to be handled before new ones are dropped.
+const alertEventsBuffer = 64
+
+// AlertNotifier emails the alert recipients when a presence is detected while the home is armed.
+type AlertNotifier struct {
+	Models data.Models
+	Mailer mailer.Mailer
+	Logger *slog.Logger
+
+	// Sender is the contact address displayed in the emails
+	Sender string
+
+	// Background sends the emails without holding the handling of the next readings
+	Background func(func())
+}
+
+/**
+ * Run handles the presence readings published on the EventBus.
+ * It returns when the EventBus is closed, on shutdown.
+ */
+func (n *AlertNotifier) Run() {
+	sub := n.Models.Events.Subscribe(alertEventsBuffer, func(event data.Event) bool {
+		return event.Type == data.EVENT_READING && event.Module == data.PRESENCE_DETECTOR
+	})
+	defer sub.Close()
+
+	for event := range sub.C {
+		n.HandlePresence(event)
+	}
+}
+
+// HandlePresence alerts the recipients out of their cooldown when a presence is detected in an armed home.
+func (n *AlertNotifier) HandlePresence(event data.Event) {
+	present, err := data.ToBool(event.Value)
+	if err != nil || !present {
+		return
+	}
+
+	alarm, err := n.Models.Alert.GetAlarm()
+	if err != nil {
+		n.Logger.Error(err.Error())
+		return
+	}
+	if !alarm.Armed {
+		return
+	}
+
+	device, err := n.Models.Device.GetByID(event.DeviceID)
+	if err != nil {
+		n.Logger.Error(fmt.Errorf("error getting device of presence alert: %w", err).Error())
+		return
+	}
+
+	n.Logger.Warn("presence detected while armed", slog.String("device", device.ID), slog.String("location", device.Location.Name))
+
+	recipients, err := n.Models.Alert.GetRecipients()
+	if err != nil {
+		n.Logger.Error(err.Error())
+		return
+	}
+
+	mailData := map[string]any{
+		"Device":   device.Name,
+		"DeviceID": device.ID,
+		"Location": device.Location.Name,
+		"Time":     event.Time.Local().Format("02 Jan 2006 at 15:04:05"),
+		"Email":    n.Sender,
+	}
+
+	now := time.Now()
+	for _, recipient := range recipients {
+		ok, err := n.Models.Alert.ClaimRecipient(recipient, now)
+		if err != nil {
+			n.Logger.Error(err.Error())
+			continue
+		}
+		if !ok {
+			n.Logger.Debug("alert recipient in cooldown", slog.String("recipient", recipient.Email))
+			continue
+		}
+
+		email := recipient.Email
+		n.Background(func() {
+			err := n.Mailer.Send(email, "alert-notification.tmpl", mailData)
+			if err != nil {
+				n.Logger.Error(fmt.Errorf("error sending alert email to %s: %w", email, err).Error())
+			}
+		})
+	}
+}
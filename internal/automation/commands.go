@@ -0,0 +1,166 @@
+package automation
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log/slog"
+	"sync"
+	"time"
+
+	"HomeIoT/internal/data"
+)
+
+// Default acknowledgement policy of the commands
+const (
+	DefaultAckTimeout  = 5 * time.Second
+	DefaultMaxAttempts = 3
+)
+
+// DefaultCommandRetention is how long the finished commands are kept, unless configured otherwise.
+const DefaultCommandRetention = 30 * 24 * time.Hour
+
+// commandSweepInterval is the delay between two checks of the pending commands.
+const commandSweepInterval = time.Second
+
+// commandPruneInterval is the delay between two deletions of the commands older than the retention.
+const commandPruneInterval = time.Hour
+
+// Actions of the tracker on a pending command, see CommandTracker.action
+const (
+	commandWait = iota
+	commandRetry
+	commandExpire
+)
+
+/**
+ * CommandTracker sends again the commands not acknowledged within AckTimeout,
+ * and sets them as timed out after MaxAttempts attempts.
+ * The finished commands are deleted after Retention.
+ */
+type CommandTracker struct {
+	Models      data.Models
+	Logger      *slog.Logger
+	AckTimeout  time.Duration
+	MaxAttempts int
+	Retention   time.Duration
+
+	stop chan struct{}
+	once sync.Once
+}
+
+func NewCommandTracker(models data.Models, logger *slog.Logger, ackTimeout time.Duration, maxAttempts int, retention time.Duration) *CommandTracker {
+	return &CommandTracker{
+		Models:      models,
+		Logger:      logger,
+		AckTimeout:  ackTimeout,
+		MaxAttempts: maxAttempts,
+		Retention:   retention,
+		stop:        make(chan struct{}),
+	}
+}
+
+// Run checks the pending commands every commandSweepInterval, and prunes the old ones every commandPruneInterval, until Stop is called.
+func (t *CommandTracker) Run() {
+	ticker := time.NewTicker(commandSweepInterval)
+	defer ticker.Stop()
+
+	pruneTicker := time.NewTicker(commandPruneInterval)
+	defer pruneTicker.Stop()
+
+	t.Logger.Info("command tracker started", slog.Duration("ack_timeout", t.AckTimeout), slog.Int("max_attempts", t.MaxAttempts), slog.Duration("retention", t.Retention))
+	t.prune(time.Now())
+
+	for {
+		select {
+		case <-t.stop:
+			t.Logger.Info("command tracker stopped")
+			return
+		case now := <-ticker.C:
+			t.sweep(now)
+		case now := <-pruneTicker.C:
+			t.prune(now)
+		}
+	}
+}
+
+// Stop stops the tracker. The pending commands are checked again on the next start.
+func (t *CommandTracker) Stop() {
+	t.once.Do(func() {
+		close(t.stop)
+	})
+}
+
+// sweep retries or expires the pending commands whose last attempt was not acknowledged in time.
+func (t *CommandTracker) sweep(now time.Time) {
+	// the queued commands are sent on reconnection, they are not retried nor expired meanwhile
+	if !t.Models.Data.Broker.Health().Connected {
+		return
+	}
+
+	commands, err := t.Models.Command.GetPending()
+	if err != nil {
+		t.Logger.Error(err.Error())
+		return
+	}
+	queued := t.Models.Data.Broker.Health().Queued > 0
+
+	for _, command := range commands {
+		switch t.action(command, now, queued) {
+		case commandWait:
+			continue
+		case commandExpire:
+			expired, err := t.Models.Command.Expire(command)
+			if err != nil {
+				t.Logger.Error(err.Error())
+				continue
+			}
+			if expired {
+				t.Logger.Warn("command not acknowledged", slog.String("command", command.ID), slog.String("device", command.DeviceID), slog.String("module", command.Module), slog.Int("attempts", command.Attempts))
+			}
+			continue
+		}
+
+		t.Logger.Debug("retrying command", slog.String("command", command.ID), slog.String("device", command.DeviceID), slog.Int("attempt", command.Attempts+1))
+
+		err = t.Models.Command.Retry(context.Background(), command)
+		if err != nil && !errors.Is(err, data.ErrPublishQueued) {
+			t.Logger.Error(fmt.Errorf("error retrying command %s: %w", command.ID, err).Error())
+		}
+	}
+}
+
+/**
+ * action returns what to do with a pending command: wait for its acknowledgement, retry it or expire it.
+ * queued reports whether the outbound queue of the broker holds messages.
+ */
+func (t *CommandTracker) action(command *data.Command, now time.Time, queued bool) int {
+	sentAt := command.UpdatedAt
+	if command.SentAt != nil {
+		sentAt = *command.SentAt
+	} else if queued {
+		// still waiting in the outbound queue, it is sent by its flush
+		return commandWait
+	}
+	// a command never sent with an empty queue was lost, e.g. queued when the server stopped, it is sent again
+
+	if now.Sub(sentAt) < t.AckTimeout {
+		return commandWait
+	}
+	if command.Attempts >= t.MaxAttempts {
+		return commandExpire
+	}
+	return commandRetry
+}
+
+// prune deletes the finished commands older than the retention.
+func (t *CommandTracker) prune(now time.Time) {
+	pruned, err := t.Models.Command.Prune(now.Add(-t.Retention))
+	if err != nil {
+		t.Logger.Error(err.Error())
+		return
+	}
+	if pruned > 0 {
+		t.Logger.Info("old commands pruned", slog.Int64("pruned", pruned))
+	}
+}
@@ -0,0 +1,44 @@
+package automation
+
+import (
+	"testing"
+	"time"
+
+	"HomeIoT/internal/data"
+)
+
+func TestCommandTrackerAction(t *testing.T) {
+	now := time.Date(2025, time.April, 4, 10, 0, 0, 0, time.UTC)
+	tracker := &CommandTracker{AckTimeout: 5 * time.Second, MaxAttempts: 3}
+
+	sentAt := func(ago time.Duration) *time.Time {
+		sent := now.Add(-ago)
+		return &sent
+	}
+
+	tests := []struct {
+		name    string
+		command data.Command
+		queued  bool
+		want    int
+	}{
+		{"waiting for the ack", data.Command{SentAt: sentAt(2 * time.Second), Attempts: 1}, false, commandWait},
+		{"not acknowledged", data.Command{SentAt: sentAt(5 * time.Second), Attempts: 1}, false, commandRetry},
+		{"retry not acknowledged", data.Command{SentAt: sentAt(6 * time.Second), Attempts: 2}, false, commandRetry},
+		{"last attempt waiting", data.Command{SentAt: sentAt(time.Second), Attempts: 3}, false, commandWait},
+		{"last attempt not acknowledged", data.Command{SentAt: sentAt(6 * time.Second), Attempts: 3}, false, commandExpire},
+		{"sent with messages queued", data.Command{SentAt: sentAt(6 * time.Second), Attempts: 1}, true, commandRetry},
+		{"in the outbound queue", data.Command{UpdatedAt: now.Add(-time.Minute), Attempts: 1}, true, commandWait},
+		{"lost from the outbound queue", data.Command{UpdatedAt: now.Add(-time.Minute), Attempts: 1}, false, commandRetry},
+		{"just queued and lost", data.Command{UpdatedAt: now.Add(-time.Second), Attempts: 1}, false, commandWait},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got := tracker.action(&tt.command, now, tt.queued)
+			if got != tt.want {
+				t.Errorf("action() = %d, want %d", got, tt.want)
+			}
+		})
+	}
+}
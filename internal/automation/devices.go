@@ -0,0 +1,284 @@
+package automation
+
+import (
+	"fmt"
+	"log/slog"
+	"strings"
+	"sync"
+	"time"
+
+	"HomeIoT/internal/data"
+	"HomeIoT/internal/mailer"
+)
+
+// DefaultHeartbeatTimeout is the delay without message after which a device is considered offline,
+// for the device types without a specific timeout.
+const DefaultHeartbeatTimeout = 5 * time.Minute
+
+// deviceSweepInterval is the delay between two checks of the online devices.
+const deviceSweepInterval = 30 * time.Second
+
+// deviceEventsBuffer is the number of status changes waiting to be notified before new ones are dropped.
+const deviceEventsBuffer = 64
+
+// statusDebounce is how long a device must keep its new status before it is emailed,
+// so that a device flapping around its heartbeat timeout does not flood the recipients.
+const statusDebounce = 2 * time.Minute
+
+// Heartbeats holds the delays without message after which the devices are considered offline.
+type Heartbeats struct {
+	Default time.Duration
+	ByType  map[string]time.Duration
+}
+
+/**
+ * ParseHeartbeats reads the default timeout (e.g. "5m", DefaultHeartbeatTimeout if empty)
+ * and the timeouts per device type (e.g. "lightController=2m,temperatureSensor=15m").
+ */
+func ParseHeartbeats(defaultTimeout, byType string) (Heartbeats, error) {
+	heartbeats := Heartbeats{
+		Default: DefaultHeartbeatTimeout,
+		ByType:  make(map[string]time.Duration),
+	}
+
+	if defaultTimeout != "" {
+		timeout, err := time.ParseDuration(defaultTimeout)
+		if err != nil || timeout <= 0 {
+			return heartbeats, fmt.Errorf("invalid heartbeat timeout %q", defaultTimeout)
+		}
+		heartbeats.Default = timeout
+	}
+
+	for _, entry := range strings.Split(byType, ",") {
+		entry = strings.TrimSpace(entry)
+		if entry == "" {
+			continue
+		}
+		deviceType, value, ok := strings.Cut(entry, "=")
+		if !ok {
+			return heartbeats, fmt.Errorf("invalid heartbeat timeout %q, expected type=duration", entry)
+		}
+		timeout, err := time.ParseDuration(strings.TrimSpace(value))
+		if err != nil || timeout <= 0 {
+			return heartbeats, fmt.Errorf("invalid heartbeat timeout for device type %s: %q", deviceType, value)
+		}
+		heartbeats.ByType[strings.TrimSpace(deviceType)] = timeout
+	}
+
+	return heartbeats, nil
+}
+
+// Timeout returns the heartbeat timeout of a device type.
+func (h Heartbeats) Timeout(deviceType string) time.Duration {
+	if timeout, ok := h.ByType[deviceType]; ok {
+		return timeout
+	}
+	return h.Default
+}
+
+/**
+ * DeviceMonitor sets offline the devices which did not send any message within the heartbeat timeout of their type.
+ * Every online/offline transition is logged. It is emailed to the alert recipients once the device has kept
+ * its new status for statusDebounce, and to each recipient at most once per cooldown for each device.
+ */
+type DeviceMonitor struct {
+	Models     data.Models
+	Mailer     mailer.Mailer
+	Logger     *slog.Logger
+	Heartbeats Heartbeats
+
+	// Sender is the contact address displayed in the emails
+	Sender string
+
+	// Background sends the emails without holding the monitor
+	Background func(func())
+
+	// pending holds the last status change of the devices, waiting for statusDebounce before being emailed,
+	// and notified the last status emailed (or known before the change) of the devices
+	pending  map[string]data.Event
+	notified map[string]string
+
+	stop chan struct{}
+	once sync.Once
+}
+
+func NewDeviceMonitor(models data.Models, mailer mailer.Mailer, logger *slog.Logger, heartbeats Heartbeats, sender string, background func(func())) *DeviceMonitor {
+	return &DeviceMonitor{
+		Models:     models,
+		Mailer:     mailer,
+		Logger:     logger,
+		Heartbeats: heartbeats,
+		Sender:     sender,
+		Background: background,
+		pending:    make(map[string]data.Event),
+		notified:   make(map[string]string),
+		stop:       make(chan struct{}),
+	}
+}
+
+/**
+ * Run sweeps the online devices every deviceSweepInterval, and notifies the status changes published on the EventBus.
+ * The status changes are only handled by this goroutine, pending and notified need no lock.
+ * It returns when Stop is called or the EventBus is closed.
+ */
+func (d *DeviceMonitor) Run() {
+	sub := d.Models.Events.Subscribe(deviceEventsBuffer, func(event data.Event) bool {
+		return event.Type == data.EVENT_STATUS
+	})
+	defer sub.Close()
+
+	ticker := time.NewTicker(deviceSweepInterval)
+	defer ticker.Stop()
+
+	d.Logger.Info("device monitor started")
+
+	for {
+		select {
+		case <-d.stop:
+			d.Logger.Info("device monitor stopped")
+			return
+		case now := <-ticker.C:
+			d.sweep(now)
+			d.flush(now)
+		case event, ok := <-sub.C:
+			if !ok {
+				d.Logger.Info("device monitor stopped")
+				return
+			}
+			d.record(event)
+		}
+	}
+}
+
+// Stop stops the monitor. The emails being sent complete in the background.
+func (d *DeviceMonitor) Stop() {
+	d.once.Do(func() {
+		close(d.stop)
+	})
+}
+
+// sweep sets offline the online devices whose heartbeat timeout has expired.
+func (d *DeviceMonitor) sweep(now time.Time) {
+	devices, err := d.Models.Device.GetOnline()
+	if err != nil {
+		d.Logger.Error(err.Error())
+		return
+	}
+
+	for _, device := range devices {
+		if device.LastSeenAt == nil || now.Sub(*device.LastSeenAt) < d.Heartbeats.Timeout(device.Type) {
+			continue
+		}
+
+		// the device is left online if it sent a message since it was fetched
+		offline, err := d.Models.Device.MarkOffline(device.ID, *device.LastSeenAt)
+		if err != nil {
+			d.Logger.Error(err.Error())
+			continue
+		}
+		if !offline {
+			continue
+		}
+
+		d.Models.Events.Publish(data.Event{
+			Type:       data.EVENT_STATUS,
+			DeviceID:   device.ID,
+			LocationID: device.LocationID,
+			Value:      data.DEVICE_OFFLINE,
+			Time:       now,
+		})
+	}
+}
+
+// record logs a status change, then keeps it to be emailed once the device has kept its status for statusDebounce.
+func (d *DeviceMonitor) record(event data.Event) {
+	status, _ := event.Value.(string)
+
+	device, err := d.Models.Device.GetByID(event.DeviceID)
+	if err != nil {
+		d.Logger.Error(fmt.Errorf("error getting device of status change: %w", err).Error())
+		return
+	}
+
+	if status == data.DEVICE_OFFLINE {
+		d.Logger.Warn("device offline", slog.String("device", device.ID), slog.String("location", device.Location.Name), slog.Duration("timeout", d.Heartbeats.Timeout(device.Type)))
+	} else {
+		d.Logger.Info("device online", slog.String("device", device.ID), slog.String("location", device.Location.Name))
+	}
+
+	// the first change of a device is compared with the status it had before
+	if _, ok := d.notified[event.DeviceID]; !ok {
+		previous := data.DEVICE_ONLINE
+		if status == data.DEVICE_ONLINE {
+			previous = data.DEVICE_OFFLINE
+		}
+		d.notified[event.DeviceID] = previous
+	}
+	d.pending[event.DeviceID] = event
+}
+
+// flush emails the status changes kept for statusDebounce, unless the device came back to the status last emailed.
+func (d *DeviceMonitor) flush(now time.Time) {
+	for deviceID, event := range d.pending {
+		if now.Sub(event.Time) < statusDebounce {
+			continue
+		}
+		delete(d.pending, deviceID)
+
+		status, _ := event.Value.(string)
+		if d.notified[deviceID] == status {
+			d.Logger.Debug("device status change not emailed, the device came back", slog.String("device", deviceID), slog.String("status", status))
+			continue
+		}
+		d.notified[deviceID] = status
+
+		d.notify(event)
+	}
+}
+
+// notify emails a status change to the alert recipients out of their cooldown for the device.
+func (d *DeviceMonitor) notify(event data.Event) {
+	status, _ := event.Value.(string)
+
+	device, err := d.Models.Device.GetByID(event.DeviceID)
+	if err != nil {
+		d.Logger.Error(fmt.Errorf("error getting device of status change: %w", err).Error())
+		return
+	}
+
+	recipients, err := d.Models.Alert.GetRecipients()
+	if err != nil {
+		d.Logger.Error(err.Error())
+		return
+	}
+
+	mailData := map[string]any{
+		"Device":   device.Name,
+		"DeviceID": device.ID,
+		"Location": device.Location.Name,
+		"Status":   status,
+		"Time":     event.Time.Local().Format("02 Jan 2006 at 15:04:05"),
+		"Email":    d.Sender,
+	}
+
+	now := time.Now()
+	for _, recipient := range recipients {
+		ok, err := d.Models.Alert.ClaimRecipientStatus(recipient, device.ID, now)
+		if err != nil {
+			d.Logger.Error(err.Error())
+			continue
+		}
+		if !ok {
+			d.Logger.Debug("alert recipient in cooldown for the device", slog.String("recipient", recipient.Email), slog.String("device", device.ID))
+			continue
+		}
+
+		email := recipient.Email
+		d.Background(func() {
+			err := d.Mailer.Send(email, "device-status.tmpl", mailData)
+			if err != nil {
+				d.Logger.Error(fmt.Errorf("error sending device status email to %s: %w", email, err).Error())
+			}
+		})
+	}
+}
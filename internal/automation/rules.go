@@ -0,0 +1,217 @@
+package automation
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log/slog"
+	"strings"
+	"sync"
+	"time"
+
+	"HomeIoT/internal/data"
+	"HomeIoT/internal/mailer"
+)
+
+// ruleEventsBuffer is the number of readings waiting to be evaluated before new ones are dropped.
+const ruleEventsBuffer = 256
+
+// RuleEngine evaluates the automation rules on every reading accepted by the MQTT handlers,
+// and fires their actions when their conditions start matching.
+type RuleEngine struct {
+	Models data.Models
+	Mailer mailer.Mailer
+	Logger *slog.Logger
+
+	// Sender is the contact address displayed in the emails
+	Sender string
+
+	// Background runs the slow actions (emails) without holding the evaluation of the next readings
+	Background func(func())
+
+	mu sync.Mutex
+}
+
+type ConditionResult struct {
+	Condition data.RuleCondition
+	Value     string
+	Matched   bool
+	Error     error
+}
+
+type ActionResult struct {
+	Action data.RuleAction
+	Error  error
+}
+
+// Evaluation is the result of the evaluation of a rule against the current module values.
+type Evaluation struct {
+	Rule       *data.Rule
+	Matched    bool
+	Conditions []ConditionResult
+}
+
+/**
+ * Run evaluates the rules on the readings published on the EventBus.
+ * It returns when the EventBus is closed, on shutdown.
+ */
+func (e *RuleEngine) Run() {
+	sub := e.Models.Events.Subscribe(ruleEventsBuffer, func(event data.Event) bool {
+		return event.Type == data.EVENT_READING
+	})
+	defer sub.Close()
+
+	e.Logger.Info("rule engine started")
+
+	for event := range sub.C {
+		e.HandleReading(event)
+	}
+
+	e.Logger.Info("rule engine stopped")
+}
+
+/**
+ * HandleReading evaluates the enabled rules having a condition on the module of the reading.
+ * The actions of a rule are fired once when its conditions start matching, and not again until
+ * they stopped matching in between.
+ */
+func (e *RuleEngine) HandleReading(event data.Event) {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+
+	rules, err := e.Models.Rule.GetTriggeredBy(event.DeviceID, event.Module)
+	if err != nil {
+		e.Logger.Error(err.Error())
+		return
+	}
+
+	for _, rule := range rules {
+		evaluation := e.Evaluate(rule)
+		for _, result := range evaluation.Conditions {
+			if result.Error != nil {
+				e.Logger.Warn("rule condition could not be evaluated", slog.Uint64("rule", uint64(rule.ID)), slog.String("condition", result.Condition.String()), slog.String("error", result.Error.Error()))
+			}
+		}
+
+		fired := evaluation.Matched && !rule.Active
+		if fired {
+			trigger := fmt.Sprintf("%s/%s = %v", event.DeviceID, event.Module, event.Value)
+			e.Fire(rule, trigger)
+		}
+
+		if fired || evaluation.Matched != rule.Active {
+			err = e.Models.Rule.SetActive(rule, evaluation.Matched, fired)
+			if err != nil {
+				e.Logger.Error(err.Error())
+			}
+		}
+	}
+}
+
+// Evaluate checks the conditions of a rule against the current values of the modules, without firing anything.
+func (e *RuleEngine) Evaluate(rule *data.Rule) *Evaluation {
+	evaluation := &Evaluation{
+		Rule:    rule,
+		Matched: rule.Match == data.MATCH_ALL,
+	}
+
+	for _, condition := range rule.Conditions {
+		result := ConditionResult{Condition: condition}
+
+		module, err := e.Models.Module.GetByDeviceAndName(condition.DeviceID, condition.ModuleName)
+		if err == nil {
+			result.Value = module.Value
+			result.Matched, err = condition.Evaluate(module.Value)
+		}
+		result.Error = err
+		evaluation.Conditions = append(evaluation.Conditions, result)
+
+		if rule.Match == data.MATCH_ALL {
+			evaluation.Matched = evaluation.Matched && result.Matched
+		} else {
+			evaluation.Matched = evaluation.Matched || result.Matched
+		}
+	}
+
+	return evaluation
+}
+
+/**
+ * Fire runs the actions of a rule and records the run.
+ * In dry-run mode, the actions are only logged and recorded.
+ */
+func (e *RuleEngine) Fire(rule *data.Rule, trigger string) []ActionResult {
+	var results []ActionResult
+	var details []string
+	success := true
+
+	for _, action := range rule.Actions {
+		result := ActionResult{Action: action}
+		if !rule.DryRun {
+			result.Error = e.execute(rule, action, trigger)
+		}
+		results = append(results, result)
+
+		switch {
+		case rule.DryRun:
+			details = append(details, fmt.Sprintf("would %s", action.String()))
+		case result.Error != nil:
+			success = false
+			details = append(details, fmt.Sprintf("failed to %s: %s", action.String(), result.Error.Error()))
+		default:
+			details = append(details, action.String())
+		}
+	}
+
+	e.Logger.Info("rule fired", slog.Uint64("rule", uint64(rule.ID)), slog.String("name", rule.Name), slog.String("trigger", trigger), slog.Bool("dry_run", rule.DryRun), slog.String("actions", strings.Join(details, "; ")))
+
+	err := e.Models.Rule.InsertRun(&data.RuleRun{
+		RuleID:  rule.ID,
+		Trigger: trigger,
+		DryRun:  rule.DryRun,
+		Success: success,
+		Details: strings.Join(details, "\n"),
+	})
+	if err != nil {
+		e.Logger.Error(err.Error())
+	}
+
+	return results
+}
+
+func (e *RuleEngine) execute(rule *data.Rule, action data.RuleAction, trigger string) error {
+	switch action.Type {
+
+	case data.ACTION_TYPE_SET:
+		module, err := e.Models.Module.GetByDeviceAndName(action.DeviceID, action.ModuleName)
+		if err != nil {
+			return err
+		}
+		return e.Models.ModuleModels.Set(context.Background(), *module, action.Value)
+
+	case data.ACTION_TYPE_RESET:
+		device, err := e.Models.Device.GetByID(action.DeviceID)
+		if err != nil {
+			return err
+		}
+		return e.Models.Device.Reset(context.Background(), device)
+
+	case data.ACTION_TYPE_EMAIL:
+		mailData := map[string]any{
+			"Rule":    rule.Name,
+			"Trigger": trigger,
+			"Time":    time.Now().Format("02 Jan 2006 at 15:04:05"),
+			"Email":   e.Sender,
+		}
+		e.Background(func() {
+			err := e.Mailer.Send(action.Recipient, "rule-notification.tmpl", mailData)
+			if err != nil {
+				e.Logger.Error(fmt.Errorf("error sending rule notification email: %w", err).Error())
+			}
+		})
+		return nil
+
+	default:
+		return errors.New("unknown action")
+	}
+}
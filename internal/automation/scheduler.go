@@ -0,0 +1,226 @@
+package automation
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log/slog"
+	"strings"
+	"sync"
+	"time"
+
+	"HomeIoT/internal/data"
+)
+
+// missedRunGrace is the delay after which a due run is considered missed rather than late.
+const missedRunGrace = 2 * time.Minute
+
+// maxMissedRuns bounds the number of missed runs replayed by the run_all policy.
+const maxMissedRuns = 100
+
+// Scheduler runs the enabled schedules at the times of their cron expressions.
+// The runs missed while the server was down are handled according to the policy of each schedule.
+type Scheduler struct {
+	Models data.Models
+	Logger *slog.Logger
+
+	// Background runs the commands, so that the shutdown waits for the runs in progress
+	Background func(func())
+
+	stop chan struct{}
+	once sync.Once
+}
+
+type scheduledRun struct {
+	at     time.Time
+	missed bool
+}
+
+func NewScheduler(models data.Models, logger *slog.Logger, background func(func())) *Scheduler {
+	return &Scheduler{
+		Models:     models,
+		Logger:     logger,
+		Background: background,
+		stop:       make(chan struct{}),
+	}
+}
+
+/**
+ * Run checks the due schedules at startup, and then at the beginning of every minute.
+ * It returns when Stop is called.
+ */
+func (s *Scheduler) Run() {
+	s.Logger.Info("scheduler started")
+
+	s.runDue(time.Now())
+
+	for {
+		now := time.Now()
+		timer := time.NewTimer(now.Truncate(time.Minute).Add(time.Minute).Sub(now))
+
+		select {
+		case <-s.stop:
+			timer.Stop()
+			s.Logger.Info("scheduler stopped")
+			return
+		case <-timer.C:
+		}
+
+		s.runDue(time.Now())
+	}
+}
+
+// Stop stops the scheduler. The runs in progress complete in the background.
+func (s *Scheduler) Stop() {
+	s.once.Do(func() {
+		close(s.stop)
+	})
+}
+
+/**
+ * runDue starts the runs of the schedules due at the given time.
+ * Occurrences older than missedRunGrace have been missed (e.g. the server was down):
+ * they are skipped, replayed once or all replayed according to the schedule policy.
+ */
+func (s *Scheduler) runDue(now time.Time) {
+	schedules, err := s.Models.Schedule.GetDue(now)
+	if err != nil {
+		s.Logger.Error(err.Error())
+		return
+	}
+
+	for _, schedule := range schedules {
+		occurrences, err := schedule.Occurrences(schedule.NextRunAt.Add(-time.Nanosecond), now, maxMissedRuns+1)
+		if err != nil {
+			s.Logger.Error(fmt.Errorf("invalid schedule %d: %w", schedule.ID, err).Error())
+			continue
+		}
+
+		var missed []time.Time
+		var runs []scheduledRun
+		for _, t := range occurrences {
+			if t.Before(now.Add(-missedRunGrace)) {
+				missed = append(missed, t)
+			} else {
+				runs = append(runs, scheduledRun{at: t})
+			}
+		}
+
+		if len(missed) > 0 {
+			s.Logger.Warn("missed schedule runs", slog.Uint64("schedule", uint64(schedule.ID)), slog.Int("missed", len(missed)), slog.String("policy", schedule.MissedPolicy))
+
+			switch schedule.MissedPolicy {
+			case data.MISSED_RUN_ALL:
+				replayed := make([]scheduledRun, 0, len(missed)+len(runs))
+				for _, t := range missed[:min(len(missed), maxMissedRuns)] {
+					replayed = append(replayed, scheduledRun{at: t, missed: true})
+				}
+				runs = append(replayed, runs...)
+			case data.MISSED_RUN_ONCE:
+				runs = append([]scheduledRun{{at: missed[len(missed)-1], missed: true}}, runs...)
+			default:
+				err = s.Models.Schedule.InsertRun(&data.ScheduleRun{
+					ScheduleID:  schedule.ID,
+					ScheduledAt: missed[0],
+					Missed:      true,
+					Skipped:     true,
+					Details:     fmt.Sprintf("%d missed runs skipped, from %s", len(missed), missed[0].Format(time.RFC3339)),
+				})
+				if err != nil {
+					s.Logger.Error(err.Error())
+				}
+			}
+		}
+
+		if len(runs) > 0 {
+			schedule.LastRunAt = &now
+		}
+		err = schedule.ComputeNextRun(now)
+		if err != nil {
+			s.Logger.Error(fmt.Errorf("invalid schedule %d: %w", schedule.ID, err).Error())
+			continue
+		}
+		err = s.Models.Schedule.SetNextRun(schedule)
+		if err != nil {
+			s.Logger.Error(err.Error())
+			continue
+		}
+
+		if len(runs) > 0 {
+			schedule := *schedule
+			s.Background(func() {
+				for _, run := range runs {
+					s.execute(&schedule, run)
+				}
+			})
+		}
+	}
+}
+
+// execute runs the command of a schedule and records the run.
+func (s *Scheduler) execute(schedule *data.Schedule, run scheduledRun) {
+	var err error
+
+	switch schedule.ActionType {
+
+	case data.ACTION_TYPE_SET:
+		var module *data.Module
+		module, err = s.Models.Module.GetByDeviceAndName(schedule.DeviceID, schedule.ModuleName)
+		if err == nil {
+			err = s.Models.ModuleModels.Set(context.Background(), *module, schedule.Value)
+		}
+
+	case data.ACTION_TYPE_RESET:
+		err = s.resetDevices(schedule.DeviceID)
+
+	default:
+		err = errors.New("unknown action")
+	}
+
+	details := schedule.ActionString()
+	if err != nil {
+		details = fmt.Sprintf("failed to %s: %s", details, err.Error())
+		s.Logger.Error("schedule run failed", slog.Uint64("schedule", uint64(schedule.ID)), slog.String("error", err.Error()))
+	} else {
+		s.Logger.Info("schedule run", slog.Uint64("schedule", uint64(schedule.ID)), slog.String("name", schedule.Name), slog.String("action", details), slog.Bool("missed", run.missed))
+	}
+
+	err = s.Models.Schedule.InsertRun(&data.ScheduleRun{
+		ScheduleID:  schedule.ID,
+		ScheduledAt: run.at,
+		Missed:      run.missed,
+		Success:     err == nil,
+		Details:     details,
+	})
+	if err != nil {
+		s.Logger.Error(err.Error())
+	}
+}
+
+// resetDevices resets a device, or every device if deviceID is empty.
+func (s *Scheduler) resetDevices(deviceID string) error {
+	if deviceID != "" {
+		device, err := s.Models.Device.GetByID(deviceID)
+		if err != nil {
+			return err
+		}
+		return s.Models.Device.Reset(context.Background(), device)
+	}
+
+	devices, err := s.Models.Device.GetAll()
+	if err != nil {
+		return err
+	}
+
+	var failed []string
+	for _, device := range devices {
+		err = s.Models.Device.Reset(context.Background(), device)
+		if err != nil {
+			failed = append(failed, fmt.Sprintf("%s: %s", device.ID, err.Error()))
+		}
+	}
+	if len(failed) > 0 {
+		return errors.New(strings.Join(failed, "; "))
+	}
+	return nil
+}
@@ -0,0 +1,97 @@
+package cron
+
+import (
+	"errors"
+	"testing"
+	"time"
+)
+
+func TestParseErrors(t *testing.T) {
+	tests := []struct {
+		name string
+		spec string
+	}{
+		{"empty", ""},
+		{"missing field", "* * * *"},
+		{"extra field", "* * * * * *"},
+		{"unknown macro", "@fortnightly"},
+		{"minute out of range", "60 * * * *"},
+		{"hour out of range", "* 24 * * *"},
+		{"day of month zero", "* * 0 * *"},
+		{"month out of range", "* * * 13 *"},
+		{"day of week out of range", "* * * * 8"},
+		{"zero step", "*/0 * * * *"},
+		{"invalid step", "*/x * * * *"},
+		{"reversed range", "5-1 * * * *"},
+		{"open range", "5- * * * *"},
+		{"negative value", "-1 * * * *"},
+		{"unknown month name", "* * * foo *"},
+		{"day name in month", "* * * mon *"},
+		{"not a number", "a * * * *"},
+		{"empty list item", "1,,2 * * * *"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			_, err := Parse(tt.spec)
+			if !errors.Is(err, ErrInvalidSpec) {
+				t.Errorf("Parse(%q) error = %v, want ErrInvalidSpec", tt.spec, err)
+			}
+		})
+	}
+}
+
+func TestNext(t *testing.T) {
+	date := func(year int, month time.Month, day, hour, min int) time.Time {
+		return time.Date(year, month, day, hour, min, 0, 0, time.UTC)
+	}
+
+	// Friday 4 April 2025, 10:07:30
+	friday := time.Date(2025, time.April, 4, 10, 7, 30, 0, time.UTC)
+
+	tests := []struct {
+		name string
+		spec string
+		from time.Time
+		want time.Time
+	}{
+		{"every minute", "* * * * *", friday, date(2025, time.April, 4, 10, 8)},
+		{"minute step", "*/15 * * * *", friday, date(2025, time.April, 4, 10, 15)},
+		{"minute list", "5,10 * * * *", friday, date(2025, time.April, 4, 10, 10)},
+		{"minute range", "20-22 * * * *", friday, date(2025, time.April, 4, 10, 20)},
+		{"strictly after", "7 10 * * *", date(2025, time.April, 4, 10, 7), date(2025, time.April, 5, 10, 7)},
+		{"daily", "0 23 * * *", friday, date(2025, time.April, 4, 23, 0)},
+		{"next day", "0 9 * * *", friday, date(2025, time.April, 5, 9, 0)},
+		{"ranged step", "0 9-17/4 * * *", friday, date(2025, time.April, 4, 13, 0)},
+		{"value step", "0 18/2 * * *", friday, date(2025, time.April, 4, 18, 0)},
+		{"day name", "0 4 * * sun", friday, date(2025, time.April, 6, 4, 0)},
+		{"upper case day name", "0 4 * * SUN", friday, date(2025, time.April, 6, 4, 0)},
+		{"sunday as 7", "0 4 * * 7", friday, date(2025, time.April, 6, 4, 0)},
+		{"day range", "0 9 * * mon-fri", date(2025, time.April, 5, 12, 0), date(2025, time.April, 7, 9, 0)},
+		{"month names", "30 12 1 jan,jul *", friday, date(2025, time.July, 1, 12, 30)},
+		{"next year", "0 0 1 mar *", friday, date(2026, time.March, 1, 0, 0)},
+		{"day of month only", "0 0 13 * *", friday, date(2025, time.April, 13, 0, 0)},
+		{"day of week only", "0 0 * * tue", friday, date(2025, time.April, 8, 0, 0)},
+		{"day of month or week, week first", "0 0 13 * tue", friday, date(2025, time.April, 8, 0, 0)},
+		{"day of month or week, month first", "0 0 13 * tue", date(2025, time.April, 8, 0, 0), date(2025, time.April, 13, 0, 0)},
+		{"leap day", "0 0 29 2 *", friday, date(2028, time.February, 29, 0, 0)},
+		{"hourly", "@hourly", friday, date(2025, time.April, 4, 11, 0)},
+		{"daily macro", "@daily", friday, date(2025, time.April, 5, 0, 0)},
+		{"weekly", "@weekly", friday, date(2025, time.April, 6, 0, 0)},
+		{"monthly", "@monthly", friday, date(2025, time.May, 1, 0, 0)},
+		{"yearly", "@yearly", friday, date(2026, time.January, 1, 0, 0)},
+		{"never", "0 0 30 2 *", friday, time.Time{}},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			schedule, err := Parse(tt.spec)
+			if err != nil {
+				t.Fatalf("Parse(%q) error = %v", tt.spec, err)
+			}
+			if got := schedule.Next(tt.from); !got.Equal(tt.want) {
+				t.Errorf("Next(%v) of %q = %v, want %v", tt.from, tt.spec, got, tt.want)
+			}
+		})
+	}
+}
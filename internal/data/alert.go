@@ -0,0 +1,153 @@
+package data
+
+import (
+	"errors"
+	"fmt"
+	"time"
+
+	"HomeIoT/internal/validator"
+
+	"gorm.io/gorm"
+	"gorm.io/gorm/clause"
+)
+
+// DefaultAlertCooldown is the minimum delay between two alerts sent to a recipient, unless configured otherwise.
+const DefaultAlertCooldown = 15 * time.Minute
+
+// ErrDuplicateRecipient is returned when an email address is already an alert recipient.
+var ErrDuplicateRecipient = errors.New("duplicate alert recipient")
+
+// alarmID is the ID of the single row holding the alarm state.
+const alarmID = 1
+
+// Alarm holds whether the home is armed, i.e. whether the presence detectors trigger alerts.
+type Alarm struct {
+	ID        uint `gorm:"primaryKey"`
+	Armed     bool
+	ChangedBy *uint
+	UpdatedAt time.Time
+}
+
+// AlertRecipient receives the alert emails at most once per cooldown, and the device status emails at most once per cooldown and device.
+type AlertRecipient struct {
+	gorm.Model
+	Email          string `gorm:"uniqueIndex"`
+	Cooldown       time.Duration
+	LastNotifiedAt *time.Time
+}
+
+/**
+ * StatusNotification is the last device status email sent to a recipient for a device.
+ * The status emails have their own cooldown per device, so that they never hold back a presence alert
+ * nor the status of another device.
+ */
+type StatusNotification struct {
+	RecipientID uint   `gorm:"primaryKey;autoIncrement:false"`
+	DeviceID    string `gorm:"primaryKey"`
+	NotifiedAt  time.Time
+}
+
+type AlertModel struct {
+	DB *gorm.DB
+}
+
+func ValidateAlertRecipient(v *validator.Validator, recipient *AlertRecipient) {
+	v.ValidateEmail(recipient.Email)
+	v.Check(recipient.Cooldown >= 0, "cooldown", "must be a positive duration")
+	v.Check(recipient.Cooldown <= 24*time.Hour, "cooldown", "must not be more than 24 hours")
+}
+
+// GetAlarm returns the alarm state, disarmed if it has never been set.
+func (m *AlertModel) GetAlarm() (*Alarm, error) {
+	alarm := Alarm{ID: alarmID}
+	err := m.DB.FirstOrCreate(&alarm, Alarm{ID: alarmID}).Error
+	if err != nil {
+		return nil, fmt.Errorf("failed to get alarm state: %w", err)
+	}
+	return &alarm, nil
+}
+
+func (m *AlertModel) SetArmed(armed bool, userID uint) error {
+	alarm := Alarm{ID: alarmID, Armed: armed, ChangedBy: &userID}
+	err := m.DB.Save(&alarm).Error
+	if err != nil {
+		return fmt.Errorf("error updating alarm state: %w", err)
+	}
+	return nil
+}
+
+func (m *AlertModel) GetRecipients() ([]*AlertRecipient, error) {
+	var recipients []*AlertRecipient
+	err := m.DB.Order("email").Find(&recipients).Error
+	if err != nil {
+		return nil, fmt.Errorf("failed to get alert recipients: %w", err)
+	}
+	return recipients, nil
+}
+
+func (m *AlertModel) InsertRecipient(recipient *AlertRecipient) error {
+	var count int64
+	err := m.DB.Model(&AlertRecipient{}).Where("email = ?", recipient.Email).Count(&count).Error
+	if err != nil {
+		return fmt.Errorf("error checking alert recipient %s: %w", recipient.Email, err)
+	}
+	if count > 0 {
+		return ErrDuplicateRecipient
+	}
+
+	// a recipient removed earlier is soft deleted and would conflict with the unique index
+	err = m.DB.Unscoped().Where("email = ? AND deleted_at IS NOT NULL", recipient.Email).Delete(&AlertRecipient{}).Error
+	if err != nil {
+		return fmt.Errorf("error cleaning alert recipient %s: %w", recipient.Email, err)
+	}
+
+	err = m.DB.Create(recipient).Error
+	if err != nil {
+		return fmt.Errorf("could not create alert recipient %s: %w", recipient.Email, err)
+	}
+	return nil
+}
+
+func (m *AlertModel) DeleteRecipient(id uint) error {
+	result := m.DB.Delete(&AlertRecipient{}, id)
+	if result.Error != nil {
+		return fmt.Errorf("error deleting alert recipient with id %d: %w", id, result.Error)
+	}
+	if result.RowsAffected == 0 {
+		return fmt.Errorf("alert recipient with id %d: %w", id, ErrRecordNotFound)
+	}
+	return nil
+}
+
+/**
+ * ClaimRecipient marks the recipient as notified at the given time, unless it has already been
+ * notified within its cooldown. It returns false when the alert must not be sent to the recipient.
+ * The check and the update are done in a single statement, so concurrent alerts cannot both claim it.
+ */
+func (m *AlertModel) ClaimRecipient(recipient *AlertRecipient, now time.Time) (bool, error) {
+	result := m.DB.Model(&AlertRecipient{}).
+		Where("id = ? AND (last_notified_at IS NULL OR last_notified_at <= ?)", recipient.ID, now.Add(-recipient.Cooldown)).
+		Update("last_notified_at", now)
+	if result.Error != nil {
+		return false, fmt.Errorf("error claiming alert recipient %s: %w", recipient.Email, result.Error)
+	}
+	return result.RowsAffected == 1, nil
+}
+
+/**
+ * ClaimRecipientStatus is ClaimRecipient for the status emails of a device, with a cooldown per device.
+ * The notification is inserted, or updated only when out of the cooldown, in a single statement.
+ */
+func (m *AlertModel) ClaimRecipientStatus(recipient *AlertRecipient, deviceID string, now time.Time) (bool, error) {
+	result := m.DB.Clauses(clause.OnConflict{
+		Columns:   []clause.Column{{Name: "recipient_id"}, {Name: "device_id"}},
+		DoUpdates: clause.AssignmentColumns([]string{"notified_at"}),
+		Where: clause.Where{Exprs: []clause.Expression{
+			clause.Expr{SQL: "status_notifications.notified_at <= ?", Vars: []any{now.Add(-recipient.Cooldown)}},
+		}},
+	}).Create(&StatusNotification{RecipientID: recipient.ID, DeviceID: deviceID, NotifiedAt: now})
+	if result.Error != nil {
+		return false, fmt.Errorf("error claiming alert recipient %s for device %s: %w", recipient.Email, deviceID, result.Error)
+	}
+	return result.RowsAffected == 1, nil
+}
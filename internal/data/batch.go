@@ -0,0 +1,162 @@
+package data
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log/slog"
+	"strings"
+	"time"
+
+	mqtt "github.com/eclipse/paho.mqtt.golang"
+	"gorm.io/gorm"
+	"gorm.io/gorm/clause"
+)
+
+const BATCH_MODULE = "batch"
+
+// Batch is the channel on which a device publishes the readings of several modules at once.
+type Batch struct{}
+
+func (b *Batch) GetName() string {
+	return BATCH_MODULE
+}
+
+func (b *Batch) GetValue() any {
+	return nil
+}
+
+/**
+ * batchMessage is the payload of the batch channel, e.g.
+ *
+ *	{"ts": 1712225160, "readings": [{"module": "temperatureSensor", "v": 21.4, "seq": 42}, {"module": "presenceDetector", "v": false}]}
+ *
+ * Each reading has the fields of a reading on a module channel, "ts" being the time of the readings without one.
+ */
+type batchMessage struct {
+	TS       json.RawMessage `json:"ts"`
+	Readings []struct {
+		Module string `json:"module"`
+		readingMessage
+	} `json:"readings"`
+}
+
+/**
+ * NewBatch ingests the readings of a batch message in a single transaction: the device is resolved once,
+ * then every module value is updated and every reading inserted together.
+ * The invalid readings and the duplicates are skipped, the others are returned with their device.
+ */
+func (m *DataModel) NewBatch(message mqtt.Message) ([]*Data, error) {
+	channelElems := strings.Split(message.Topic(), "/")
+	if len(channelElems) != 6 {
+		return nil, fmt.Errorf("invalid batch channel format")
+	}
+	deviceID := channelElems[4]
+
+	var msg batchMessage
+	err := json.Unmarshal(message.Payload(), &msg)
+	if err != nil {
+		return nil, fmt.Errorf("error unmarshalling batch: %w", err)
+	}
+	if len(msg.Readings) == 0 {
+		return nil, fmt.Errorf("no reading found in batch")
+	}
+
+	device, modules, err := m.Devices.Cache.Get(deviceID)
+	if err != nil {
+		return nil, fmt.Errorf("error finding device %w", err)
+	}
+
+	// parsing every reading before writing anything
+	batch, err := m.batchReadings(deviceID, modules, &msg, time.Now())
+	if err != nil {
+		return nil, err
+	}
+
+	err = m.DB.Transaction(func(tx *gorm.DB) error {
+		for _, data := range batch {
+			err := m.updateModule(tx, deviceID, data.ModuleID, data.ModuleValue, data.CreatedAt)
+			if err != nil {
+				return fmt.Errorf("error updating module %s: %w", data.ModuleName, err)
+			}
+		}
+
+		// the device is known, it is not saved again with each reading
+		err := tx.Omit(clause.Associations).Create(&batch).Error
+		if err != nil {
+			return fmt.Errorf("error inserting data: %w", err)
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	for _, data := range batch {
+		data.Device = device
+	}
+
+	return batch, nil
+}
+
+/**
+ * batchReadings parses the readings of a batch message received at now, for a device whose module IDs are given by name.
+ * The readings of unknown modules, the invalid ones and the duplicates are skipped,
+ * ErrDuplicateReading is returned if every reading is a duplicate.
+ */
+func (m *DataModel) batchReadings(deviceID string, modules map[string]uint, msg *batchMessage, now time.Time) ([]*Data, error) {
+	var batch []*Data
+	duplicates := false
+	for i, entry := range msg.Readings {
+		moduleID, ok := modules[entry.Module]
+		if !ok {
+			m.Logger.Warn("batch reading of an unknown module skipped", slog.String("device", deviceID), slog.String("module", entry.Module))
+			continue
+		}
+
+		if len(entry.TS) == 0 {
+			entry.TS = msg.TS
+		}
+		reading, err := entry.toReading()
+		if err != nil {
+			m.Logger.Warn("invalid batch reading skipped", slog.String("device", deviceID), slog.Int("index", i), slog.String("error", err.Error()))
+			continue
+		}
+
+		readAt, plausible := reading.readingTimeAt(now)
+		if !plausible {
+			m.Logger.Warn("implausible reading time, using the reception time", slog.String("device", deviceID), slog.String("module", entry.Module), slog.Time("ts", reading.Time))
+		}
+
+		// the duplicates are also those of the previous readings of the batch
+		if reading.Seq != nil {
+			ok, err := m.Devices.Cache.ClaimReading(deviceID, moduleID, *reading.Seq, readAt, now)
+			if err != nil {
+				return nil, err
+			}
+			if !ok {
+				duplicates = true
+				m.Logger.Debug("duplicate reading dropped", slog.String("device", deviceID), slog.String("module", entry.Module), slog.Uint64("seq", *reading.Seq))
+				continue
+			}
+		}
+
+		batch = append(batch, &Data{
+			Model:       gorm.Model{CreatedAt: readAt},
+			DeviceID:    deviceID,
+			ModuleID:    moduleID,
+			ModuleName:  entry.Module,
+			ModuleValue: reading.Value,
+			Unit:        reading.Unit,
+			Seq:         reading.Seq,
+		})
+	}
+
+	if len(batch) == 0 {
+		if duplicates {
+			return nil, fmt.Errorf("%w: every reading of the batch of device %s", ErrDuplicateReading, deviceID)
+		}
+		return nil, errors.New("no valid reading found in batch")
+	}
+	return batch, nil
+}
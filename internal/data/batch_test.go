@@ -0,0 +1,106 @@
+package data
+
+import (
+	"encoding/json"
+	"errors"
+	"io"
+	"log/slog"
+	"slices"
+	"testing"
+	"time"
+)
+
+func TestBatchReadings(t *testing.T) {
+	now := time.Date(2025, time.April, 4, 10, 0, 0, 0, time.UTC)
+	modules := map[string]uint{TEMPERATURE_SENSOR: 1, LIGHT_CONTROLLER: 2}
+
+	tests := []struct {
+		name     string
+		previous string
+		payload  string
+		want     []string
+		wantErr  error
+	}{
+		{
+			name:    "every reading",
+			payload: `{"readings": [{"module": "temperatureSensor", "v": 21.4, "seq": 1}, {"module": "lightController", "v": true, "seq": 1}]}`,
+			want:    []string{"21.4", "true"},
+		},
+		{
+			name:    "repeated within the batch",
+			payload: `{"readings": [{"module": "temperatureSensor", "v": 21.4, "seq": 1}, {"module": "temperatureSensor", "v": 21.4, "seq": 1}]}`,
+			want:    []string{"21.4"},
+		},
+		{
+			name:    "same seq on another module",
+			payload: `{"readings": [{"module": "temperatureSensor", "v": 21.4, "seq": 1}, {"module": "lightController", "v": false, "seq": 1}]}`,
+			want:    []string{"21.4", "false"},
+		},
+		{
+			name:    "without seq",
+			payload: `{"readings": [{"module": "temperatureSensor", "v": 21.4}, {"module": "temperatureSensor", "v": 21.4}]}`,
+			want:    []string{"21.4", "21.4"},
+		},
+		{
+			name:     "received in a previous batch",
+			previous: `{"readings": [{"module": "temperatureSensor", "v": 21.4, "seq": 1}]}`,
+			payload:  `{"readings": [{"module": "temperatureSensor", "v": 21.4, "seq": 1}, {"module": "temperatureSensor", "v": 21.6, "seq": 2}]}`,
+			want:     []string{"21.6"},
+		},
+		{
+			name:     "every reading repeated",
+			previous: `{"readings": [{"module": "temperatureSensor", "v": 21.4, "seq": 1}]}`,
+			payload:  `{"readings": [{"module": "temperatureSensor", "v": 21.4, "seq": 1}]}`,
+			wantErr:  ErrDuplicateReading,
+		},
+		{
+			name:    "unknown and invalid readings skipped",
+			payload: `{"readings": [{"module": "doorSensor", "v": 1}, {"module": "temperatureSensor"}, {"module": "lightController", "v": true}]}`,
+			want:    []string{"true"},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			cache := NewDeviceCache(nil)
+			cache.recent["esp1"] = make(map[readingKey]recentReading)
+			m := &DataModel{
+				Logger:  slog.New(slog.NewTextHandler(io.Discard, nil)),
+				Devices: &DeviceModel{Cache: cache},
+			}
+
+			if tt.previous != "" {
+				var msg batchMessage
+				if err := json.Unmarshal([]byte(tt.previous), &msg); err != nil {
+					t.Fatal(err)
+				}
+				if _, err := m.batchReadings("esp1", modules, &msg, now); err != nil {
+					t.Fatalf("batchReadings(%s) error = %v", tt.previous, err)
+				}
+			}
+
+			var msg batchMessage
+			if err := json.Unmarshal([]byte(tt.payload), &msg); err != nil {
+				t.Fatal(err)
+			}
+			batch, err := m.batchReadings("esp1", modules, &msg, now)
+			if tt.wantErr != nil {
+				if !errors.Is(err, tt.wantErr) {
+					t.Errorf("batchReadings(%s) error = %v, want %v", tt.payload, err, tt.wantErr)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("batchReadings(%s) error = %v", tt.payload, err)
+			}
+
+			var got []string
+			for _, data := range batch {
+				got = append(got, data.ModuleValue)
+			}
+			if !slices.Equal(got, tt.want) {
+				t.Errorf("batchReadings(%s) values = %v, want %v", tt.payload, got, tt.want)
+			}
+		})
+	}
+}
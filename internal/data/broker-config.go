@@ -0,0 +1,139 @@
+package data
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"fmt"
+	"os"
+	"slices"
+	"strings"
+	"time"
+)
+
+// ErrInvalidBrokerConfig is returned when the settings of the connection to the MQTT broker are inconsistent.
+var ErrInvalidBrokerConfig = errors.New("invalid MQTT broker configuration")
+
+// Schemes of the connection to the MQTT broker
+const (
+	BROKER_TCP = "tcp"
+	BROKER_SSL = "ssl"
+	BROKER_WS  = "ws"
+	BROKER_WSS = "wss"
+)
+
+var BrokerSchemes = []string{BROKER_TCP, BROKER_SSL, BROKER_WS, BROKER_WSS}
+
+// BrokerConfig holds the settings of the connection to the MQTT broker.
+type BrokerConfig struct {
+	// Scheme is one of BrokerSchemes, tcp if empty. It can also be set as a prefix of Host (e.g. "ssl://broker.home")
+	Scheme string
+	Host   string
+	Port   int64
+
+	// Path is the path of the websocket endpoint (e.g. "/mqtt"), for the ws and wss schemes
+	Path string
+
+	QoS         byte
+	StatusTopic string
+
+	ClientID string
+	Username string
+	Password string
+
+	// CAFile is a PEM bundle of the authorities trusted to sign the broker certificate, the system ones if empty
+	CAFile string
+
+	// CertFile and KeyFile are the PEM client certificate and key, for mutual TLS
+	CertFile string
+	KeyFile  string
+
+	// QueueSize is the number of messages kept while the broker is disconnected
+	QueueSize int
+
+	// ConnectRetryInterval is the delay between the attempts of the first connection
+	ConnectRetryInterval time.Duration
+
+	// MaxReconnectInterval bounds the delay between the reconnection attempts, doubled after every failure
+	MaxReconnectInterval time.Duration
+}
+
+// URL returns the URL of the broker, e.g. "ssl://broker.home:8883".
+func (cfg BrokerConfig) URL() (string, error) {
+	scheme, host := cfg.Scheme, cfg.Host
+	if hostScheme, hostname, ok := strings.Cut(host, "://"); ok {
+		if scheme != "" && scheme != hostScheme {
+			return "", fmt.Errorf("%w: scheme %q conflicts with the host %q", ErrInvalidBrokerConfig, scheme, host)
+		}
+		scheme, host = hostScheme, hostname
+	}
+	if scheme == "" {
+		scheme = BROKER_TCP
+	}
+
+	if !slices.Contains(BrokerSchemes, scheme) {
+		return "", fmt.Errorf("%w: unsupported scheme %q, must be one of %s", ErrInvalidBrokerConfig, scheme, strings.Join(BrokerSchemes, ", "))
+	}
+	if host == "" || strings.Contains(host, "/") || (strings.Contains(host, ":") && !strings.HasPrefix(host, "[")) {
+		return "", fmt.Errorf("%w: invalid host %q", ErrInvalidBrokerConfig, cfg.Host)
+	}
+	if cfg.Port <= 0 || cfg.Port > 65535 {
+		return "", fmt.Errorf("%w: invalid port %d", ErrInvalidBrokerConfig, cfg.Port)
+	}
+
+	path := ""
+	if scheme == BROKER_WS || scheme == BROKER_WSS {
+		path = cfg.Path
+		if path != "" && !strings.HasPrefix(path, "/") {
+			path = "/" + path
+		}
+	} else if cfg.Path != "" {
+		return "", fmt.Errorf("%w: a path is only used with the ws and wss schemes", ErrInvalidBrokerConfig)
+	}
+
+	return fmt.Sprintf("%s://%s:%d%s", scheme, host, cfg.Port, path), nil
+}
+
+/**
+ * TLSConfig returns the TLS settings of the connection, or nil if no TLS file is set.
+ * The files are read at once, so that a misconfiguration is reported at startup.
+ */
+func (cfg BrokerConfig) TLSConfig() (*tls.Config, error) {
+	if cfg.CAFile == "" && cfg.CertFile == "" && cfg.KeyFile == "" {
+		return nil, nil
+	}
+
+	url, err := cfg.URL()
+	if err != nil {
+		return nil, err
+	}
+	if !strings.HasPrefix(url, BROKER_SSL+"://") && !strings.HasPrefix(url, BROKER_WSS+"://") {
+		return nil, fmt.Errorf("%w: the TLS files require the ssl or wss scheme", ErrInvalidBrokerConfig)
+	}
+
+	tlsConfig := &tls.Config{MinVersion: tls.VersionTLS12}
+
+	if cfg.CAFile != "" {
+		pem, err := os.ReadFile(cfg.CAFile)
+		if err != nil {
+			return nil, fmt.Errorf("%w: cannot read the CA bundle: %w", ErrInvalidBrokerConfig, err)
+		}
+		tlsConfig.RootCAs = x509.NewCertPool()
+		if !tlsConfig.RootCAs.AppendCertsFromPEM(pem) {
+			return nil, fmt.Errorf("%w: no PEM certificate found in the CA bundle %s", ErrInvalidBrokerConfig, cfg.CAFile)
+		}
+	}
+
+	if (cfg.CertFile == "") != (cfg.KeyFile == "") {
+		return nil, fmt.Errorf("%w: the client certificate and key must be set together", ErrInvalidBrokerConfig)
+	}
+	if cfg.CertFile != "" {
+		cert, err := tls.LoadX509KeyPair(cfg.CertFile, cfg.KeyFile)
+		if err != nil {
+			return nil, fmt.Errorf("%w: cannot load the client certificate: %w", ErrInvalidBrokerConfig, err)
+		}
+		tlsConfig.Certificates = []tls.Certificate{cert}
+	}
+
+	return tlsConfig, nil
+}
@@ -0,0 +1,165 @@
+package data
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"errors"
+	"math/big"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestBrokerConfigURL(t *testing.T) {
+	tests := []struct {
+		name string
+		cfg  BrokerConfig
+		want string
+	}{
+		{"default scheme", BrokerConfig{Host: "broker.home", Port: 1883}, "tcp://broker.home:1883"},
+		{"scheme", BrokerConfig{Scheme: BROKER_SSL, Host: "broker.home", Port: 8883}, "ssl://broker.home:8883"},
+		{"scheme in host", BrokerConfig{Host: "ssl://broker.home", Port: 8883}, "ssl://broker.home:8883"},
+		{"same scheme twice", BrokerConfig{Scheme: BROKER_SSL, Host: "ssl://broker.home", Port: 8883}, "ssl://broker.home:8883"},
+		{"IPv6 host", BrokerConfig{Host: "[::1]", Port: 1883}, "tcp://[::1]:1883"},
+		{"websocket", BrokerConfig{Scheme: BROKER_WS, Host: "broker.home", Port: 80, Path: "/mqtt"}, "ws://broker.home:80/mqtt"},
+		{"websocket path without slash", BrokerConfig{Scheme: BROKER_WSS, Host: "broker.home", Port: 443, Path: "mqtt"}, "wss://broker.home:443/mqtt"},
+		{"websocket without path", BrokerConfig{Scheme: BROKER_WSS, Host: "broker.home", Port: 443}, "wss://broker.home:443"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := tt.cfg.URL()
+			if err != nil {
+				t.Fatalf("URL() error = %v", err)
+			}
+			if got != tt.want {
+				t.Errorf("URL() = %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestBrokerConfigURLErrors(t *testing.T) {
+	tests := []struct {
+		name string
+		cfg  BrokerConfig
+	}{
+		{"unsupported scheme", BrokerConfig{Scheme: "http", Host: "broker.home", Port: 1883}},
+		{"unsupported scheme in host", BrokerConfig{Host: "mqtt://broker.home", Port: 1883}},
+		{"conflicting schemes", BrokerConfig{Scheme: BROKER_TCP, Host: "ssl://broker.home", Port: 8883}},
+		{"no host", BrokerConfig{Port: 1883}},
+		{"host with path", BrokerConfig{Host: "broker.home/mqtt", Port: 1883}},
+		{"host with port", BrokerConfig{Host: "broker.home:1883", Port: 1883}},
+		{"no port", BrokerConfig{Host: "broker.home"}},
+		{"port out of range", BrokerConfig{Host: "broker.home", Port: 65536}},
+		{"path without websocket", BrokerConfig{Host: "broker.home", Port: 1883, Path: "/mqtt"}},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := tt.cfg.URL()
+			if !errors.Is(err, ErrInvalidBrokerConfig) {
+				t.Errorf("URL() = %q, %v, want ErrInvalidBrokerConfig", got, err)
+			}
+		})
+	}
+}
+
+func TestBrokerConfigTLSConfig(t *testing.T) {
+	dir := t.TempDir()
+	certFile, keyFile := writeTestCertificate(t, dir)
+	notPEM := filepath.Join(dir, "not-pem.txt")
+	if err := os.WriteFile(notPEM, []byte("not a certificate"), 0o600); err != nil {
+		t.Fatal(err)
+	}
+
+	ssl := BrokerConfig{Scheme: BROKER_SSL, Host: "broker.home", Port: 8883}
+	with := func(caFile, certFile, keyFile string) BrokerConfig {
+		cfg := ssl
+		cfg.CAFile, cfg.CertFile, cfg.KeyFile = caFile, certFile, keyFile
+		return cfg
+	}
+
+	tests := []struct {
+		name      string
+		cfg       BrokerConfig
+		wantErr   bool
+		wantTLS   bool
+		wantCerts int
+	}{
+		{"no TLS file", ssl, false, false, 0},
+		{"CA bundle", with(certFile, "", ""), false, true, 0},
+		{"client certificate", with("", certFile, keyFile), false, true, 1},
+		{"CA bundle and client certificate", with(certFile, certFile, keyFile), false, true, 1},
+		{"TLS files without TLS scheme", BrokerConfig{Host: "broker.home", Port: 1883, CAFile: certFile}, true, false, 0},
+		{"missing CA bundle", with(filepath.Join(dir, "missing.pem"), "", ""), true, false, 0},
+		{"CA bundle without certificate", with(notPEM, "", ""), true, false, 0},
+		{"certificate without key", with("", certFile, ""), true, false, 0},
+		{"key without certificate", with("", "", keyFile), true, false, 0},
+		{"invalid key", with("", certFile, notPEM), true, false, 0},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := tt.cfg.TLSConfig()
+			if tt.wantErr {
+				if !errors.Is(err, ErrInvalidBrokerConfig) {
+					t.Errorf("TLSConfig() error = %v, want ErrInvalidBrokerConfig", err)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("TLSConfig() error = %v", err)
+			}
+			if (got != nil) != tt.wantTLS {
+				t.Fatalf("TLSConfig() = %v, want TLS settings: %v", got, tt.wantTLS)
+			}
+			if got != nil && len(got.Certificates) != tt.wantCerts {
+				t.Errorf("TLSConfig() has %d client certificates, want %d", len(got.Certificates), tt.wantCerts)
+			}
+		})
+	}
+}
+
+// writeTestCertificate writes a self-signed certificate and its key, and returns their paths.
+func writeTestCertificate(t *testing.T, dir string) (string, string) {
+	t.Helper()
+
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	template := &x509.Certificate{
+		SerialNumber:          big.NewInt(1),
+		Subject:               pkix.Name{CommonName: "broker.home"},
+		NotBefore:             time.Now().Add(-time.Hour),
+		NotAfter:              time.Now().Add(time.Hour),
+		IsCA:                  true,
+		BasicConstraintsValid: true,
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	keyDER, err := x509.MarshalECPrivateKey(key)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	certFile := filepath.Join(dir, "cert.pem")
+	keyFile := filepath.Join(dir, "key.pem")
+	err = os.WriteFile(certFile, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der}), 0o600)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = os.WriteFile(keyFile, pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: keyDER}), 0o600)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return certFile, keyFile
+}
@@ -1,34 +1,349 @@
 package data
 
 import (
+	"context"
+	"crypto/tls"
+	"errors"
 	"fmt"
+	"log/slog"
+	"net/url"
+	"sync"
+	"time"
 
 	mqtt "github.com/eclipse/paho.mqtt.golang"
 )
 
+// DefaultHubStatusTopic is the topic of the retained online/offline status of the hub.
+const DefaultHubStatusTopic = "hub/status"
+
+// Default delays between the connection attempts to the broker
+const (
+	DefaultConnectRetryInterval = 5 * time.Second
+	DefaultMaxReconnectInterval = time.Minute
+)
+
+// DefaultPublishTimeout bounds the wait for the acknowledgement of a publish when the context has no deadline.
+const DefaultPublishTimeout = 5 * time.Second
+
+// DefaultOutboundQueueSize is the number of messages kept while the broker is disconnected.
+const DefaultOutboundQueueSize = 100
+
+var (
+	// ErrPublishQueued is returned when a message is kept to be sent on reconnection to the broker.
+	ErrPublishQueued = errors.New("broker disconnected, message queued")
+
+	// ErrPublishQueueFull is returned when a message is dropped because the broker is disconnected and the outbound queue is full.
+	ErrPublishQueueFull = errors.New("broker disconnected and outbound queue full, message dropped")
+)
+
+// brokerCloseTimeout bounds the wait for the offline status publish on shutdown.
+const brokerCloseTimeout = 2 * time.Second
+
+// BrokerHealth describes the state of the connection to the broker.
+type BrokerHealth struct {
+	Connected     bool       `json:"connected"`
+	Since         *time.Time `json:"since,omitempty"`
+	LastError     string     `json:"last_error,omitempty"`
+	Reconnections int        `json:"reconnections"`
+	Queued        int        `json:"queued"`
+	Dropped       int        `json:"dropped"`
+}
+
+type outboundMessage struct {
+	topic   string
+	payload string
+
+	// sent is called once the message is published, see PubNotify
+	sent func() error
+}
+
 type Broker struct {
 	opts mqtt.ClientOptions
 	mqtt.Client
 	qos byte
+
+	// StatusTopic is the topic on which the hub status is published, retained so that the devices get it on subscription
+	StatusTopic string
+
+	logger *slog.Logger
+
+	mu            sync.Mutex
+	subscriptions map[string]mqtt.MessageHandler
+	health        BrokerHealth
+	connectedOnce bool
+	attempts      int
+
+	queue     []outboundMessage
+	queueSize int
+	flushing  bool
 }
 
-func NewBroker(host string, port int64, qos byte) *Broker {
+/**
+ * NewBroker starts connecting to the MQTT broker, retrying in the background until it succeeds.
+ * The connection is automatically restored when lost, and the subscriptions and the hub status are then applied again.
+ * A Will is set so that the broker publishes the hub status as offline if the connection is lost.
+ */
+func NewBroker(cfg BrokerConfig, logger *slog.Logger) (*Broker, error) {
+	brokerURL, err := cfg.URL()
+	if err != nil {
+		return nil, err
+	}
+	tlsConfig, err := cfg.TLSConfig()
+	if err != nil {
+		return nil, err
+	}
+	if cfg.Password != "" && cfg.Username == "" {
+		return nil, fmt.Errorf("%w: a password is set without username", ErrInvalidBrokerConfig)
+	}
+
+	broker := &Broker{
+		qos:           cfg.QoS,
+		StatusTopic:   cfg.StatusTopic,
+		logger:        logger,
+		subscriptions: make(map[string]mqtt.MessageHandler),
+		queueSize:     cfg.QueueSize,
+	}
+
 	opts := mqtt.NewClientOptions()
-	opts.AddBroker(fmt.Sprintf("%s:%d", host, port))
+	opts.AddBroker(brokerURL)
+	opts.SetClientID(cfg.ClientID)
+	opts.SetUsername(cfg.Username)
+	opts.SetPassword(cfg.Password)
+	if tlsConfig != nil {
+		opts.SetTLSConfig(tlsConfig)
+	}
+	opts.SetWill(cfg.StatusTopic, DEVICE_OFFLINE, cfg.QoS, true)
+	opts.SetConnectRetry(true)
+	opts.SetConnectRetryInterval(cfg.ConnectRetryInterval)
+	opts.SetAutoReconnect(true)
+	opts.SetMaxReconnectInterval(cfg.MaxReconnectInterval)
+	opts.SetConnectionAttemptHandler(broker.onConnectionAttempt)
+	opts.SetOnConnectHandler(broker.onConnect)
+	opts.SetConnectionLostHandler(broker.onConnectionLost)
+	opts.SetReconnectingHandler(broker.onReconnecting)
+
+	// the handlers publish and wait for the acknowledgements, which would block the ordered delivery
+	opts.SetOrderMatters(false)
+
+	broker.opts = *opts
+	broker.Client = mqtt.NewClient(opts)
+
+	// the token completes once connected, the attempts are logged by the handlers
+	broker.Connect()
+
+	return broker, nil
+}
+
+// onConnectionAttempt logs the connection attempts, the failed ones being retried until the broker is reachable.
+func (b *Broker) onConnectionAttempt(broker *url.URL, tlsCfg *tls.Config) *tls.Config {
+	b.mu.Lock()
+	b.attempts++
+	attempts := b.attempts
+	b.mu.Unlock()
+
+	if attempts == 1 {
+		b.logger.Info("connecting to MQTT broker", slog.String("broker", broker.Redacted()))
+	} else {
+		b.logger.Warn("MQTT broker unreachable, retrying", slog.String("broker", broker.Redacted()), slog.Int("attempt", attempts))
+	}
+	return tlsCfg
+}
+
+// onConnect applies again every subscription, the session being clean, and publishes the hub status.
+func (b *Broker) onConnect(client mqtt.Client) {
+	b.mu.Lock()
+	reconnection := b.connectedOnce
+	now := time.Now()
+	b.connectedOnce = true
+	b.attempts = 0
+	b.health.Connected = true
+	b.health.Since = &now
+	if reconnection {
+		b.health.Reconnections++
+	}
+	subscriptions := make(map[string]mqtt.MessageHandler, len(b.subscriptions))
+	for topic, handler := range b.subscriptions {
+		subscriptions[topic] = handler
+	}
+	b.mu.Unlock()
+
+	b.logger.Info("connected to MQTT broker", slog.Bool("reconnection", reconnection), slog.Int("subscriptions", len(subscriptions)))
+
+	for topic, handler := range subscriptions {
+		b.subscribe(topic, handler)
+	}
+	b.Publish(b.StatusTopic, b.qos, true, DEVICE_ONLINE)
+
+	go b.flush()
+}
 
-	client := mqtt.NewClient(opts)
-	if token := client.Connect(); token.Wait() && token.Error() != nil {
-		panic(token.Error())
+func (b *Broker) onConnectionLost(client mqtt.Client, err error) {
+	b.mu.Lock()
+	now := time.Now()
+	b.health.Connected = false
+	b.health.Since = &now
+	b.health.LastError = err.Error()
+	b.mu.Unlock()
+
+	b.logger.Error("connection to MQTT broker lost", slog.String("error", err.Error()))
+}
+
+func (b *Broker) onReconnecting(client mqtt.Client, opts *mqtt.ClientOptions) {
+	b.logger.Warn("reconnecting to MQTT broker")
+}
+
+// Health returns the state of the connection to the broker.
+func (b *Broker) Health() BrokerHealth {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	return b.health
+}
+
+/**
+ * AddSubscription subscribes to a topic now if connected, and on every (re)connection.
+ * The subscription is not waited for, so that it can be called from an MQTT handler.
+ */
+func (b *Broker) AddSubscription(topic string, handler mqtt.MessageHandler) {
+	b.mu.Lock()
+	b.subscriptions[topic] = handler
+	b.mu.Unlock()
+
+	if b.IsConnectionOpen() {
+		b.subscribe(topic, handler)
 	}
+}
 
-	return &Broker{
-		opts:   *opts,
-		Client: client,
-		qos:    qos,
+func (b *Broker) subscribe(topic string, handler mqtt.MessageHandler) {
+	token := b.Subscribe(topic, b.qos, handler)
+	go func() {
+		if token.Wait() && token.Error() != nil {
+			b.logger.Error(fmt.Errorf("error subscribing to %s: %w", topic, token.Error()).Error())
+		}
+	}()
+}
+
+/**
+ * Pub publishes a message and waits for its acknowledgement by the broker until the context deadline,
+ * or for DefaultPublishTimeout if the context has none.
+ * While the broker is disconnected, the message is queued to be sent on reconnection and ErrPublishQueued is returned.
+ */
+func (b *Broker) Pub(ctx context.Context, topic, message string) error {
+	return b.PubNotify(ctx, topic, message, nil)
+}
+
+/**
+ * PubNotify is Pub, calling sent once the message is actually published:
+ * before returning, or on reconnection for a queued message.
+ */
+func (b *Broker) PubNotify(ctx context.Context, topic, message string, sent func() error) error {
+	msg := outboundMessage{topic: topic, payload: message, sent: sent}
+	if !b.IsConnectionOpen() {
+		return b.enqueue(msg)
+	}
+
+	err := b.publish(ctx, topic, message)
+	if errors.Is(err, mqtt.ErrNotConnected) {
+		return b.enqueue(msg)
+	}
+	if err == nil {
+		b.notifySent(msg)
+	}
+	return err
+}
+
+// notifySent calls the sent callback of a published message, if any.
+func (b *Broker) notifySent(msg outboundMessage) {
+	if msg.sent == nil {
+		return
+	}
+	err := msg.sent()
+	if err != nil {
+		b.logger.Error(fmt.Errorf("error handling the publish to %s: %w", msg.topic, err).Error())
 	}
 }
 
-func (b *Broker) Pub(topic, message string) {
+func (b *Broker) publish(ctx context.Context, topic, message string) error {
+	if _, ok := ctx.Deadline(); !ok {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, DefaultPublishTimeout)
+		defer cancel()
+	}
+
 	token := b.Publish(topic, b.qos, false, message)
-	token.Wait()
+	select {
+	case <-token.Done():
+		if token.Error() != nil {
+			return fmt.Errorf("error publishing to %s: %w", topic, token.Error())
+		}
+		return nil
+	case <-ctx.Done():
+		return fmt.Errorf("publish to %s not acknowledged: %w", topic, ctx.Err())
+	}
+}
+
+// enqueue keeps a message to be sent on reconnection, unless the outbound queue is full.
+func (b *Broker) enqueue(msg outboundMessage) error {
+	b.mu.Lock()
+	if len(b.queue) >= b.queueSize {
+		b.health.Dropped++
+		b.mu.Unlock()
+		b.logger.Warn("outbound queue full, message dropped", slog.String("topic", msg.topic))
+		return fmt.Errorf("%w: %s", ErrPublishQueueFull, msg.topic)
+	}
+	b.queue = append(b.queue, msg)
+	b.health.Queued = len(b.queue)
+	b.mu.Unlock()
+
+	// the connection may have been restored since it was checked
+	if b.IsConnectionOpen() {
+		go b.flush()
+	}
+
+	return fmt.Errorf("%w: %s", ErrPublishQueued, msg.topic)
+}
+
+// flush sends the queued messages in order. The messages which cannot be sent are kept for the next connection.
+func (b *Broker) flush() {
+	b.mu.Lock()
+	if b.flushing {
+		b.mu.Unlock()
+		return
+	}
+	b.flushing = true
+
+	for len(b.queue) > 0 && b.IsConnectionOpen() {
+		msg := b.queue[0]
+		b.mu.Unlock()
+
+		err := b.publish(context.Background(), msg.topic, msg.payload)
+		if err == nil {
+			// notified while still queued, so that a message is never seen neither queued nor sent
+			b.notifySent(msg)
+		}
+
+		b.mu.Lock()
+		if err != nil {
+			b.logger.Error(fmt.Errorf("error flushing the outbound queue: %w", err).Error(), slog.Int("queued", len(b.queue)))
+			break
+		}
+		b.queue = b.queue[1:]
+		b.health.Queued = len(b.queue)
+	}
+
+	b.flushing = false
+	b.mu.Unlock()
+}
+
+// Close publishes the hub status as offline, which the Will does not do on a clean disconnection, and disconnects.
+func (b *Broker) Close() {
+	b.mu.Lock()
+	if len(b.queue) > 0 {
+		b.logger.Warn("outbound messages not sent", slog.Int("queued", len(b.queue)))
+	}
+	b.mu.Unlock()
+
+	token := b.Publish(b.StatusTopic, b.qos, true, DEVICE_OFFLINE)
+	token.WaitTimeout(brokerCloseTimeout)
+	b.Disconnect(250)
 }
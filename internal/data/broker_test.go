@@ -0,0 +1,184 @@
+package data
+
+import (
+	"context"
+	"errors"
+	"io"
+	"log/slog"
+	"slices"
+	"sync"
+	"testing"
+	"time"
+
+	mqtt "github.com/eclipse/paho.mqtt.golang"
+)
+
+// fakeToken is an MQTT token already completed, with an optional error.
+type fakeToken struct {
+	err error
+}
+
+func (t *fakeToken) Wait() bool                     { return true }
+func (t *fakeToken) WaitTimeout(time.Duration) bool { return true }
+func (t *fakeToken) Error() error                   { return t.err }
+
+func (t *fakeToken) Done() <-chan struct{} {
+	done := make(chan struct{})
+	close(done)
+	return done
+}
+
+// fakeClient records the published messages, the publishes to the failing topics being rejected.
+type fakeClient struct {
+	mqtt.Client
+
+	mu        sync.Mutex
+	connected bool
+	failing   map[string]bool
+	published []string
+}
+
+func (c *fakeClient) IsConnectionOpen() bool {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.connected
+}
+
+func (c *fakeClient) Publish(topic string, qos byte, retained bool, payload any) mqtt.Token {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.failing[topic] {
+		return &fakeToken{err: errors.New("publish rejected")}
+	}
+	c.published = append(c.published, topic)
+	return &fakeToken{}
+}
+
+func newTestBroker(client *fakeClient, queueSize int) *Broker {
+	return &Broker{
+		Client:        client,
+		logger:        slog.New(slog.NewTextHandler(io.Discard, nil)),
+		subscriptions: make(map[string]mqtt.MessageHandler),
+		queueSize:     queueSize,
+	}
+}
+
+func TestBrokerPubQueue(t *testing.T) {
+	tests := []struct {
+		name        string
+		queueSize   int
+		topics      []string
+		want        []error
+		wantQueued  int
+		wantDropped int
+	}{
+		{"queued", 2, []string{"a", "b"}, []error{ErrPublishQueued, ErrPublishQueued}, 2, 0},
+		{"queue full", 2, []string{"a", "b", "c"}, []error{ErrPublishQueued, ErrPublishQueued, ErrPublishQueueFull}, 2, 1},
+		{"no queue", 0, []string{"a"}, []error{ErrPublishQueueFull}, 0, 1},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			broker := newTestBroker(&fakeClient{}, tt.queueSize)
+
+			sent := 0
+			for i, topic := range tt.topics {
+				err := broker.PubNotify(context.Background(), topic, "1", func() error {
+					sent++
+					return nil
+				})
+				if !errors.Is(err, tt.want[i]) {
+					t.Errorf("PubNotify(%s) error = %v, want %v", topic, err, tt.want[i])
+				}
+			}
+
+			health := broker.Health()
+			if health.Queued != tt.wantQueued || health.Dropped != tt.wantDropped {
+				t.Errorf("Health() = queued %d, dropped %d, want queued %d, dropped %d", health.Queued, health.Dropped, tt.wantQueued, tt.wantDropped)
+			}
+			if sent != 0 {
+				t.Errorf("sent called %d times while disconnected, want 0", sent)
+			}
+		})
+	}
+}
+
+func TestBrokerFlush(t *testing.T) {
+	tests := []struct {
+		name          string
+		queued        []string
+		failing       string
+		wantPublished []string
+		wantSent      []string
+		wantQueued    int
+	}{
+		{"empty queue", nil, "", nil, nil, 0},
+		{"in order", []string{"a", "b", "c"}, "", []string{"a", "b", "c"}, []string{"a", "b", "c"}, 0},
+		{"kept from the failed message", []string{"a", "b", "c"}, "b", []string{"a"}, []string{"a"}, 2},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			client := &fakeClient{failing: map[string]bool{tt.failing: true}}
+			broker := newTestBroker(client, DefaultOutboundQueueSize)
+
+			var sent []string
+			for _, topic := range tt.queued {
+				err := broker.PubNotify(context.Background(), topic, "1", func() error {
+					sent = append(sent, topic)
+					return nil
+				})
+				if !errors.Is(err, ErrPublishQueued) {
+					t.Fatalf("PubNotify(%s) error = %v, want %v", topic, err, ErrPublishQueued)
+				}
+			}
+
+			client.connected = true
+			broker.flush()
+
+			if !slices.Equal(client.published, tt.wantPublished) {
+				t.Errorf("published %v, want %v", client.published, tt.wantPublished)
+			}
+			if !slices.Equal(sent, tt.wantSent) {
+				t.Errorf("sent %v, want %v", sent, tt.wantSent)
+			}
+			if queued := broker.Health().Queued; queued != tt.wantQueued {
+				t.Errorf("queued %d, want %d", queued, tt.wantQueued)
+			}
+		})
+	}
+}
+
+func TestBrokerPubNotifyConnected(t *testing.T) {
+	tests := []struct {
+		name     string
+		failing  bool
+		wantErr  bool
+		wantSent int
+	}{
+		{"published", false, false, 1},
+		{"rejected", true, true, 0},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			client := &fakeClient{connected: true, failing: map[string]bool{"a": tt.failing}}
+			broker := newTestBroker(client, DefaultOutboundQueueSize)
+
+			sent := 0
+			err := broker.PubNotify(context.Background(), "a", "1", func() error {
+				sent++
+				return nil
+			})
+			if (err != nil) != tt.wantErr {
+				t.Errorf("PubNotify() error = %v, want error %v", err, tt.wantErr)
+			}
+			if sent != tt.wantSent {
+				t.Errorf("sent called %d times, want %d", sent, tt.wantSent)
+			}
+			if queued := broker.Health().Queued; queued != 0 {
+				t.Errorf("queued %d, want 0", queued)
+			}
+		})
+	}
+}
@@ -0,0 +1,338 @@
+package data
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"strings"
+	"sync"
+	"time"
+
+	"gorm.io/gorm"
+)
+
+// Statuses of the commands sent to the devices
+const (
+	COMMAND_PENDING   = "pending"
+	COMMAND_ACKED     = "acked"
+	COMMAND_FAILED    = "failed"
+	COMMAND_TIMED_OUT = "timed_out"
+)
+
+// Suffixes of the module channels on which the commands are sent and acknowledged
+const (
+	COMMAND_SUFFIX = "set"
+	ACK_SUFFIX     = "ack"
+)
+
+// Statuses of the acknowledgements sent by the devices
+const (
+	ACK_OK    = "ok"
+	ACK_ERROR = "error"
+)
+
+/**
+ * Command is a value sent to a module of a device, on the "set" suffix of the module channel.
+ * The device acknowledges it on the "ack" suffix with the same correlation ID, see CommandMessage and AckMessage.
+ */
+type Command struct {
+	ID         string `gorm:"primaryKey"`
+	CreatedAt  time.Time
+	UpdatedAt  time.Time
+	DeviceID   string `gorm:"index"`
+	LocationID uint
+	Module     string
+	Topic      string
+	Value      string
+	Status     string `gorm:"index"`
+	Attempts   int
+	Error      string
+	SentAt     *time.Time // nil while the command waits in the outbound queue of the broker
+	AckedAt    *time.Time
+}
+
+// CommandMessage is the payload of a command, e.g. {"id":"5f2c...","value":"true"}.
+type CommandMessage struct {
+	ID    string `json:"id"`
+	Value string `json:"value"`
+}
+
+// AckMessage is the payload of an acknowledgement, e.g. {"id":"5f2c...","status":"ok"} or {"id":"5f2c...","status":"error","error":"relay stuck"}.
+type AckMessage struct {
+	ID     string `json:"id"`
+	Status string `json:"status"`
+	Error  string `json:"error,omitempty"`
+}
+
+func NewAckMessage(payload []byte) (*AckMessage, error) {
+	var ack AckMessage
+	err := json.Unmarshal(payload, &ack)
+	if err != nil {
+		return nil, fmt.Errorf("error unmarshalling ack message: %w", err)
+	}
+	if ack.ID == "" {
+		return nil, errors.New("ack message without command id")
+	}
+	ack.Status = strings.ToLower(strings.TrimSpace(ack.Status))
+	if ack.Status != ACK_OK && ack.Status != ACK_ERROR {
+		return nil, fmt.Errorf("unknown ack status %q", ack.Status)
+	}
+	return &ack, nil
+}
+
+/**
+ * CommandModel stores the commands and wakes up the requests waiting for their outcome.
+ * The retries and the timeouts are handled by the automation.CommandTracker.
+ */
+type CommandModel struct {
+	DB     *gorm.DB
+	Broker *Broker
+	Events *EventBus
+
+	mu      sync.Mutex
+	waiters map[string][]chan struct{}
+}
+
+func NewCommandModel(db *gorm.DB, broker *Broker, events *EventBus) *CommandModel {
+	return &CommandModel{
+		DB:      db,
+		Broker:  broker,
+		Events:  events,
+		waiters: make(map[string][]chan struct{}),
+	}
+}
+
+// newCommandID generates a correlation ID of 16 random bytes, hex encoded.
+func newCommandID() (string, error) {
+	randomBytes := make([]byte, 16)
+	_, err := rand.Read(randomBytes)
+	if err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(randomBytes), nil
+}
+
+/**
+ * Send stores a pending command and publishes it to the module of the device.
+ * The errors of the publish are returned, see Broker.Pub: a queued command stays pending, the others are failed.
+ */
+func (m *CommandModel) Send(ctx context.Context, device *Device, module *Module, payload string) (*Command, error) {
+	id, err := newCommandID()
+	if err != nil {
+		return nil, fmt.Errorf("error generating command id: %w", err)
+	}
+
+	command := &Command{
+		ID:         id,
+		DeviceID:   device.ID,
+		LocationID: device.LocationID,
+		Module:     module.Name,
+		Topic:      device.GetChannel(module) + "/" + COMMAND_SUFFIX,
+		Value:      payload,
+		Status:     COMMAND_PENDING,
+		Attempts:   1,
+	}
+
+	err = m.DB.Create(command).Error
+	if err != nil {
+		return nil, fmt.Errorf("could not create command: %w", err)
+	}
+
+	err = m.publish(ctx, command)
+	if err != nil && !errors.Is(err, ErrPublishQueued) {
+		if _, finishErr := m.finish(command, COMMAND_FAILED, err.Error()); finishErr != nil {
+			return command, errors.Join(err, finishErr)
+		}
+	}
+	return command, err
+}
+
+/**
+ * Retry publishes a pending command again, with the same correlation ID.
+ * The attempt counts even if the publish fails, so that the command is retried then timed out as usual.
+ */
+func (m *CommandModel) Retry(ctx context.Context, command *Command) error {
+	command.Attempts++
+	command.SentAt = nil
+
+	err := m.DB.Model(&Command{}).Where("id = ? AND status = ?", command.ID, COMMAND_PENDING).
+		Updates(map[string]any{"attempts": command.Attempts, "sent_at": nil}).Error
+	if err != nil {
+		return fmt.Errorf("error updating command %s: %w", command.ID, err)
+	}
+
+	err = m.publish(ctx, command)
+	if err != nil && !errors.Is(err, ErrPublishQueued) {
+		if sentErr := m.markSent(command.ID, time.Now()); sentErr != nil {
+			return errors.Join(err, sentErr)
+		}
+	}
+	return err
+}
+
+// publish sends a command, its sending time being recorded once it is actually published, see Broker.PubNotify.
+func (m *CommandModel) publish(ctx context.Context, command *Command) error {
+	payload, err := json.Marshal(CommandMessage{ID: command.ID, Value: command.Value})
+	if err != nil {
+		return fmt.Errorf("error marshaling command: %w", err)
+	}
+
+	var sentAt time.Time
+	err = m.Broker.PubNotify(ctx, command.Topic, string(payload), func() error {
+		sentAt = time.Now()
+		return m.markSent(command.ID, sentAt)
+	})
+	// the callback of a queued command runs later, on reconnection, it is only read for a command published now
+	if err == nil {
+		command.SentAt = &sentAt
+	}
+	return err
+}
+
+func (m *CommandModel) markSent(id string, sentAt time.Time) error {
+	err := m.DB.Model(&Command{}).Where("id = ? AND status = ?", id, COMMAND_PENDING).Update("sent_at", sentAt).Error
+	if err != nil {
+		return fmt.Errorf("error updating command %s: %w", id, err)
+	}
+	return nil
+}
+
+func (m *CommandModel) Get(id string) (*Command, error) {
+	var command Command
+	err := m.DB.First(&command, "id = ?", id).Error
+	if err != nil {
+		switch {
+		case errors.Is(err, gorm.ErrRecordNotFound):
+			return nil, fmt.Errorf("command %s: %w", id, ErrRecordNotFound)
+		default:
+			return nil, fmt.Errorf("failed to get command %s: %w", id, err)
+		}
+	}
+	return &command, nil
+}
+
+// GetPending returns the commands waiting for their acknowledgement, the oldest first.
+func (m *CommandModel) GetPending() ([]*Command, error) {
+	var commands []*Command
+	err := m.DB.Where("status = ?", COMMAND_PENDING).Order("created_at").Find(&commands).Error
+	if err != nil {
+		return nil, fmt.Errorf("failed to get pending commands: %w", err)
+	}
+	return commands, nil
+}
+
+// Prune deletes the acknowledged, failed and timed out commands last updated before a time, and returns their number.
+func (m *CommandModel) Prune(before time.Time) (int64, error) {
+	result := m.DB.Where("status <> ? AND updated_at < ?", COMMAND_PENDING, before).Delete(&Command{})
+	if result.Error != nil {
+		return 0, fmt.Errorf("error pruning commands: %w", result.Error)
+	}
+	return result.RowsAffected, nil
+}
+
+/**
+ * Ack records the acknowledgement of a command by its device.
+ * It returns false if the command is already acknowledged, failed or timed out, e.g. for the ack of a retry.
+ */
+func (m *CommandModel) Ack(deviceID string, ack *AckMessage) (*Command, bool, error) {
+	command, err := m.Get(ack.ID)
+	if err != nil {
+		return nil, false, err
+	}
+	if command.DeviceID != deviceID {
+		return nil, false, fmt.Errorf("command %s of device %s acknowledged by device %s: %w", command.ID, command.DeviceID, deviceID, ErrRecordNotFound)
+	}
+
+	status := COMMAND_ACKED
+	if ack.Status == ACK_ERROR {
+		status = COMMAND_FAILED
+	}
+
+	done, err := m.finish(command, status, ack.Error)
+	return command, done, err
+}
+
+// Expire sets a pending command as timed out, its device having acknowledged none of the attempts.
+func (m *CommandModel) Expire(command *Command) (bool, error) {
+	return m.finish(command, COMMAND_TIMED_OUT, fmt.Sprintf("no acknowledgement after %d attempts", command.Attempts))
+}
+
+// finish sets the final status of a pending command, then wakes up its waiters and publishes it on the EventBus.
+func (m *CommandModel) finish(command *Command, status, message string) (bool, error) {
+	now := time.Now()
+	updates := map[string]any{"status": status, "error": message}
+	if status == COMMAND_ACKED {
+		updates["acked_at"] = now
+	}
+
+	result := m.DB.Model(&Command{}).Where("id = ? AND status = ?", command.ID, COMMAND_PENDING).Updates(updates)
+	if result.Error != nil {
+		return false, fmt.Errorf("error updating command %s: %w", command.ID, result.Error)
+	}
+	if result.RowsAffected == 0 {
+		return false, nil
+	}
+
+	command.Status = status
+	command.Error = message
+	if status == COMMAND_ACKED {
+		command.AckedAt = &now
+	}
+
+	m.mu.Lock()
+	for _, waiter := range m.waiters[command.ID] {
+		close(waiter)
+	}
+	delete(m.waiters, command.ID)
+	m.mu.Unlock()
+
+	m.Events.Publish(Event{
+		Type:       EVENT_COMMAND,
+		DeviceID:   command.DeviceID,
+		LocationID: command.LocationID,
+		Module:     command.Module,
+		Value:      status,
+		Time:       now,
+	})
+
+	return true, nil
+}
+
+/**
+ * Wait waits for a command to be acknowledged, failed or timed out, until the context is done.
+ * The command is returned as it is then, possibly still pending.
+ */
+func (m *CommandModel) Wait(ctx context.Context, id string) (*Command, error) {
+	waiter := make(chan struct{})
+
+	m.mu.Lock()
+	m.waiters[id] = append(m.waiters[id], waiter)
+	m.mu.Unlock()
+
+	// the command may have been finished before the waiter was registered
+	command, err := m.Get(id)
+	if err == nil && command.Status == COMMAND_PENDING {
+		select {
+		case <-waiter:
+		case <-ctx.Done():
+		}
+		command, err = m.Get(id)
+	}
+
+	m.mu.Lock()
+	for i, w := range m.waiters[id] {
+		if w == waiter {
+			m.waiters[id] = append(m.waiters[id][:i], m.waiters[id][i+1:]...)
+			break
+		}
+	}
+	if len(m.waiters[id]) == 0 {
+		delete(m.waiters, id)
+	}
+	m.mu.Unlock()
+
+	return command, err
+}
@@ -0,0 +1,48 @@
+package data
+
+import "testing"
+
+func TestNewAckMessage(t *testing.T) {
+	tests := []struct {
+		name    string
+		payload string
+		want    AckMessage
+	}{
+		{"ok", `{"id": "5f2c", "status": "ok"}`, AckMessage{ID: "5f2c", Status: ACK_OK}},
+		{"error", `{"id": "5f2c", "status": "error", "error": "relay stuck"}`, AckMessage{ID: "5f2c", Status: ACK_ERROR, Error: "relay stuck"}},
+		{"status case and spaces", `{"id": "5f2c", "status": " OK "}`, AckMessage{ID: "5f2c", Status: ACK_OK}},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := NewAckMessage([]byte(tt.payload))
+			if err != nil {
+				t.Fatalf("NewAckMessage(%q) error = %v", tt.payload, err)
+			}
+			if *got != tt.want {
+				t.Errorf("NewAckMessage(%q) = %+v, want %+v", tt.payload, *got, tt.want)
+			}
+		})
+	}
+}
+
+func TestNewAckMessageErrors(t *testing.T) {
+	tests := []struct {
+		name    string
+		payload string
+	}{
+		{"invalid JSON", `{"id": "5f2c"`},
+		{"no id", `{"status": "ok"}`},
+		{"no status", `{"id": "5f2c"}`},
+		{"unknown status", `{"id": "5f2c", "status": "done"}`},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := NewAckMessage([]byte(tt.payload))
+			if err == nil {
+				t.Errorf("NewAckMessage(%q) = %+v, want an error", tt.payload, *got)
+			}
+		})
+	}
+}
@@ -1,13 +1,30 @@
 package data
 
 import (
-	"strconv"
-	
 	"gorm.io/gorm"
 )
 
 const CONSUMPTION_SENSOR = "consumptionSensor"
 
+func init() {
+	RegisterModuleType(ModuleType{
+		Name:     CONSUMPTION_SENSOR,
+		Kind:     KIND_NUMERIC,
+		Unit:     "Wh",
+		Writable: false,
+		Parse:    parseFloat,
+		Encode:   encodeFloat,
+		New: func(module *Module, value any) IModule {
+			return ConsumptionSensor{
+				Model:         module.Model,
+				DeviceID:      module.DeviceID,
+				Name:          module.Name,
+				ValueWattHour: value.(float64),
+			}
+		},
+	})
+}
+
 type ConsumptionSensor struct {
 	gorm.Model
 	DeviceID      string `gorm:"index"`
@@ -22,17 +39,3 @@ func (c ConsumptionSensor) GetValue() any {
 func (c ConsumptionSensor) GetName() string {
 	return c.Name
 }
-
-type ConsumptionSensorModel struct {
-	DB     *gorm.DB
-	Broker *Broker
-}
-
-func (m *ConsumptionSensorModel) Set(channel string, value any) error {
-	floatValue, err := ToFloat(value)
-	if err != nil {
-		return err
-	}
-	m.Broker.Pub(channel, strconv.FormatFloat(floatValue, 'f', 2, 64))
-	return nil
-}
@@ -14,31 +14,35 @@ import (
 
 type Data struct {
 	gorm.Model
-	DeviceID    string
+	DeviceID    string `gorm:"index:idx_data_history,priority:1"`
 	Device      Device `gorm:"foreignKey:DeviceID"`
 	ModuleID    uint
-	ModuleName  string
+	ModuleName  string `gorm:"index:idx_data_history,priority:2"`
 	ModuleValue string
+	Unit        string
+	Seq         *uint64
 }
 
 type DataModel struct {
-	DB     *gorm.DB
-	Broker *Broker
-	Logger *slog.Logger
+	DB       *gorm.DB
+	Broker   *Broker
+	Logger   *slog.Logger
+	Events   *EventBus
+	Devices  *DeviceModel
+	Commands *CommandModel
+	Ingester *Ingester
+	Startups *StartupWorker
 }
 
-func (m *DataModel) updateModule(deviceID string, moduleID uint, nouveauNom string, nouvelleValeur string) error {
-	module := Module{}
-	err := m.DB.Where("device_id = ? AND id = ?", deviceID, moduleID).First(&module).Error
-	if err != nil {
-		return err
-	}
-
-	module.Name = nouveauNom
-	module.Value = nouvelleValeur
-
-	err = m.DB.Save(&module).Error
-	return err
+/**
+ * updateModule sets the value reported by the device, unless a more recent reading was already received,
+ * e.g. when the readings buffered by the device arrive after the live ones.
+ */
+func (m *DataModel) updateModule(db *gorm.DB, deviceID string, moduleID uint, nouvelleValeur string, readAt time.Time) error {
+	// only the reported value is updated, the desired value being set by the commands meanwhile
+	return db.Model(&Module{}).
+		Where("device_id = ? AND id = ? AND (reported_at IS NULL OR reported_at <= ?)", deviceID, moduleID, readAt).
+		Updates(map[string]any{"value": nouvelleValeur, "reported_at": readAt}).Error
 }
 
 func (m *DataModel) NewData(message mqtt.Message) (*Data, error) {
@@ -63,14 +67,21 @@ func (m *DataModel) NewData(message mqtt.Message) (*Data, error) {
 	deviceID := channelElems[4]
 	moduleName := channelElems[5]
 
-	// Get value in payload
-	moduleValue := string(message.Payload())
-	if moduleValue == "" {
-		return nil, fmt.Errorf("no value found in payload")
+	// Get value in payload, raw or JSON with the time and sequence number of the reading
+	reading, err := ParseReading(message.Payload())
+	if err != nil {
+		return nil, err
+	}
+	moduleValue := reading.Value
+
+	readAt, plausible := reading.readingTimeAt(time.Now())
+	if !plausible {
+		m.Logger.Warn("implausible reading time, using the reception time", slog.String("TOPIC", channel), slog.Time("ts", reading.Time))
 	}
 
 	// Create data instance
 	data := &Data{
+		Model:    gorm.Model{CreatedAt: readAt},
 		DeviceID: deviceID,
 		Device: Device{
 			ID:         deviceID,
@@ -86,6 +97,8 @@ func (m *DataModel) NewData(message mqtt.Message) (*Data, error) {
 		},
 		ModuleName:  moduleName,
 		ModuleValue: moduleValue,
+		Unit:        reading.Unit,
+		Seq:         reading.Seq,
 	}
 
 	// Retrieve device and module data from DB
@@ -95,35 +108,95 @@ func (m *DataModel) NewData(message mqtt.Message) (*Data, error) {
 	//if err != nil {
 	//	return nil, fmt.Errorf("error finding device %w", err)
 	//}
-	err = m.DB.Preload("Modules").First(&data.Device, "id = ?", deviceID).Error
+	// the device and its modules are cached, see DeviceCache
+	cached, modules, err := m.Devices.Cache.Get(deviceID)
 	if err != nil {
 		// FIXME -> reset device or skip data?
 		return nil, fmt.Errorf("error finding device %w", err)
 	}
+	data.Device = cached
+
+	// Get ModuleID from the modules of the device by name
+	moduleID, ok := modules[data.ModuleName]
+	if !ok {
+		return nil, fmt.Errorf("module %s of device %s: %w", moduleName, deviceID, ErrRecordNotFound)
+	}
+	data.ModuleID = moduleID
 
-	// Get ModuleID from Device.Modules by matching Device.ID/Module.Type
-	for _, module := range data.Device.Modules {
-		if module.Name == data.ModuleName {
-			data.ModuleID = module.ID
+	// Drop the readings received twice, e.g. redelivered by the broker
+	if data.Seq != nil {
+		ok, err := m.Devices.Cache.ClaimReading(deviceID, data.ModuleID, *data.Seq, readAt, time.Now())
+		if err != nil {
+			return nil, err
 		}
+		if !ok {
+			return nil, fmt.Errorf("%w: seq %d of module %s of device %s", ErrDuplicateReading, *data.Seq, moduleName, deviceID)
+		}
+	}
+
+	// the value of the module is updated with the insertion of the reading, see Ingester.flush
+	return data, nil
+}
+
+// publishReading notifies the EventBus subscribers of an accepted reading, with its typed value when possible.
+func (m *DataModel) publishReading(data *Data) {
+	var value any = data.ModuleValue
+	module := Module{Name: data.ModuleName, Value: data.ModuleValue}
+	if iModule, err := module.ToIModule(); err == nil {
+		value = iModule.GetValue()
 	}
-	// Mise à jour de la valeur du module
-	err = m.updateModule(deviceID, data.ModuleID, moduleName, moduleValue)
+
+	m.Events.Publish(Event{
+		Type:       EVENT_READING,
+		DeviceID:   data.DeviceID,
+		LocationID: data.Device.LocationID,
+		ModuleID:   data.ModuleID,
+		Module:     data.ModuleName,
+		Value:      value,
+		Time:       data.CreatedAt,
+	})
+}
+
+// markSeen updates the last seen time of a device which sent a message, and publishes its status if it came online.
+func (m *DataModel) markSeen(device *Device) {
+	now := time.Now()
+	online, err := m.Devices.MarkSeen(device.ID, now)
 	if err != nil {
-		return nil, fmt.Errorf("Erreur de mise à jour du module %s, valeur %s  error: %w", moduleName, moduleValue, err)
+		m.Logger.Error(err.Error())
+		return
 	}
-	return data, nil
+	if !online {
+		return
+	}
+
+	m.Events.Publish(Event{
+		Type:       EVENT_STATUS,
+		DeviceID:   device.ID,
+		LocationID: device.LocationID,
+		Value:      DEVICE_ONLINE,
+		Time:       now,
+	})
 }
 
-func (m *DataModel) insert(data *Data) error {
-	result := m.DB.Model(&Data{}).Create(&data)
-	if result.Error != nil {
-		return fmt.Errorf("error inserting data: %w", result.Error)
+// markOffline sets a device offline on its request, and publishes its status if it was online.
+func (m *DataModel) markOffline(device *Device) {
+	now := time.Now()
+	offline, err := m.Devices.MarkOffline(device.ID, now)
+	if err != nil {
+		m.Logger.Error(err.Error())
+		return
 	}
-	if result.RowsAffected == 0 {
-		return fmt.Errorf("error inserting data: %d rows affected", result.RowsAffected)
+	if !offline {
+		return
 	}
-	return nil
+
+	m.Events.Publish(Event{
+		Type:       EVENT_STATUS,
+		DeviceID:   device.ID,
+		LocationID: device.LocationID,
+		Value:      DEVICE_OFFLINE,
+		Time:       now,
+	})
 }
 
 func (m *DataModel) Check(device *Device) error {
@@ -137,6 +210,5 @@ func (m *DataModel) Check(device *Device) error {
 			return fmt.Errorf("error fetching device %v: %w", device.ID, err)
 		}
 	}
-	time.Sleep(5 * time.Second)
 	return nil
 }
@@ -0,0 +1,232 @@
+package data
+
+import (
+	"errors"
+	"fmt"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"gorm.io/gorm"
+)
+
+// DeviceCacheStats describes the use of the device cache by the ingestion of the readings.
+type DeviceCacheStats struct {
+	Entries       int     `json:"entries"`
+	Hits          uint64  `json:"hits"`
+	Misses        uint64  `json:"misses"`
+	Invalidations uint64  `json:"invalidations"`
+	HitRatio      float64 `json:"hit_ratio"`
+
+	// RecentReadings is the number of sequence numbers kept to detect the duplicates
+	RecentReadings int `json:"recent_readings"`
+}
+
+type cachedDevice struct {
+	device  Device
+	modules map[string]uint
+}
+
+type readingKey struct {
+	moduleID uint
+	seq      uint64
+}
+
+// recentReading is the time of a reading and the time it was received, after which it is forgotten.
+type recentReading struct {
+	readAt     time.Time
+	receivedAt time.Time
+}
+
+/**
+ * DeviceCache keeps the devices and the IDs of their modules by name, so that the readings are resolved
+ * without querying the database. The entries are invalidated on the startup of their device and on the
+ * changes of the devices and modules by the DeviceModel and the ModuleModel.
+ * It also keeps the sequence numbers of the readings received within duplicateWindow, see ClaimReading.
+ */
+type DeviceCache struct {
+	DB *gorm.DB
+
+	mu      sync.RWMutex
+	devices map[string]*cachedDevice
+
+	// generation is incremented on every invalidation, so that a device loaded meanwhile is not cached
+	generation uint64
+
+	hits          atomic.Uint64
+	misses        atomic.Uint64
+	invalidations atomic.Uint64
+
+	// the recent readings are not invalidated with the devices, they are only forgotten after duplicateWindow
+	recentMu sync.Mutex
+	recent   map[string]map[readingKey]recentReading
+	prunedAt time.Time
+}
+
+func NewDeviceCache(db *gorm.DB) *DeviceCache {
+	return &DeviceCache{
+		DB:      db,
+		devices: make(map[string]*cachedDevice),
+		recent:  make(map[string]map[readingKey]recentReading),
+	}
+}
+
+/**
+ * Get returns a device with its location, without its modules, and the IDs of its modules by name.
+ * The device is loaded from the database if it is not cached yet. The returned map must not be modified,
+ * and the status of the device (LastSeenAt, Online) is that of its loading.
+ */
+func (c *DeviceCache) Get(id string) (Device, map[string]uint, error) {
+	c.mu.RLock()
+	entry, ok := c.devices[id]
+	generation := c.generation
+	c.mu.RUnlock()
+
+	if ok {
+		c.hits.Add(1)
+		return entry.device, entry.modules, nil
+	}
+	c.misses.Add(1)
+
+	var device Device
+	err := c.DB.Joins("Location").Preload("Modules").First(&device, "devices.id = ?", id).Error
+	if err != nil {
+		switch {
+		case errors.Is(err, gorm.ErrRecordNotFound):
+			return Device{}, nil, fmt.Errorf("device with id %s: %w", id, ErrRecordNotFound)
+		default:
+			return Device{}, nil, fmt.Errorf("failed to get device with id %s: %w", id, err)
+		}
+	}
+
+	entry = &cachedDevice{modules: make(map[string]uint, len(device.Modules))}
+	for _, module := range device.Modules {
+		entry.modules[module.Name] = module.ID
+	}
+	device.Modules = nil
+	entry.device = device
+
+	c.mu.Lock()
+	if c.generation == generation {
+		c.devices[id] = entry
+	}
+	c.mu.Unlock()
+
+	return entry.device, entry.modules, nil
+}
+
+// Invalidate removes a device from the cache, to be loaded again on its next reading.
+func (c *DeviceCache) Invalidate(id string) {
+	c.mu.Lock()
+	delete(c.devices, id)
+	c.generation++
+	c.mu.Unlock()
+
+	c.invalidations.Add(1)
+}
+
+// InvalidateAll empties the cache, when the devices concerned by a change are not known.
+func (c *DeviceCache) InvalidateAll() {
+	c.mu.Lock()
+	c.devices = make(map[string]*cachedDevice)
+	c.generation++
+	c.mu.Unlock()
+
+	c.invalidations.Add(1)
+}
+
+/**
+ * ClaimReading reports whether a reading with a sequence number is new, i.e. whether no reading of the module
+ * with the same sequence number was received within duplicateWindow of its time, and keeps it to compare the next ones.
+ * The readings of a device stored before its first one since the start of the server are loaded from the database.
+ */
+func (c *DeviceCache) ClaimReading(deviceID string, moduleID uint, seq uint64, readAt, now time.Time) (bool, error) {
+	c.recentMu.Lock()
+	readings, ok := c.recent[deviceID]
+	c.recentMu.Unlock()
+
+	if !ok {
+		// the readings of a device are handled by a single ingestion worker, it is loaded only once
+		loaded, err := c.loadRecent(deviceID, now)
+		if err != nil {
+			return false, err
+		}
+		readings = loaded
+	}
+
+	c.recentMu.Lock()
+	defer c.recentMu.Unlock()
+
+	if !ok {
+		c.recent[deviceID] = readings
+	}
+	if now.Sub(c.prunedAt) >= duplicateWindow {
+		c.pruneRecent(now)
+	}
+
+	key := readingKey{moduleID: moduleID, seq: seq}
+	if previous, ok := readings[key]; ok && previous.readAt.Sub(readAt).Abs() <= duplicateWindow {
+		return false, nil
+	}
+	readings[key] = recentReading{readAt: readAt, receivedAt: now}
+	return true, nil
+}
+
+// loadRecent returns the sequence numbers of the readings of a device stored within duplicateWindow.
+func (c *DeviceCache) loadRecent(deviceID string, now time.Time) (map[readingKey]recentReading, error) {
+	var rows []struct {
+		ModuleID  uint
+		Seq       uint64
+		CreatedAt time.Time
+	}
+	err := c.DB.Model(&Data{}).Select("module_id, seq, created_at").
+		Where("device_id = ? AND seq IS NOT NULL AND created_at >= ?", deviceID, now.Add(-duplicateWindow)).
+		Scan(&rows).Error
+	if err != nil {
+		return nil, fmt.Errorf("error loading the recent readings of device %s: %w", deviceID, err)
+	}
+
+	readings := make(map[readingKey]recentReading, len(rows))
+	for _, row := range rows {
+		readings[readingKey{moduleID: row.ModuleID, seq: row.Seq}] = recentReading{readAt: row.CreatedAt, receivedAt: now}
+	}
+	return readings, nil
+}
+
+// pruneRecent forgets the readings received more than duplicateWindow ago. The caller holds recentMu.
+func (c *DeviceCache) pruneRecent(now time.Time) {
+	for _, readings := range c.recent {
+		for key, reading := range readings {
+			if now.Sub(reading.receivedAt) > duplicateWindow {
+				delete(readings, key)
+			}
+		}
+	}
+	c.prunedAt = now
+}
+
+// Stats returns the counters of the cache, the hit ratio being 0 before the first reading.
+func (c *DeviceCache) Stats() DeviceCacheStats {
+	c.mu.RLock()
+	entries := len(c.devices)
+	c.mu.RUnlock()
+
+	c.recentMu.Lock()
+	recent := 0
+	for _, readings := range c.recent {
+		recent += len(readings)
+	}
+	c.recentMu.Unlock()
+
+	stats := DeviceCacheStats{
+		Entries:        entries,
+		Hits:           c.hits.Load(),
+		Misses:         c.misses.Load(),
+		Invalidations:  c.invalidations.Load(),
+		RecentReadings: recent,
+	}
+	if total := stats.Hits + stats.Misses; total > 0 {
+		stats.HitRatio = float64(stats.Hits) / float64(total)
+	}
+	return stats
+}
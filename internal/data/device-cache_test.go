@@ -0,0 +1,98 @@
+package data
+
+import (
+	"testing"
+	"time"
+)
+
+func TestDeviceCacheClaimReading(t *testing.T) {
+	start := time.Date(2025, time.April, 4, 10, 0, 0, 0, time.UTC)
+
+	type claim struct {
+		moduleID uint
+		seq      uint64
+		readAt   time.Duration // after start
+		now      time.Duration // after start
+		want     bool
+	}
+
+	tests := []struct {
+		name   string
+		claims []claim
+	}{
+		{"new readings", []claim{
+			{1, 1, 0, 0, true},
+			{1, 2, time.Second, time.Second, true},
+		}},
+		{"repeated", []claim{
+			{1, 1, 0, 0, true},
+			{1, 1, 0, time.Second, false},
+		}},
+		{"same seq on another module", []claim{
+			{1, 1, 0, 0, true},
+			{2, 1, 0, 0, true},
+		}},
+		{"buffered and sent again", []claim{
+			{1, 1, 0, 0, true},
+			{1, 1, 0, 5 * time.Minute, false},
+		}},
+		{"seq restarted after a reboot", []claim{
+			{1, 1, 0, 0, true},
+			{1, 1, duplicateWindow + time.Second, duplicateWindow + time.Second, true},
+		}},
+		{"seq of an older reading", []claim{
+			{1, 1, duplicateWindow + time.Second, duplicateWindow + time.Second, true},
+			{1, 1, 0, duplicateWindow + 2*time.Second, true},
+		}},
+		{"forgotten after the window", []claim{
+			{1, 1, 0, 0, true},
+			{1, 1, 0, duplicateWindow + time.Second, true},
+		}},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			cache := NewDeviceCache(nil)
+			// the device is already known, its recent readings are not loaded from the database
+			cache.recent["esp1"] = make(map[readingKey]recentReading)
+
+			for i, c := range tt.claims {
+				got, err := cache.ClaimReading("esp1", c.moduleID, c.seq, start.Add(c.readAt), start.Add(c.now))
+				if err != nil {
+					t.Fatalf("claim %d: ClaimReading() error = %v", i, err)
+				}
+				if got != c.want {
+					t.Errorf("claim %d: ClaimReading(module %d, seq %d) = %v, want %v", i, c.moduleID, c.seq, got, c.want)
+				}
+			}
+		})
+	}
+}
+
+func TestDeviceCacheStatsRecentReadings(t *testing.T) {
+	start := time.Date(2025, time.April, 4, 10, 0, 0, 0, time.UTC)
+	cache := NewDeviceCache(nil)
+	cache.recent["esp1"] = make(map[readingKey]recentReading)
+	cache.recent["esp2"] = make(map[readingKey]recentReading)
+
+	for seq := range uint64(3) {
+		if _, err := cache.ClaimReading("esp1", 1, seq, start, start); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if _, err := cache.ClaimReading("esp2", 1, 1, start, start); err != nil {
+		t.Fatal(err)
+	}
+	if got := cache.Stats().RecentReadings; got != 4 {
+		t.Errorf("RecentReadings = %d, want 4", got)
+	}
+
+	// the readings received more than duplicateWindow ago are pruned on the next claim
+	later := start.Add(duplicateWindow + time.Second)
+	if _, err := cache.ClaimReading("esp2", 1, 2, later, later); err != nil {
+		t.Fatal(err)
+	}
+	if got := cache.Stats().RecentReadings; got != 1 {
+		t.Errorf("RecentReadings after the window = %d, want 1", got)
+	}
+}
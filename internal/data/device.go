@@ -1,14 +1,25 @@
 package data
 
 import (
+	"context"
 	"errors"
 	"fmt"
 	"strconv"
+	"strings"
 	"time"
 
+	"HomeIoT/internal/validator"
+
 	"gorm.io/gorm"
 )
 
+// Statuses of the devices
+const (
+	DEVICE_ONLINE  = "online"
+	DEVICE_OFFLINE = "offline"
+	DEVICE_UNKNOWN = "unknown"
+)
+
 type Device struct {
 	ID         string `gorm:"primaryKey;index"`
 	CreatedAt  time.Time
@@ -20,6 +31,8 @@ type Device struct {
 	Name       string
 	Modules    []Module `gorm:"foreignKey:DeviceID"`
 	//Modules []Module `gorm:"many2many:devices_modules;"`
+	LastSeenAt *time.Time
+	Online     bool `gorm:"index"`
 }
 
 //type Devices_modules struct {
@@ -27,6 +40,18 @@ type Device struct {
 //	ModuleID int    `gorm:"primaryKey"`
 //}
 
+// Status returns DEVICE_ONLINE or DEVICE_OFFLINE, or DEVICE_UNKNOWN if the device never sent any message.
+func (d Device) Status() string {
+	switch {
+	case d.LastSeenAt == nil:
+		return DEVICE_UNKNOWN
+	case d.Online:
+		return DEVICE_ONLINE
+	default:
+		return DEVICE_OFFLINE
+	}
+}
+
 func (d *Device) GetChannel(iModule IModule) string {
 	return fmt.Sprintf("home/%s/%d/%s/%s/%s", d.Location.Type, d.LocationID, d.Type, d.ID, iModule.GetName())
 }
@@ -34,15 +59,16 @@ func (d *Device) GetChannel(iModule IModule) string {
 type DeviceModel struct {
 	DB     *gorm.DB
 	Broker *Broker
+	Cache  *DeviceCache
 }
 
 func (m *DeviceModel) GetByID(id string) (*Device, error) {
 	var device Device
-	err := m.DB.Joins("Location").Joins("Module").Where("device_id = ?", id).First(&device).Error
+	err := m.DB.Joins("Location").Preload("Modules").First(&device, "devices.id = ?", id).Error
 	if err != nil {
 		switch {
 		case errors.Is(err, gorm.ErrRecordNotFound):
-			return nil, fmt.Errorf("device with id %s not found", id)
+			return nil, fmt.Errorf("device with id %s: %w", id, ErrRecordNotFound)
 		default:
 			return nil, fmt.Errorf("failed to get device with id %s: %w", id, err)
 		}
@@ -78,19 +104,123 @@ func (m *DeviceModel) GetAll() ([]*Device, error) {
 		}
 		return nil, fmt.Errorf("failed to get devices: %w", err)
 	}
-	if len(devices) == 0 {
-		return nil, fmt.Errorf("0 devices found")
+	return devices, nil
+}
+
+// GetOnline returns the devices currently considered online.
+func (m *DeviceModel) GetOnline() ([]*Device, error) {
+	var devices []*Device
+	err := m.DB.Where("online").Find(&devices).Error
+	if err != nil {
+		return nil, fmt.Errorf("failed to get online devices: %w", err)
 	}
 	return devices, nil
 }
 
+/**
+ * MarkSeen records that a device sent a message at the given time.
+ * It returns true if the device was not online before, i.e. if it just came (back) online.
+ */
+func (m *DeviceModel) MarkSeen(id string, t time.Time) (bool, error) {
+	result := m.DB.Model(&Device{}).Where("id = ? AND NOT online", id).Updates(map[string]any{"last_seen_at": t, "online": true})
+	if result.Error != nil {
+		return false, fmt.Errorf("error updating last seen of device %s: %w", id, result.Error)
+	}
+	if result.RowsAffected > 0 {
+		return true, nil
+	}
+
+	err := m.DB.Model(&Device{}).Where("id = ?", id).Update("last_seen_at", t).Error
+	if err != nil {
+		return false, fmt.Errorf("error updating last seen of device %s: %w", id, err)
+	}
+	return false, nil
+}
+
+/**
+ * MarkOffline sets an online device offline, unless it sent a message since lastSeen.
+ * It returns false if the device was not set offline.
+ */
+func (m *DeviceModel) MarkOffline(id string, lastSeen time.Time) (bool, error) {
+	result := m.DB.Model(&Device{}).Where("id = ? AND online AND last_seen_at <= ?", id, lastSeen).Update("online", false)
+	if result.Error != nil {
+		return false, fmt.Errorf("error setting device %s offline: %w", id, result.Error)
+	}
+	return result.RowsAffected > 0, nil
+}
+
+func ValidateDevice(v *validator.Validator, device *Device) {
+	v.StringCheck(device.ID, 1, 100, true, "id")
+	v.Check(!strings.ContainsAny(device.ID, "/+#"), "id", "must not contain '/', '+' or '#'")
+	v.StringCheck(device.Type, 1, 50, true, "type")
+	v.Check(!strings.ContainsAny(device.Type, "/+#"), "type", "must not contain '/', '+' or '#'")
+	v.StringCheck(device.Name, 0, 100, false, "name")
+}
+
+func (m *DeviceModel) Exists(id string) (bool, error) {
+	var count int64
+	err := m.DB.Unscoped().Model(&Device{}).Where("id = ?", id).Count(&count).Error
+	if err != nil {
+		return false, fmt.Errorf("error checking device %s: %w", id, err)
+	}
+	return count > 0, nil
+}
+
+func (m *DeviceModel) Insert(device *Device) error {
+	result := m.DB.Omit("Location").Create(device)
+	if result.Error != nil {
+		return fmt.Errorf("could not create device %v: %w", device.ID, result.Error)
+	}
+	if result.RowsAffected == 0 {
+		return fmt.Errorf("could not create device %v: %d rows affected", device.ID, result.RowsAffected)
+	}
+	m.Cache.Invalidate(device.ID)
+	return nil
+}
+
+func (m *DeviceModel) UpdateName(device *Device) error {
+	err := m.DB.Model(&Device{}).Where("id = ?", device.ID).Update("name", device.Name).Error
+	if err != nil {
+		return fmt.Errorf("error updating device name: %w", err)
+	}
+	m.Cache.Invalidate(device.ID)
+	return nil
+}
+
+/**
+ * Delete permanently removes a device with its modules and data.
+ * The rows are hard-deleted so that the device can announce itself again with the same ID.
+ */
+func (m *DeviceModel) Delete(id string) error {
+	defer m.Cache.Invalidate(id)
+
+	return m.DB.Transaction(func(tx *gorm.DB) error {
+		err := tx.Unscoped().Where("device_id = ?", id).Delete(&Data{}).Error
+		if err != nil {
+			return fmt.Errorf("error deleting data of device %s: %w", id, err)
+		}
+		err = tx.Unscoped().Where("device_id = ?", id).Delete(&Module{}).Error
+		if err != nil {
+			return fmt.Errorf("error deleting modules of device %s: %w", id, err)
+		}
+		result := tx.Unscoped().Delete(&Device{}, "id = ?", id)
+		if result.Error != nil {
+			return fmt.Errorf("error deleting device %s: %w", id, result.Error)
+		}
+		if result.RowsAffected == 0 {
+			return fmt.Errorf("device with id %s: %w", id, ErrRecordNotFound)
+		}
+		return nil
+	})
+}
+
 /**
  * UpdateLocation updates the location of a device in the database.
  * It first checks if the location exists, and if not, it creates a new location.
  * Then it updates the device's location ID in the database.
  * Finally, it resets the device.
  */
-func (m *DeviceModel) UpdateLocation(device *Device) error {
+func (m *DeviceModel) UpdateLocation(ctx context.Context, device *Device) error {
 
 	result := m.DB.FirstOrCreate(&device.Location, &Location{Name: device.Location.Name, Type: device.Location.Type})
 	if result.Error != nil {
@@ -100,8 +230,9 @@ func (m *DeviceModel) UpdateLocation(device *Device) error {
 	if err != nil {
 		return fmt.Errorf("error updating device locationID: %w", err)
 	}
+	m.Cache.Invalidate(device.ID)
 
-	err = m.Reset(device)
+	err = m.Reset(ctx, device)
 	if err != nil {
 		return err
 	}
@@ -109,7 +240,8 @@ func (m *DeviceModel) UpdateLocation(device *Device) error {
 	return nil
 }
 
-func (m *DeviceModel) Reset(device *Device) error {
+// Reset asks a device to restart its startup sequence. The errors of the publish are returned, see Broker.Pub.
+func (m *DeviceModel) Reset(ctx context.Context, device *Device) error {
 	resetModule, err := NewResetModule()
 	if err != nil {
 		return err
@@ -120,9 +252,7 @@ func (m *DeviceModel) Reset(device *Device) error {
 		return fmt.Errorf("error getting value for reset module %s: %w", resetModule.GetName(), err)
 	}
 
-	m.Broker.Pub(channel, strconv.FormatBool(resetValue))
-
-	return nil
+	return m.Broker.Pub(ctx, channel, strconv.FormatBool(resetValue))
 }
 
 func (m *DeviceModel) CheckOrCreate(device *Device) error {
@@ -151,6 +281,7 @@ func (m *DeviceModel) CheckOrCreate(device *Device) error {
 			if result.RowsAffected == 0 {
 				return fmt.Errorf("could not create device %v: %d rows affected", device.ID, result.RowsAffected)
 			}
+			m.Cache.Invalidate(device.ID)
 		default:
 			return fmt.Errorf("error fetching device: %w", err)
 		}
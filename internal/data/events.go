@@ -0,0 +1,112 @@
+package data
+
+import (
+	"sync"
+	"time"
+)
+
+// Types of the events published on the EventBus
+const (
+	EVENT_READING = "reading"
+	EVENT_DEVICE  = "device"
+	EVENT_STATUS  = "status"
+	EVENT_COMMAND = "command"
+)
+
+type Event struct {
+	Type       string    `json:"type"`
+	DeviceID   string    `json:"device_id"`
+	LocationID uint      `json:"location_id"`
+	ModuleID   uint      `json:"module_id,omitempty"`
+	Module     string    `json:"module,omitempty"`
+	Value      any       `json:"value,omitempty"`
+	Time       time.Time `json:"time"`
+}
+
+// EventBus broadcasts the events of the MQTT handlers to every subscriber.
+// Publishing never blocks: events are dropped for subscribers that do not keep up.
+type EventBus struct {
+	mu          sync.RWMutex
+	subscribers map[*Subscription]struct{}
+	closed      bool
+}
+
+type Subscription struct {
+	C      chan Event
+	filter func(Event) bool
+	bus    *EventBus
+}
+
+func NewEventBus() *EventBus {
+	return &EventBus{
+		subscribers: make(map[*Subscription]struct{}),
+	}
+}
+
+/**
+ * Subscribe registers a new subscriber receiving the events accepted by filter (or every event if filter is nil).
+ * The channel is closed when the subscription or the bus is closed.
+ */
+func (b *EventBus) Subscribe(buffer int, filter func(Event) bool) *Subscription {
+	sub := &Subscription{
+		C:      make(chan Event, buffer),
+		filter: filter,
+		bus:    b,
+	}
+
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	if b.closed {
+		close(sub.C)
+		return sub
+	}
+	b.subscribers[sub] = struct{}{}
+
+	return sub
+}
+
+func (b *EventBus) Publish(event Event) {
+	if event.Time.IsZero() {
+		event.Time = time.Now()
+	}
+
+	b.mu.RLock()
+	defer b.mu.RUnlock()
+
+	for sub := range b.subscribers {
+		if sub.filter != nil && !sub.filter(event) {
+			continue
+		}
+		select {
+		case sub.C <- event:
+		default:
+		}
+	}
+}
+
+// Close closes every subscription, and makes later subscriptions closed from the start.
+func (b *EventBus) Close() {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	if b.closed {
+		return
+	}
+	b.closed = true
+
+	for sub := range b.subscribers {
+		delete(b.subscribers, sub)
+		close(sub.C)
+	}
+}
+
+func (s *Subscription) Close() {
+	s.bus.mu.Lock()
+	defer s.bus.mu.Unlock()
+
+	if _, ok := s.bus.subscribers[s]; ok {
+		delete(s.bus.subscribers, s)
+		close(s.C)
+	}
+}
@@ -0,0 +1,229 @@
+package data
+
+import (
+	"fmt"
+	"time"
+
+	"HomeIoT/internal/validator"
+)
+
+// MaxHistoryPoints is the maximum number of readings or buckets returned by a history query.
+const MaxHistoryPoints = 10_000
+
+type HistoryQuery struct {
+	DeviceID   string
+	ModuleName string
+	From       time.Time
+	To         time.Time
+	Bucket     time.Duration
+}
+
+type NumericPoint struct {
+	Time  time.Time `json:"time"`
+	Value float64   `json:"value"`
+}
+
+type NumericBucket struct {
+	Start time.Time `json:"start"`
+	Count int       `json:"count"`
+	Min   float64   `json:"min"`
+	Max   float64   `json:"max"`
+	Avg   float64   `json:"avg"`
+	Last  float64   `json:"last"`
+}
+
+type StateChange struct {
+	Time  time.Time `json:"time"`
+	Value bool      `json:"value"`
+}
+
+type History struct {
+	DeviceID  string          `json:"device_id"`
+	Module    string          `json:"module"`
+	Kind      string          `json:"kind"`
+	From      time.Time       `json:"from"`
+	To        time.Time       `json:"to"`
+	Bucket    string          `json:"bucket,omitempty"`
+	Points    []NumericPoint  `json:"points,omitempty"`
+	Buckets   []NumericBucket `json:"buckets,omitempty"`
+	Initial   *bool           `json:"initial,omitempty"`
+	Changes   []StateChange   `json:"changes,omitempty"`
+	Skipped   int             `json:"skipped"`
+	Truncated bool            `json:"truncated"`
+}
+
+type reading struct {
+	CreatedAt   time.Time
+	ModuleValue string
+}
+
+func ValidateHistoryQuery(v *validator.Validator, q *HistoryQuery) {
+	_, err := ModuleKind(q.ModuleName)
+	v.Check(err == nil, "module", "must be a known module")
+	v.Check(q.From.Before(q.To), "from", "must be before to")
+	v.Check(q.Bucket >= 0, "bucket", "must be a positive duration")
+	if q.Bucket > 0 && q.From.Before(q.To) {
+		v.Check(q.Bucket >= time.Second, "bucket", "must be at least 1s")
+		v.Check(int64(q.To.Sub(q.From)/q.Bucket) <= MaxHistoryPoints, "bucket", fmt.Sprintf("must not produce more than %d buckets", MaxHistoryPoints))
+	}
+}
+
+/**
+ * History returns the readings of a device module over a time range.
+ * Numeric modules return the raw points, or fixed buckets with min/max/avg/last when a bucket size is given.
+ * Boolean modules return the state at the start of the range and every state change within it.
+ */
+func (m *DataModel) History(q HistoryQuery) (*History, error) {
+	kind, err := ModuleKind(q.ModuleName)
+	if err != nil {
+		return nil, err
+	}
+
+	history := &History{
+		DeviceID: q.DeviceID,
+		Module:   q.ModuleName,
+		Kind:     kind,
+		From:     q.From,
+		To:       q.To,
+	}
+
+	limit := MaxHistoryPoints
+	if q.Bucket > 0 || kind == KIND_BOOLEAN {
+		// aggregated queries need every reading of the range
+		limit = -1
+	}
+
+	var readings []reading
+	err = m.DB.Model(&Data{}).
+		Select("created_at, module_value").
+		Where("device_id = ? AND module_name = ? AND created_at >= ? AND created_at < ?", q.DeviceID, q.ModuleName, q.From, q.To).
+		Order("created_at").
+		Limit(limit).
+		Scan(&readings).Error
+	if err != nil {
+		return nil, fmt.Errorf("error fetching history of module %s of device %s: %w", q.ModuleName, q.DeviceID, err)
+	}
+	history.Truncated = limit > 0 && len(readings) == limit
+
+	switch kind {
+	case KIND_NUMERIC:
+		if q.Bucket > 0 {
+			history.Bucket = q.Bucket.String()
+			history.Buckets, history.Skipped = bucketize(readings, q.From, q.Bucket)
+		} else {
+			history.Points, history.Skipped = numericPoints(readings)
+		}
+
+	case KIND_BOOLEAN:
+		initial, err := m.stateBefore(q.DeviceID, q.ModuleName, q.From)
+		if err != nil {
+			return nil, err
+		}
+		history.Initial = initial
+		history.Changes, history.Skipped = stateChanges(readings, initial)
+	}
+
+	return history, nil
+}
+
+// stateBefore returns the last boolean state reported before the given time, or nil if there is none.
+func (m *DataModel) stateBefore(deviceID, moduleName string, t time.Time) (*bool, error) {
+	var readings []reading
+	err := m.DB.Model(&Data{}).
+		Select("created_at, module_value").
+		Where("device_id = ? AND module_name = ? AND created_at < ?", deviceID, moduleName, t).
+		Order("created_at DESC").
+		Limit(1).
+		Scan(&readings).Error
+	if err != nil {
+		return nil, fmt.Errorf("error fetching state of module %s of device %s: %w", moduleName, deviceID, err)
+	}
+	if len(readings) == 0 {
+		return nil, nil
+	}
+
+	value, err := ToBool(readings[0].ModuleValue)
+	if err != nil {
+		return nil, nil
+	}
+	return &value, nil
+}
+
+func numericPoints(readings []reading) ([]NumericPoint, int) {
+	points := make([]NumericPoint, 0, len(readings))
+	skipped := 0
+
+	for _, r := range readings {
+		value, err := ToFloat(r.ModuleValue)
+		if err != nil {
+			skipped++
+			continue
+		}
+		points = append(points, NumericPoint{Time: r.CreatedAt, Value: value})
+	}
+
+	return points, skipped
+}
+
+// bucketize groups the readings in fixed buckets starting at from. Empty buckets are omitted.
+func bucketize(readings []reading, from time.Time, size time.Duration) ([]NumericBucket, int) {
+	var buckets []NumericBucket
+	var sum float64
+	skipped := 0
+
+	for _, r := range readings {
+		value, err := ToFloat(r.ModuleValue)
+		if err != nil {
+			skipped++
+			continue
+		}
+
+		start := from.Add(r.CreatedAt.Sub(from) / size * size)
+
+		// closing the current bucket and opening a new one
+		if len(buckets) == 0 || !buckets[len(buckets)-1].Start.Equal(start) {
+			if len(buckets) > 0 {
+				last := &buckets[len(buckets)-1]
+				last.Avg = sum / float64(last.Count)
+			}
+			buckets = append(buckets, NumericBucket{Start: start, Min: value, Max: value})
+			sum = 0
+		}
+
+		bucket := &buckets[len(buckets)-1]
+		bucket.Count++
+		bucket.Min = min(bucket.Min, value)
+		bucket.Max = max(bucket.Max, value)
+		bucket.Last = value
+		sum += value
+	}
+
+	if len(buckets) > 0 {
+		last := &buckets[len(buckets)-1]
+		last.Avg = sum / float64(last.Count)
+	}
+
+	return buckets, skipped
+}
+
+// stateChanges keeps only the readings whose state differs from the previous one.
+func stateChanges(readings []reading, initial *bool) ([]StateChange, int) {
+	var changes []StateChange
+	skipped := 0
+	current := initial
+
+	for _, r := range readings {
+		value, err := ToBool(r.ModuleValue)
+		if err != nil {
+			skipped++
+			continue
+		}
+		if current != nil && *current == value {
+			continue
+		}
+		changes = append(changes, StateChange{Time: r.CreatedAt, Value: value})
+		current = &value
+	}
+
+	return changes, skipped
+}
@@ -0,0 +1,276 @@
+package data
+
+import (
+	"errors"
+	"fmt"
+	"hash/fnv"
+	"log/slog"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	mqtt "github.com/eclipse/paho.mqtt.golang"
+	"gorm.io/gorm"
+	"gorm.io/gorm/clause"
+)
+
+// Default settings of the ingestion of the readings
+const (
+	DefaultIngestWorkers       = 4
+	DefaultIngestQueueSize     = 1000
+	DefaultIngestBatchSize     = 100
+	DefaultIngestFlushInterval = time.Second
+)
+
+type IngestConfig struct {
+	Workers       int
+	QueueSize     int
+	BatchSize     int
+	FlushInterval time.Duration
+}
+
+// IngestStats describes the activity of the ingestion of the readings.
+type IngestStats struct {
+	Workers  int    `json:"workers"`
+	Received uint64 `json:"received"`
+	Stored   uint64 `json:"stored"`
+	Dropped  uint64 `json:"dropped"`
+	Failed   uint64 `json:"failed"`
+	Backlog  int    `json:"backlog"`
+	Pending  int64  `json:"pending"`
+}
+
+/**
+ * Ingester stores the readings received from the broker out of the MQTT handler.
+ * The messages are queued to a pool of workers, those of a device always going to the same worker so that they stay in order.
+ * Each worker inserts its readings and updates the values of their modules in batches, when BatchSize of them are waiting or every FlushInterval.
+ * The messages received while the queue of their worker is full are dropped.
+ */
+type Ingester struct {
+	Data   *DataModel
+	Config IngestConfig
+
+	queues []chan mqtt.Message
+	stop   chan struct{}
+	once   sync.Once
+
+	received atomic.Uint64
+	stored   atomic.Uint64
+	dropped  atomic.Uint64
+	failed   atomic.Uint64
+	pending  atomic.Int64
+}
+
+func NewIngester(data *DataModel, cfg IngestConfig) *Ingester {
+	cfg.Workers = max(cfg.Workers, 1)
+	cfg.BatchSize = max(cfg.BatchSize, 1)
+	if cfg.FlushInterval <= 0 {
+		cfg.FlushInterval = DefaultIngestFlushInterval
+	}
+
+	ingester := &Ingester{
+		Data:   data,
+		Config: cfg,
+		queues: make([]chan mqtt.Message, cfg.Workers),
+		stop:   make(chan struct{}),
+	}
+
+	// the queue is shared out between the workers
+	for i := range ingester.queues {
+		ingester.queues[i] = make(chan mqtt.Message, max(cfg.QueueSize/cfg.Workers, 1))
+	}
+
+	return ingester
+}
+
+// Enqueue hands a message over to the worker of its device, without blocking the MQTT handler.
+func (in *Ingester) Enqueue(msg mqtt.Message) {
+	in.received.Add(1)
+
+	select {
+	case in.queues[in.worker(msg.Topic())] <- msg:
+	default:
+		in.dropped.Add(1)
+		in.Data.Logger.Warn("ingestion queue full, message dropped", slog.String("TOPIC", msg.Topic()))
+	}
+}
+
+// worker returns the index of the worker of a topic, from the device ID.
+func (in *Ingester) worker(topic string) int {
+	key := topic
+	if channelElems := strings.Split(topic, "/"); len(channelElems) == 6 {
+		key = channelElems[4]
+	}
+
+	h := fnv.New32a()
+	h.Write([]byte(key))
+	return int(h.Sum32() % uint32(len(in.queues)))
+}
+
+// Stats returns the counters of the ingestion, the backlog being the number of messages waiting in the queues.
+func (in *Ingester) Stats() IngestStats {
+	backlog := 0
+	for _, queue := range in.queues {
+		backlog += len(queue)
+	}
+
+	return IngestStats{
+		Workers:  len(in.queues),
+		Received: in.received.Load(),
+		Stored:   in.stored.Load(),
+		Dropped:  in.dropped.Load(),
+		Failed:   in.failed.Load(),
+		Backlog:  backlog,
+		Pending:  in.pending.Load(),
+	}
+}
+
+// Run runs the workers until Stop is called, then returns once they have stored the messages already queued.
+func (in *Ingester) Run() {
+	var wg sync.WaitGroup
+
+	in.Data.Logger.Info("ingestion started", slog.Int("workers", len(in.queues)), slog.Int("batch_size", in.Config.BatchSize))
+
+	for _, queue := range in.queues {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			in.work(queue)
+		}()
+	}
+
+	wg.Wait()
+	in.Data.Logger.Info("ingestion stopped", slog.Uint64("stored", in.stored.Load()), slog.Uint64("dropped", in.dropped.Load()))
+}
+
+// Stop stops the workers. The messages received afterwards are not stored.
+func (in *Ingester) Stop() {
+	in.once.Do(func() {
+		close(in.stop)
+	})
+}
+
+// work processes the messages of a queue in order, the readings being inserted by batches.
+func (in *Ingester) work(queue chan mqtt.Message) {
+	ticker := time.NewTicker(in.Config.FlushInterval)
+	defer ticker.Stop()
+
+	var batch []*Data
+
+	for {
+		select {
+		case msg := <-queue:
+			batch = in.process(batch, msg)
+
+		case <-ticker.C:
+			batch = in.flush(batch)
+
+		case <-in.stop:
+			// storing what was already received
+			for {
+				select {
+				case msg := <-queue:
+					batch = in.process(batch, msg)
+				default:
+					in.flush(batch)
+					return
+				}
+			}
+		}
+	}
+}
+
+// process adds the reading of a message to the batch, flushing it when full.
+func (in *Ingester) process(batch []*Data, msg mqtt.Message) []*Data {
+	m := in.Data
+
+	// the batches of the devices are already inserted together, after the readings received before them
+	if strings.HasSuffix(msg.Topic(), "/"+BATCH_MODULE) {
+		batch = in.flush(batch)
+		in.stored.Add(uint64(m.ingestBatch(msg)))
+		return batch
+	}
+
+	// DEBUG
+	m.Logger.Debug("received MQTT message", slog.String("HANDLER", "ingester"), slog.String("TOPIC", msg.Topic()), slog.String("PAYLOAD", string(msg.Payload())))
+
+	data, err := m.NewData(msg)
+	if err != nil {
+		switch {
+		case errors.Is(err, ErrDuplicateReading):
+			m.Logger.Debug("duplicate reading dropped", slog.String("error", err.Error()))
+		default:
+			in.failed.Add(1)
+			m.Logger.Error(fmt.Errorf("error creating data from MQTT message: %w", err).Error())
+			m.Logger.Warn("aborting data creation")
+		}
+		return batch
+	}
+
+	batch = append(batch, data)
+	in.pending.Add(1)
+	if len(batch) >= in.Config.BatchSize {
+		batch = in.flush(batch)
+	}
+	return batch
+}
+
+/**
+ * flush inserts the readings of the batch and updates the values of their modules in a single transaction,
+ * so that the values never get ahead of the history, then publishes them. It returns the emptied batch.
+ */
+func (in *Ingester) flush(batch []*Data) []*Data {
+	if len(batch) == 0 {
+		return batch
+	}
+	m := in.Data
+	defer in.pending.Add(-int64(len(batch)))
+
+	// only the latest reading of each module updates its value
+	latest := latestReadings(batch)
+
+	err := m.DB.Transaction(func(tx *gorm.DB) error {
+		// the devices are known, they are not saved again with each reading
+		err := tx.Omit(clause.Associations).Create(&batch).Error
+		if err != nil {
+			return err
+		}
+
+		for _, data := range latest {
+			err = m.updateModule(tx, data.DeviceID, data.ModuleID, data.ModuleValue, data.CreatedAt)
+			if err != nil {
+				return fmt.Errorf("error updating module %s of device %s: %w", data.ModuleName, data.DeviceID, err)
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		in.failed.Add(uint64(len(batch)))
+		m.Logger.Error(fmt.Errorf("error storing data: %w", err).Error(), slog.Int("readings", len(batch)))
+		return batch[:0]
+	}
+	in.stored.Add(uint64(len(batch)))
+
+	seen := make(map[string]bool)
+	for _, data := range batch {
+		if !seen[data.DeviceID] {
+			seen[data.DeviceID] = true
+			m.markSeen(&data.Device)
+		}
+		m.publishReading(data)
+	}
+
+	return batch[:0]
+}
+
+// latestReadings returns the latest reading of each module of a batch, the last received one for the readings of the same time.
+func latestReadings(batch []*Data) map[uint]*Data {
+	latest := make(map[uint]*Data)
+	for _, data := range batch {
+		if current, ok := latest[data.ModuleID]; !ok || !data.CreatedAt.Before(current.CreatedAt) {
+			latest[data.ModuleID] = data
+		}
+	}
+	return latest
+}
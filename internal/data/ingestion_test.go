@@ -0,0 +1,149 @@
+package data
+
+import (
+	"fmt"
+	"io"
+	"log/slog"
+	"testing"
+	"time"
+
+	"gorm.io/gorm"
+)
+
+// testMessage is an MQTT message received on a topic.
+type testMessage struct {
+	topic   string
+	payload string
+}
+
+func (m *testMessage) Duplicate() bool   { return false }
+func (m *testMessage) Qos() byte         { return 0 }
+func (m *testMessage) Retained() bool    { return false }
+func (m *testMessage) Topic() string     { return m.topic }
+func (m *testMessage) MessageID() uint16 { return 0 }
+func (m *testMessage) Payload() []byte   { return []byte(m.payload) }
+func (m *testMessage) Ack()              {}
+
+func newTestIngester(cfg IngestConfig) *Ingester {
+	return NewIngester(&DataModel{Logger: slog.New(slog.NewTextHandler(io.Discard, nil))}, cfg)
+}
+
+func TestNewIngester(t *testing.T) {
+	tests := []struct {
+		name          string
+		cfg           IngestConfig
+		wantWorkers   int
+		wantQueueCap  int
+		wantBatchSize int
+		wantInterval  time.Duration
+	}{
+		{"configured", IngestConfig{Workers: 4, QueueSize: 1000, BatchSize: 100, FlushInterval: 2 * time.Second}, 4, 250, 100, 2 * time.Second},
+		{"zero values", IngestConfig{}, 1, 1, 1, DefaultIngestFlushInterval},
+		{"queue smaller than the workers", IngestConfig{Workers: 4, QueueSize: 2, BatchSize: 10}, 4, 1, 10, DefaultIngestFlushInterval},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			in := newTestIngester(tt.cfg)
+			if len(in.queues) != tt.wantWorkers || cap(in.queues[0]) != tt.wantQueueCap {
+				t.Errorf("NewIngester() = %d workers with queues of %d, want %d workers with queues of %d", len(in.queues), cap(in.queues[0]), tt.wantWorkers, tt.wantQueueCap)
+			}
+			if in.Config.BatchSize != tt.wantBatchSize || in.Config.FlushInterval != tt.wantInterval {
+				t.Errorf("NewIngester() config = %+v, want batch size %d and flush interval %s", in.Config, tt.wantBatchSize, tt.wantInterval)
+			}
+		})
+	}
+}
+
+func TestIngesterWorker(t *testing.T) {
+	in := newTestIngester(IngestConfig{Workers: 8})
+
+	tests := []struct {
+		name  string
+		topic string
+		same  string
+	}{
+		{"same device, other module", "home/room/1/esp/abc/temperatureSensor", "home/room/1/esp/abc/presenceDetector"},
+		{"same device, other location", "home/room/1/esp/abc/temperatureSensor", "home/garden/2/esp/abc/batch"},
+		{"invalid topic", "home/abc", "home/abc"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			worker := in.worker(tt.topic)
+			if worker < 0 || worker >= len(in.queues) {
+				t.Fatalf("worker(%s) = %d, want a worker in [0, %d)", tt.topic, worker, len(in.queues))
+			}
+			if other := in.worker(tt.same); other != worker {
+				t.Errorf("worker(%s) = %d, want the worker of %s %d", tt.same, other, tt.topic, worker)
+			}
+		})
+	}
+
+	// the devices are shared out between the workers
+	used := make(map[int]bool)
+	for i := range 100 {
+		used[in.worker(fmt.Sprintf("home/room/1/esp/device%d/temperatureSensor", i))] = true
+	}
+	if len(used) != len(in.queues) {
+		t.Errorf("100 devices handled by %d workers, want %d", len(used), len(in.queues))
+	}
+}
+
+func TestIngesterEnqueue(t *testing.T) {
+	tests := []struct {
+		name        string
+		queueSize   int
+		messages    int
+		wantBacklog int
+		wantDropped uint64
+	}{
+		{"queued", 3, 2, 2, 0},
+		{"queue full", 3, 5, 3, 2},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			in := newTestIngester(IngestConfig{Workers: 1, QueueSize: tt.queueSize})
+			for range tt.messages {
+				in.Enqueue(&testMessage{topic: "home/room/1/esp/abc/temperatureSensor", payload: "21.4"})
+			}
+
+			stats := in.Stats()
+			if stats.Received != uint64(tt.messages) || stats.Backlog != tt.wantBacklog || stats.Dropped != tt.wantDropped {
+				t.Errorf("Stats() = %+v, want %d received, %d backlog and %d dropped", stats, tt.messages, tt.wantBacklog, tt.wantDropped)
+			}
+		})
+	}
+}
+
+func TestLatestReadings(t *testing.T) {
+	at := func(minutes int) gorm.Model {
+		return gorm.Model{CreatedAt: time.Date(2025, time.April, 4, 10, minutes, 0, 0, time.UTC)}
+	}
+
+	tests := []struct {
+		name  string
+		batch []*Data
+		want  map[uint]string
+	}{
+		{"empty", nil, map[uint]string{}},
+		{"one per module", []*Data{{Model: at(0), ModuleID: 1, ModuleValue: "a"}, {Model: at(0), ModuleID: 2, ModuleValue: "b"}}, map[uint]string{1: "a", 2: "b"}},
+		{"in order", []*Data{{Model: at(0), ModuleID: 1, ModuleValue: "a"}, {Model: at(1), ModuleID: 1, ModuleValue: "b"}}, map[uint]string{1: "b"}},
+		{"buffered reading received late", []*Data{{Model: at(1), ModuleID: 1, ModuleValue: "a"}, {Model: at(0), ModuleID: 1, ModuleValue: "b"}}, map[uint]string{1: "a"}},
+		{"same time", []*Data{{Model: at(0), ModuleID: 1, ModuleValue: "a"}, {Model: at(0), ModuleID: 1, ModuleValue: "b"}}, map[uint]string{1: "b"}},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			latest := latestReadings(tt.batch)
+			got := make(map[uint]string, len(latest))
+			for moduleID, data := range latest {
+				got[moduleID] = data.ModuleValue
+			}
+			if fmt.Sprint(got) != fmt.Sprint(tt.want) {
+				t.Errorf("latestReadings() = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
@@ -1,14 +1,29 @@
 package data
 
 import (
-	"fmt"
-	"strconv"
-	
 	"gorm.io/gorm"
 )
 
 const LIGHT_CONTROLLER = "lightController"
 
+func init() {
+	RegisterModuleType(ModuleType{
+		Name:     LIGHT_CONTROLLER,
+		Kind:     KIND_BOOLEAN,
+		Writable: true,
+		Parse:    parseBool,
+		Encode:   encodeBool,
+		New: func(module *Module, value any) IModule {
+			return LightController{
+				Model:    module.Model,
+				DeviceID: module.DeviceID,
+				Name:     module.Name,
+				On:       value.(bool),
+			}
+		},
+	})
+}
+
 type LightController struct {
 	gorm.Model
 	DeviceID string `gorm:"index"`
@@ -23,21 +38,3 @@ func (l LightController) GetValue() any {
 func (l LightController) GetName() string {
 	return l.Name
 }
-
-func (l LightController) getChannel() (string, error) {
-	return fmt.Sprintf("home/%s/%d/%s/%s/%s"), nil
-}
-
-type LightControllerModel struct {
-	DB     *gorm.DB
-	Broker *Broker
-}
-
-func (m *LightControllerModel) Set(channel string, value any) error {
-	boolValue, err := ToBool(value)
-	if err != nil {
-		return err
-	}
-	m.Broker.Pub(channel, strconv.FormatBool(boolValue))
-	return nil
-}
@@ -1,13 +1,29 @@
 package data
 
 import (
-	"strconv"
-	
 	"gorm.io/gorm"
 )
 
 const LIGHT_SENSOR = "lightSensor"
 
+func init() {
+	RegisterModuleType(ModuleType{
+		Name:     LIGHT_SENSOR,
+		Kind:     KIND_BOOLEAN,
+		Writable: false,
+		Parse:    parseBool,
+		Encode:   encodeBool,
+		New: func(module *Module, value any) IModule {
+			return LightSensor{
+				Model:    module.Model,
+				DeviceID: module.DeviceID,
+				Name:     module.Name,
+				IsOn:     value.(bool),
+			}
+		},
+	})
+}
+
 type LightSensor struct {
 	gorm.Model
 	DeviceID string `gorm:"index"`
@@ -22,17 +38,3 @@ func (l LightSensor) GetValue() any {
 func (l LightSensor) GetName() string {
 	return l.Name
 }
-
-type LightSensorModel struct {
-	DB     *gorm.DB
-	Broker *Broker
-}
-
-func (m *LightSensorModel) Set(channel string, value any) error {
-	boolValue, err := ToBool(value)
-	if err != nil {
-		return err
-	}
-	m.Broker.Pub(channel, strconv.FormatBool(boolValue))
-	return nil
-}
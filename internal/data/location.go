@@ -1,8 +1,12 @@
 package data
 
 import (
+	"errors"
 	"fmt"
-	
+	"strings"
+
+	"HomeIoT/internal/validator"
+
 	"gorm.io/gorm"
 )
 
@@ -13,7 +17,60 @@ type Location struct {
 }
 
 type LocationModel struct {
-	DB *gorm.DB
+	DB    *gorm.DB
+	Cache *DeviceCache
+}
+
+// ErrLocationNotEmpty is returned when trying to delete a location that still contains devices.
+var ErrLocationNotEmpty = errors.New("location is not empty")
+
+func ValidateLocation(v *validator.Validator, location *Location) {
+	v.StringCheck(location.Name, 1, 100, true, "name")
+	v.StringCheck(location.Type, 1, 50, true, "type")
+	v.Check(!strings.ContainsAny(location.Type, "/+#"), "type", "must not contain '/', '+' or '#'")
+}
+
+func (m *LocationModel) GetAll() ([]*Location, error) {
+	var locations []*Location
+	err := m.DB.Order("id").Find(&locations).Error
+	if err != nil {
+		return nil, fmt.Errorf("failed to get locations: %w", err)
+	}
+	return locations, nil
+}
+
+func (m *LocationModel) GetByID(id uint) (*Location, error) {
+	var location Location
+	err := m.DB.First(&location, id).Error
+	if err != nil {
+		switch {
+		case errors.Is(err, gorm.ErrRecordNotFound):
+			return nil, fmt.Errorf("location with id %d: %w", id, ErrRecordNotFound)
+		default:
+			return nil, fmt.Errorf("failed to get location with id %d: %w", id, err)
+		}
+	}
+	return &location, nil
+}
+
+func (m *LocationModel) NameExists(name string, exceptID uint) (bool, error) {
+	var count int64
+	err := m.DB.Model(&Location{}).Where("name = ? AND id <> ?", name, exceptID).Count(&count).Error
+	if err != nil {
+		return false, fmt.Errorf("error checking location name %s: %w", name, err)
+	}
+	return count > 0, nil
+}
+
+func (m *LocationModel) Insert(location *Location) error {
+	result := m.DB.Create(location)
+	if result.Error != nil {
+		return fmt.Errorf("could not create location: %w", result.Error)
+	}
+	if result.RowsAffected == 0 {
+		return fmt.Errorf("could not create location: %d rows affected", result.RowsAffected)
+	}
+	return nil
 }
 
 func (m *LocationModel) Delete(id uint) error {
@@ -23,7 +80,7 @@ func (m *LocationModel) Delete(id uint) error {
 		return fmt.Errorf("error counting devices in location with id %d: %w", id, err)
 	}
 	if usages > 0 {
-		return fmt.Errorf("location with id %d is not empty", id)
+		return fmt.Errorf("location with id %d: %w", id, ErrLocationNotEmpty)
 	}
 	
 	err = m.DB.Delete(&Location{}, id).Error
@@ -39,6 +96,8 @@ func (m *LocationModel) UpdateName(location *Location) error {
 	if err != nil {
 		return fmt.Errorf("error updating location: %w", err)
 	}
+	// the devices are cached with their location
+	m.Cache.InvalidateAll()
 	
 	return nil
 }
@@ -48,6 +107,8 @@ func (m *LocationModel) UpdateType(location *Location) error {
 	if err != nil {
 		return fmt.Errorf("error updating location: %w", err)
 	}
+	// the devices are cached with their location
+	m.Cache.InvalidateAll()
 	
 	return nil
 }
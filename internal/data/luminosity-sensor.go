@@ -1,13 +1,30 @@
 package data
 
 import (
-	"strconv"
-	
 	"gorm.io/gorm"
 )
 
 const LUMINOSITY_SENSOR = "luminositySensor"
 
+func init() {
+	RegisterModuleType(ModuleType{
+		Name:     LUMINOSITY_SENSOR,
+		Kind:     KIND_NUMERIC,
+		Unit:     "lm",
+		Writable: false,
+		Parse:    parseFloat,
+		Encode:   encodeFloat,
+		New: func(module *Module, value any) IModule {
+			return LuminositySensor{
+				Model:      module.Model,
+				DeviceID:   module.DeviceID,
+				Name:       module.Name,
+				ValueLumen: value.(float64),
+			}
+		},
+	})
+}
+
 type LuminositySensor struct {
 	gorm.Model
 	DeviceID   string `gorm:"index"`
@@ -22,17 +39,3 @@ func (l LuminositySensor) GetValue() any {
 func (l LuminositySensor) GetName() string {
 	return l.Name
 }
-
-type LuminositySensorModel struct {
-	DB     *gorm.DB
-	Broker *Broker
-}
-
-func (m *LuminositySensorModel) Set(channel string, value any) error {
-	floatValue, err := ToFloat(value)
-	if err != nil {
-		return err
-	}
-	m.Broker.Pub(channel, strconv.FormatFloat(floatValue, 'f', 2, 64))
-	return nil
-}
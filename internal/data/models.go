@@ -1,45 +1,80 @@
 package data
 
 import (
+	"errors"
 	"log/slog"
+	"time"
 
 	"gorm.io/gorm"
 )
 
+var (
+	// ErrRecordNotFound is returned when a requested record does not exist in the database.
+	ErrRecordNotFound = errors.New("record not found")
+
+	// ErrUnknownModule is returned when a module name is not part of ModuleNames.
+	ErrUnknownModule = errors.New("unknown module")
+
+	// ErrReadOnlyModule is returned when a value is sent to a module which does not accept commands, e.g. a sensor.
+	ErrReadOnlyModule = errors.New("read-only module")
+
+	// ErrInvalidValue is returned when a value cannot be converted to the type expected by a module.
+	ErrInvalidValue = errors.New("invalid module value")
+)
+
 type Models struct {
 	Location *LocationModel
 	Device   *DeviceModel
 	Module   *ModuleModel
 	Data     *DataModel
+	User     *UserModel
+	Policy   *PolicyModel
+	Token    *TokenModel
+	Rule     *RuleModel
+	Alert    *AlertModel
+	Schedule *ScheduleModel
+	Scene    *SceneModel
+	Command  *CommandModel
 
 	ModuleModels *ModuleModels
+
+	Events *EventBus
 }
 
 type ModuleModels struct {
-	DB                *gorm.DB
-	LightController   *LightControllerModel
-	LightSensor       *LightSensorModel
-	PresenceDetector  *PresenceDetectorModel
-	LuminositySensor  *LuminositySensorModel
-	TemperatureSensor *TemperatureSensorModel
-	ConsumptionSensor *ConsumptionSensorModel
+	DB       *gorm.DB
+	Commands *CommandModel
 }
 
-func NewModels(db *gorm.DB, broker *Broker, logger *slog.Logger) Models {
+func NewModels(db *gorm.DB, broker *Broker, logger *slog.Logger, ingest IngestConfig, setupDelay time.Duration) Models {
+	events := NewEventBus()
+	cache := NewDeviceCache(db)
+	module := &ModuleModel{DB: db, Broker: broker, Cache: cache}
+	device := &DeviceModel{DB: db, Broker: broker, Cache: cache}
+	command := NewCommandModel(db, broker, events)
+
+	moduleModels := &ModuleModels{DB: db, Commands: command}
+
+	dataModel := &DataModel{DB: db, Broker: broker, Logger: logger, Events: events, Devices: device, Commands: command}
+	dataModel.Ingester = NewIngester(dataModel, ingest)
+	dataModel.Startups = NewStartupWorker(dataModel, setupDelay)
+
 	return Models{
-		Location: &LocationModel{DB: db},
-		Device:   &DeviceModel{DB: db, Broker: broker},
-		Module:   &ModuleModel{DB: db, Broker: broker},
-		Data:     &DataModel{DB: db, Broker: broker, Logger: logger},
-
-		ModuleModels: &ModuleModels{
-			DB:                db,
-			LightController:   &LightControllerModel{DB: db, Broker: broker},
-			LightSensor:       &LightSensorModel{DB: db, Broker: broker},
-			PresenceDetector:  &PresenceDetectorModel{DB: db, Broker: broker},
-			LuminositySensor:  &LuminositySensorModel{DB: db, Broker: broker},
-			TemperatureSensor: &TemperatureSensorModel{DB: db, Broker: broker},
-			ConsumptionSensor: &ConsumptionSensorModel{DB: db, Broker: broker},
-		},
+		Location: &LocationModel{DB: db, Cache: cache},
+		Device:   device,
+		Module:   module,
+		Data:     dataModel,
+		User:     &UserModel{DB: db},
+		Policy:   &PolicyModel{DB: db},
+		Token:    &TokenModel{DB: db},
+		Rule:     &RuleModel{DB: db},
+		Alert:    &AlertModel{DB: db},
+		Schedule: &ScheduleModel{DB: db},
+		Scene:    &SceneModel{DB: db, Module: module, Modules: moduleModels},
+		Command:  command,
+
+		ModuleModels: moduleModels,
+
+		Events: events,
 	}
 }
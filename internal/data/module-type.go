@@ -0,0 +1,101 @@
+package data
+
+import (
+	"fmt"
+	"strconv"
+)
+
+// Value kinds of the modules, used to interpret the stored string values
+const (
+	KIND_BOOLEAN = "boolean"
+	KIND_NUMERIC = "numeric"
+)
+
+/**
+ * ModuleType describes a kind of module: how its values are read and sent, and whether it accepts commands.
+ * Each module type registers itself in its own file with RegisterModuleType, nothing else has to be edited to add one.
+ */
+type ModuleType struct {
+	Name string
+	Kind string
+	Unit string
+
+	// Writable is false for the sensors: their channel is reserved for the readings of the devices
+	Writable bool
+
+	// Parse converts a stored or received value to the typed value of the module
+	Parse func(value string) (any, error)
+
+	// Encode converts a commanded value to the payload sent to the device
+	Encode func(value any) (string, error)
+
+	// New builds the typed module from a module and its parsed value
+	New func(module *Module, value any) IModule
+}
+
+var moduleTypes = make(map[string]*ModuleType)
+
+// ModuleNames lists the registered module types, in registration order.
+var ModuleNames []string
+
+// RegisterModuleType adds a module type to the registry. It panics on a duplicate or incomplete type, from the init functions.
+func RegisterModuleType(moduleType ModuleType) {
+	if moduleType.Name == "" || moduleType.Parse == nil || moduleType.Encode == nil || moduleType.New == nil {
+		panic(fmt.Sprintf("incomplete module type %q", moduleType.Name))
+	}
+	if _, ok := moduleTypes[moduleType.Name]; ok {
+		panic(fmt.Sprintf("module type %s registered twice", moduleType.Name))
+	}
+	moduleTypes[moduleType.Name] = &moduleType
+	ModuleNames = append(ModuleNames, moduleType.Name)
+}
+
+// LookupModuleType returns the registered type of a module, or ErrUnknownModule.
+func LookupModuleType(name string) (*ModuleType, error) {
+	moduleType, ok := moduleTypes[name]
+	if !ok {
+		return nil, fmt.Errorf("%w: %s", ErrUnknownModule, name)
+	}
+	return moduleType, nil
+}
+
+// ModuleKind returns the kind of value a module holds.
+func ModuleKind(name string) (string, error) {
+	moduleType, err := LookupModuleType(name)
+	if err != nil {
+		return "", err
+	}
+	return moduleType.Kind, nil
+}
+
+// IsWritable reports whether a module accepts commands.
+func IsWritable(name string) bool {
+	moduleType, err := LookupModuleType(name)
+	return err == nil && moduleType.Writable
+}
+
+// Parsers and encoders shared by the module types
+
+func parseBool(value string) (any, error) {
+	return ToBool(value)
+}
+
+func parseFloat(value string) (any, error) {
+	return ToFloat(value)
+}
+
+func encodeBool(value any) (string, error) {
+	boolValue, err := ToBool(value)
+	if err != nil {
+		return "", fmt.Errorf("%w: %w", ErrInvalidValue, err)
+	}
+	return strconv.FormatBool(boolValue), nil
+}
+
+func encodeFloat(value any) (string, error) {
+	floatValue, err := ToFloat(value)
+	if err != nil {
+		return "", fmt.Errorf("%w: %w", ErrInvalidValue, err)
+	}
+	return strconv.FormatFloat(floatValue, 'f', 2, 64), nil
+}
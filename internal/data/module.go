@@ -1,25 +1,18 @@
 package data
 
 import (
+	"context"
 	"errors"
 	"fmt"
+	"math"
 	"slices"
+	"time"
+
+	"HomeIoT/internal/validator"
 
 	"gorm.io/gorm"
 )
 
-// When adding a module, be sure to add it in ModuleNames below and in *ModuleModels.Set(Module, any)
-
-var ModuleNames = []string{
-	LIGHT_CONTROLLER,
-	LIGHT_SENSOR,
-	PRESENCE_DETECTOR,
-	LUMINOSITY_SENSOR,
-	TEMPERATURE_SENSOR,
-	CONSUMPTION_SENSOR,
-	RESET,
-}
-
 /**
  * mettreAJourModulePartiel met à jour un module partiellement dans la base de données.
  * Il utilise GORM pour effectuer la mise à jour.
@@ -29,86 +22,67 @@ func (m *ModuleModels) updateModulePartial(deviceID string, moduleID uint, champ
 }
 
 /**
- * ModuleModels is a struct that contains the database connection and the models for each module type.
- * It is used to interact with the database and perform CRUD operations on modules.
+ * ModuleModels sends the commanded values to the modules of the devices.
+ * The values are checked and encoded according to the registered module types, see ModuleType.
  */
 
-func (m *ModuleModels) Set(module Module, value any) error {
-	iModule, err := module.ToIModule()
+// Set sends a value to a module of a device. The errors of the publish are returned, see Broker.Pub.
+func (m *ModuleModels) Set(ctx context.Context, module Module, value any) error {
+	_, err := m.Send(ctx, module, value)
+	return err
+}
+
+/**
+ * Send sends a value to a module of a device as a command, whose acknowledgement by the device is tracked.
+ * The sensors do not accept commands, ErrReadOnlyModule is returned for them.
+ * The value is recorded as the desired value of the module, the device reporting it back as its value.
+ * The command is returned even if the publish failed, with its status, see CommandModel.Send.
+ */
+func (m *ModuleModels) Send(ctx context.Context, module Module, value any) (*Command, error) {
+	payload, err := m.Encode(module, value)
 	if err != nil {
-		return err
+		return nil, err
 	}
 
 	device, err := m.GetDevice(module.DeviceID)
 	if err != nil {
-		return err
+		return nil, err
 	}
-	channel := device.GetChannel(iModule)
-
-	// Set value according to Module type
-	switch iModule.(type) {
-
-	case LightController:
 
-		err = m.LightController.Set(channel, value)
-		if err != nil {
-			return err
-		}
-
-	case LightSensor:
-		err = m.LightSensor.Set(channel, value)
-		if err != nil {
-			return err
-		}
-
-	case PresenceDetector:
-
-		if err != nil {
-			return err
-		}
-		err = m.PresenceDetector.Set(channel, value)
-		if err != nil {
-			return err
-		}
-
-	case LuminositySensor:
-
-		if err != nil {
-			return err
-		}
-		err = m.LuminositySensor.Set(channel, value)
-		if err != nil {
-			return err
-		}
+	// the desired value is kept even if the publish fails, to be sent again on the next startup of the device
+	now := time.Now()
+	err = m.DB.Model(&Module{}).Where("id = ?", module.ID).Updates(map[string]any{"desired": payload, "desired_at": now}).Error
+	if err != nil {
+		return nil, fmt.Errorf("error updating the desired value of module %s: %w", module.Name, err)
+	}
+	module.Desired, module.DesiredAt = &payload, &now
 
-	case TemperatureSensor:
+	return m.Commands.Send(ctx, device, &module, payload)
+}
 
-		if err != nil {
-			return err
-		}
-		err = m.TemperatureSensor.Set(channel, value)
-		if err != nil {
-			return err
-		}
+// Encode checks that a value can be sent to a module and returns its payload, without sending it, see Send.
+func (m *ModuleModels) Encode(module Module, value any) (string, error) {
+	moduleType, err := LookupModuleType(module.Name)
+	if err != nil {
+		return "", err
+	}
 
-	case ConsumptionSensor:
-		err = m.ConsumptionSensor.Set(channel, value)
-		if err != nil {
-			return err
-		}
+	// the sensors channels are reserved for the readings of the devices
+	if !moduleType.Writable {
+		return "", fmt.Errorf("%w: %s", ErrReadOnlyModule, module.Name)
 	}
 
-	return nil
+	return moduleType.Encode(value)
 }
 
 func (m *ModuleModels) GetDevice(deviceID string) (*Device, error) {
 	var device Device
 
-	err := m.DB.First(&device, "id = ?", deviceID).Error
+	err := m.DB.Joins("Location").First(&device, "devices.id = ?", deviceID).Error
 	if err != nil {
 		switch {
 		case errors.Is(err, gorm.ErrRecordNotFound):
-			return nil, fmt.Errorf("device %s not found", deviceID)
+			return nil, fmt.Errorf("device %s: %w", deviceID, ErrRecordNotFound)
 		default:
 			return nil, fmt.Errorf("failed to query device: %w", err)
 		}
@@ -120,6 +94,96 @@ func (m *ModuleModels) GetDevice(deviceID string) (*Device, error) {
 type ModuleModel struct {
 	DB     *gorm.DB
 	Broker *Broker
+	Cache  *DeviceCache
+}
+
+func ValidateModule(v *validator.Validator, module *Module) {
+	v.Check(slices.Contains(ModuleNames, module.Name), "name", "must be a known module")
+	if module.Value != "" && v.Valid() {
+		_, err := module.ToIModule()
+		v.Check(err == nil, "value", fmt.Sprintf("invalid value for module %s", module.Name))
+	}
+}
+
+func (m *ModuleModel) Get(id uint) (*Module, error) {
+	var module Module
+	err := m.DB.First(&module, id).Error
+	if err != nil {
+		switch {
+		case errors.Is(err, gorm.ErrRecordNotFound):
+			return nil, fmt.Errorf("module with id %d: %w", id, ErrRecordNotFound)
+		default:
+			return nil, fmt.Errorf("failed to get module with id %d: %w", id, err)
+		}
+	}
+	return &module, nil
+}
+
+func (m *ModuleModel) GetByDeviceID(deviceID string) ([]*Module, error) {
+	var modules []*Module
+	err := m.DB.Where("device_id = ?", deviceID).Order("id").Find(&modules).Error
+	if err != nil {
+		return nil, fmt.Errorf("failed to get modules of device %s: %w", deviceID, err)
+	}
+	return modules, nil
+}
+
+// GetByDeviceAndName returns the module of a device from its name.
+func (m *ModuleModel) GetByDeviceAndName(deviceID, name string) (*Module, error) {
+	var module Module
+	err := m.DB.Where("device_id = ? AND name = ?", deviceID, name).First(&module).Error
+	if err != nil {
+		switch {
+		case errors.Is(err, gorm.ErrRecordNotFound):
+			return nil, fmt.Errorf("module %s of device %s: %w", name, deviceID, ErrRecordNotFound)
+		default:
+			return nil, fmt.Errorf("failed to get module %s of device %s: %w", name, deviceID, err)
+		}
+	}
+	return &module, nil
+}
+
+func (m *ModuleModel) NameExists(deviceID, name string, exceptID uint) (bool, error) {
+	var count int64
+	err := m.DB.Model(&Module{}).Where("device_id = ? AND name = ? AND id <> ?", deviceID, name, exceptID).Count(&count).Error
+	if err != nil {
+		return false, fmt.Errorf("error checking module %s of device %s: %w", name, deviceID, err)
+	}
+	return count > 0, nil
+}
+
+func (m *ModuleModel) Insert(module *Module) error {
+	result := m.DB.Create(module)
+	if result.Error != nil {
+		return fmt.Errorf("could not create module %s: %w", module.Name, result.Error)
+	}
+	if result.RowsAffected == 0 {
+		return fmt.Errorf("could not create module %s: %d rows affected", module.Name, result.RowsAffected)
+	}
+	m.Cache.Invalidate(module.DeviceID)
+	return nil
+}
+
+func (m *ModuleModel) UpdateName(module *Module) error {
+	err := m.DB.Model(&Module{}).Where("id = ?", module.ID).Update("name", module.Name).Error
+	if err != nil {
+		return fmt.Errorf("error updating module name: %w", err)
+	}
+	m.Cache.Invalidate(module.DeviceID)
+	return nil
+}
+
+func (m *ModuleModel) Delete(id uint) error {
+	result := m.DB.Delete(&Module{}, id)
+	if result.Error != nil {
+		return fmt.Errorf("error deleting module with id %d: %w", id, result.Error)
+	}
+	if result.RowsAffected == 0 {
+		return fmt.Errorf("module with id %d: %w", id, ErrRecordNotFound)
+	}
+	// the device of the module is not known here
+	m.Cache.InvalidateAll()
+	return nil
 }
 
 func (m *ModuleModel) GetByID(id uint) (*IModule, error) {
@@ -134,11 +198,46 @@ func (m *ModuleModel) GetByID(id uint) (*IModule, error) {
 	return &iModule, nil
 }
 
+/**
+ * Module is a sensor or an actuator of a device.
+ * Value is the value reported by the device at ReportedAt, Desired the value last sent to it (nil if none was).
+ */
 type Module struct {
 	gorm.Model
-	DeviceID string `gorm:"index"`
-	Name     string
-	Value    string
+	DeviceID   string `gorm:"index"`
+	Name       string
+	Value      string
+	ReportedAt *time.Time
+	Desired    *string
+	DesiredAt  *time.Time
+}
+
+// InSync reports whether the device reported the value last sent to the module, or no value was sent.
+func (m *Module) InSync() bool {
+	if m.Desired == nil {
+		return true
+	}
+	return SameValue(m.Name, m.Value, *m.Desired)
+}
+
+// SameValue compares two values of a module according to its kind, e.g. "1" and "true" for a boolean module.
+func SameValue(name, a, b string) bool {
+	kind, err := ModuleKind(name)
+	if err != nil {
+		return a == b
+	}
+
+	switch kind {
+	case KIND_BOOLEAN:
+		boolA, errA := ToBool(a)
+		boolB, errB := ToBool(b)
+		return errA == nil && errB == nil && boolA == boolB
+	default:
+		floatA, errA := ToFloat(a)
+		floatB, errB := ToFloat(b)
+		// the numeric values are sent with 2 decimals
+		return errA == nil && errB == nil && math.Abs(floatA-floatB) < 0.005
+	}
 }
 
 func (m *Module) GetValue() any {
@@ -149,96 +248,17 @@ func (m *Module) GetName() string {
 	return m.Name
 }
 
+// ToIModule converts a module to its typed representation, according to its registered type.
 func (m *Module) ToIModule() (IModule, error) {
-	if !slices.Contains(ModuleNames, m.Name) {
+	moduleType, err := LookupModuleType(m.Name)
+	if err != nil {
 		return nil, fmt.Errorf("module %s not found", m.Name)
 	}
-	switch m.Name {
-	case PRESENCE_DETECTOR:
-		value, err := ToBool(m.Value)
-		if err != nil {
-			return nil, err
-		}
-		return PresenceDetector{
-			Model:      m.Model,
-			DeviceID:   m.DeviceID,
-			Name:       m.Name,
-			IsPresence: value,
-		}, nil
-
-	case TEMPERATURE_SENSOR:
-		value, err := ToFloat(m.Value)
-		if err != nil {
-			return nil, err
-		}
-		return TemperatureSensor{
-			Model:        m.Model,
-			DeviceID:     m.DeviceID,
-			Name:         m.Name,
-			ValueDegrees: value,
-		}, nil
-
-	case CONSUMPTION_SENSOR:
-		value, err := ToFloat(m.Value)
-		if err != nil {
-			return nil, err
-		}
-		return ConsumptionSensor{
-			Model:         m.Model,
-			DeviceID:      m.DeviceID,
-			Name:          m.Name,
-			ValueWattHour: value,
-		}, nil
-
-	case LIGHT_CONTROLLER:
-		value, err := ToBool(m.Value)
-		if err != nil {
-			return nil, err
-		}
-		return LightController{
-			Model:    m.Model,
-			DeviceID: m.DeviceID,
-			Name:     m.Name,
-			On:       value,
-		}, nil
-
-	case LIGHT_SENSOR:
-		value, err := ToBool(m.Value)
-		if err != nil {
-			return nil, err
-		}
-		return LightSensor{
-			Model:    m.Model,
-			DeviceID: m.DeviceID,
-			Name:     m.Name,
-			IsOn:     value,
-		}, nil
-
-	case LUMINOSITY_SENSOR:
-		value, err := ToFloat(m.Value)
-		if err != nil {
-			return nil, err
-		}
-		return LuminositySensor{
-			Model:      m.Model,
-			DeviceID:   m.DeviceID,
-			Name:       m.Name,
-			ValueLumen: value,
-		}, nil
-
-	case RESET:
-		value, err := ToBool(m.Value)
-		if err != nil {
-			return nil, err
-		}
-		return Reset{
-			Model:     m.Model,
-			DeviceID:  m.DeviceID,
-			Name:      m.Name,
-			BoolValue: value,
-		}, nil
 
-	default:
-		return nil, fmt.Errorf("module %s not found", m.Name)
+	value, err := moduleType.Parse(m.Value)
+	if err != nil {
+		return nil, err
 	}
+
+	return moduleType.New(m, value), nil
 }
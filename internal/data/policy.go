@@ -0,0 +1,147 @@
+package data
+
+import (
+	"errors"
+	"fmt"
+	"slices"
+
+	"gorm.io/gorm"
+)
+
+// Actions a user can perform on the locations and their devices
+const (
+	ACTION_VIEW      = "view"
+	ACTION_COMMAND   = "command"
+	ACTION_CONFIGURE = "configure"
+)
+
+// LocationGrant gives a guest access to a location.
+// Residents and admins don't need grants: they access every location.
+type LocationGrant struct {
+	gorm.Model
+	UserID     uint `gorm:"uniqueIndex:idx_location_grant"`
+	LocationID uint `gorm:"uniqueIndex:idx_location_grant"`
+	Location   Location
+	CanCommand bool
+}
+
+type PolicyModel struct {
+	DB *gorm.DB
+}
+
+/**
+ * Can decides whether a user may perform an action on a location.
+ * A locationID of 0 means the action is not tied to a location (e.g. creating a location).
+ * - admins can do everything
+ * - residents can view and command every location, but not configure anything
+ * - guests can only view the locations granted to them, and command them if the grant allows it
+ */
+func (m *PolicyModel) Can(user *User, action string, locationID uint) (bool, error) {
+	if user == nil {
+		return false, nil
+	}
+
+	switch user.Role {
+
+	case ROLE_ADMIN:
+		return true, nil
+
+	case ROLE_RESIDENT:
+		return action == ACTION_VIEW || action == ACTION_COMMAND, nil
+
+	case ROLE_GUEST:
+		if action == ACTION_CONFIGURE || locationID == 0 {
+			return false, nil
+		}
+		grant, err := m.getGrant(user.ID, locationID)
+		if err != nil {
+			if errors.Is(err, ErrRecordNotFound) {
+				return false, nil
+			}
+			return false, err
+		}
+		return action == ACTION_VIEW || grant.CanCommand, nil
+
+	default:
+		return false, nil
+	}
+}
+
+/**
+ * ViewableLocations returns the IDs of the locations a user may view.
+ * all is true when the user may view every location, in which case ids is nil.
+ */
+func (m *PolicyModel) ViewableLocations(user *User) (all bool, ids []uint, err error) {
+	if user == nil {
+		return false, nil, nil
+	}
+	if user.Role == ROLE_ADMIN || user.Role == ROLE_RESIDENT {
+		return true, nil, nil
+	}
+	if user.Role != ROLE_GUEST {
+		return false, nil, nil
+	}
+
+	err = m.DB.Model(&LocationGrant{}).Where("user_id = ?", user.ID).Pluck("location_id", &ids).Error
+	if err != nil {
+		return false, nil, fmt.Errorf("error fetching grants of user %d: %w", user.ID, err)
+	}
+	return false, ids, nil
+}
+
+// FilterDevices keeps only the devices of the locations a user may view.
+func (m *PolicyModel) FilterDevices(user *User, devices []*Device) ([]*Device, error) {
+	all, ids, err := m.ViewableLocations(user)
+	if err != nil || all {
+		return devices, err
+	}
+	return slices.DeleteFunc(devices, func(device *Device) bool {
+		return !slices.Contains(ids, device.LocationID)
+	}), nil
+}
+
+func (m *PolicyModel) getGrant(userID, locationID uint) (*LocationGrant, error) {
+	var grant LocationGrant
+	err := m.DB.Where("user_id = ? AND location_id = ?", userID, locationID).First(&grant).Error
+	if err != nil {
+		switch {
+		case errors.Is(err, gorm.ErrRecordNotFound):
+			return nil, fmt.Errorf("grant of user %d on location %d: %w", userID, locationID, ErrRecordNotFound)
+		default:
+			return nil, fmt.Errorf("failed to get grant of user %d on location %d: %w", userID, locationID, err)
+		}
+	}
+	return &grant, nil
+}
+
+func (m *PolicyModel) GetGrants(userID uint) ([]*LocationGrant, error) {
+	var grants []*LocationGrant
+	err := m.DB.Joins("Location").Where("user_id = ?", userID).Order("location_grants.location_id").Find(&grants).Error
+	if err != nil {
+		return nil, fmt.Errorf("error fetching grants of user %d: %w", userID, err)
+	}
+	return grants, nil
+}
+
+// SetGrant creates or updates the grant of a user on a location.
+func (m *PolicyModel) SetGrant(grant *LocationGrant) error {
+	err := m.DB.Where(LocationGrant{UserID: grant.UserID, LocationID: grant.LocationID}).
+		Assign(LocationGrant{CanCommand: grant.CanCommand}).
+		Omit("Location").
+		FirstOrCreate(grant).Error
+	if err != nil {
+		return fmt.Errorf("error setting grant of user %d on location %d: %w", grant.UserID, grant.LocationID, err)
+	}
+	return nil
+}
+
+func (m *PolicyModel) DeleteGrant(userID, locationID uint) error {
+	result := m.DB.Unscoped().Where("user_id = ? AND location_id = ?", userID, locationID).Delete(&LocationGrant{})
+	if result.Error != nil {
+		return fmt.Errorf("error deleting grant of user %d on location %d: %w", userID, locationID, result.Error)
+	}
+	if result.RowsAffected == 0 {
+		return fmt.Errorf("grant of user %d on location %d: %w", userID, locationID, ErrRecordNotFound)
+	}
+	return nil
+}
@@ -1,13 +1,29 @@
 package data
 
 import (
-	"strconv"
-	
 	"gorm.io/gorm"
 )
 
 const PRESENCE_DETECTOR = "presenceDetector"
 
+func init() {
+	RegisterModuleType(ModuleType{
+		Name:     PRESENCE_DETECTOR,
+		Kind:     KIND_BOOLEAN,
+		Writable: false,
+		Parse:    parseBool,
+		Encode:   encodeBool,
+		New: func(module *Module, value any) IModule {
+			return PresenceDetector{
+				Model:      module.Model,
+				DeviceID:   module.DeviceID,
+				Name:       module.Name,
+				IsPresence: value.(bool),
+			}
+		},
+	})
+}
+
 type PresenceDetector struct {
 	gorm.Model
 	DeviceID   string `gorm:"index"`
@@ -22,17 +38,3 @@ func (p PresenceDetector) GetValue() any {
 func (p PresenceDetector) GetName() string {
 	return p.Name
 }
-
-type PresenceDetectorModel struct {
-	DB     *gorm.DB
-	Broker *Broker
-}
-
-func (m *PresenceDetectorModel) Set(channel string, value any) error {
-	boolValue, err := ToBool(value)
-	if err != nil {
-		return err
-	}
-	m.Broker.Pub(channel, strconv.FormatBool(boolValue))
-	return nil
-}
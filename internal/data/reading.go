@@ -0,0 +1,147 @@
+package data
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// ErrDuplicateReading is returned when a reading carries the sequence number of a reading already stored.
+var ErrDuplicateReading = errors.New("duplicate reading")
+
+const (
+	// maxClockSkew is how far in the future a device timestamp may be before the reception time is used instead.
+	maxClockSkew = time.Minute
+
+	// maxReadingAge is how old a device timestamp may be, e.g. for the readings buffered while the broker was unreachable.
+	// Older timestamps come from devices whose clock is not set, the reception time is used instead.
+	maxReadingAge = 7 * 24 * time.Hour
+
+	// duplicateWindow is the period around a reading in which the same sequence number means a duplicate.
+	// The sequence numbers of a device start again on reboot, they are not compared beyond it.
+	duplicateWindow = 10 * time.Minute
+)
+
+/**
+ * Reading is the value of a module published by a device, either as a raw string (e.g. "21.4")
+ * or as a JSON object with its time, unit and sequence number:
+ *
+ *	{"v": 21.4, "ts": "2025-04-04T10:06:00Z", "unit": "C", "seq": 42}
+ *
+ * The time may also be a Unix timestamp in seconds or milliseconds. Every field but "v" is optional.
+ */
+type Reading struct {
+	Value string
+	Time  time.Time
+	Unit  string
+	Seq   *uint64
+}
+
+type readingMessage struct {
+	V    json.RawMessage `json:"v"`
+	TS   json.RawMessage `json:"ts"`
+	Unit string          `json:"unit"`
+	Seq  *uint64         `json:"seq"`
+}
+
+// ParseReading reads the payload of a module channel. The time is zero when the payload has none.
+func ParseReading(payload []byte) (*Reading, error) {
+	trimmed := bytes.TrimSpace(payload)
+	if len(trimmed) == 0 {
+		return nil, fmt.Errorf("no value found in payload")
+	}
+
+	// the raw format of the older firmwares
+	if trimmed[0] != '{' {
+		return &Reading{Value: string(payload)}, nil
+	}
+
+	var msg readingMessage
+	err := json.Unmarshal(trimmed, &msg)
+	if err != nil {
+		return nil, fmt.Errorf("error unmarshalling reading: %w", err)
+	}
+
+	return msg.toReading()
+}
+
+func (msg *readingMessage) toReading() (*Reading, error) {
+	value, err := readingValue(msg.V)
+	if err != nil {
+		return nil, err
+	}
+
+	readAt, err := readingTime(msg.TS)
+	if err != nil {
+		return nil, err
+	}
+
+	return &Reading{Value: value, Time: readAt, Unit: msg.Unit, Seq: msg.Seq}, nil
+}
+
+// readingValue converts the JSON value of a reading to the string stored for the modules.
+func readingValue(raw json.RawMessage) (string, error) {
+	var value any
+	if len(raw) == 0 || json.Unmarshal(raw, &value) != nil || value == nil {
+		return "", fmt.Errorf("no value found in payload")
+	}
+
+	switch value := value.(type) {
+	case string:
+		if value == "" {
+			return "", fmt.Errorf("no value found in payload")
+		}
+		return value, nil
+	case bool:
+		return strconv.FormatBool(value), nil
+	case float64:
+		return strconv.FormatFloat(value, 'f', -1, 64), nil
+	default:
+		return "", fmt.Errorf("invalid reading value %s", raw)
+	}
+}
+
+// readingTime reads an RFC 3339 time, or a Unix timestamp in seconds or milliseconds.
+func readingTime(raw json.RawMessage) (time.Time, error) {
+	if len(raw) == 0 || string(raw) == "null" {
+		return time.Time{}, nil
+	}
+
+	var value any
+	err := json.Unmarshal(raw, &value)
+	if err != nil {
+		return time.Time{}, fmt.Errorf("invalid reading time %s", raw)
+	}
+
+	switch value := value.(type) {
+	case string:
+		readAt, err := time.Parse(time.RFC3339Nano, strings.TrimSpace(value))
+		if err != nil {
+			return time.Time{}, fmt.Errorf("invalid reading time %q: %w", value, err)
+		}
+		return readAt, nil
+	case float64:
+		// the timestamps in milliseconds are beyond the year 33658 in seconds
+		if value >= 1e12 {
+			return time.UnixMilli(int64(value)), nil
+		}
+		return time.Unix(int64(value), 0), nil
+	default:
+		return time.Time{}, fmt.Errorf("invalid reading time %s", raw)
+	}
+}
+
+// readingTimeAt returns the time of a reading received at now: the device time if it is plausible, now otherwise.
+func (r *Reading) readingTimeAt(now time.Time) (time.Time, bool) {
+	if r.Time.IsZero() {
+		return now, true
+	}
+	if r.Time.After(now.Add(maxClockSkew)) || r.Time.Before(now.Add(-maxReadingAge)) {
+		return now, false
+	}
+	return r.Time, true
+}
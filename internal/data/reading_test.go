@@ -0,0 +1,100 @@
+package data
+
+import (
+	"testing"
+	"time"
+)
+
+func TestParseReading(t *testing.T) {
+	seq := uint64(42)
+
+	tests := []struct {
+		name    string
+		payload string
+		want    Reading
+	}{
+		{"raw number", "21.4", Reading{Value: "21.4"}},
+		{"raw boolean", "true", Reading{Value: "true"}},
+		{"number", `{"v": 21.4}`, Reading{Value: "21.4"}},
+		{"integer", `{"v": 1500}`, Reading{Value: "1500"}},
+		{"boolean", `{"v": false}`, Reading{Value: "false"}},
+		{"string", `{"v": "on"}`, Reading{Value: "on"}},
+		{"padded", " \n{\"v\": 1}\n", Reading{Value: "1"}},
+		{"unit and seq", `{"v": 21.4, "unit": "C", "seq": 42}`, Reading{Value: "21.4", Unit: "C", Seq: &seq}},
+		{"RFC 3339 time", `{"v": 1, "ts": "2025-04-04T10:06:00Z"}`, Reading{Value: "1", Time: time.Date(2025, time.April, 4, 10, 6, 0, 0, time.UTC)}},
+		{"Unix seconds", `{"v": 1, "ts": 1712225160}`, Reading{Value: "1", Time: time.Unix(1712225160, 0)}},
+		{"Unix milliseconds", `{"v": 1, "ts": 1712225160123}`, Reading{Value: "1", Time: time.UnixMilli(1712225160123)}},
+		{"null time", `{"v": 1, "ts": null}`, Reading{Value: "1"}},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := ParseReading([]byte(tt.payload))
+			if err != nil {
+				t.Fatalf("ParseReading(%q) error = %v", tt.payload, err)
+			}
+			if got.Value != tt.want.Value || !got.Time.Equal(tt.want.Time) || got.Unit != tt.want.Unit {
+				t.Errorf("ParseReading(%q) = %+v, want %+v", tt.payload, *got, tt.want)
+			}
+			if (got.Seq == nil) != (tt.want.Seq == nil) || (got.Seq != nil && *got.Seq != *tt.want.Seq) {
+				t.Errorf("ParseReading(%q) seq = %v, want %v", tt.payload, got.Seq, tt.want.Seq)
+			}
+		})
+	}
+}
+
+func TestParseReadingErrors(t *testing.T) {
+	tests := []struct {
+		name    string
+		payload string
+	}{
+		{"empty", ""},
+		{"blank", " \n"},
+		{"invalid JSON", `{"v": 1`},
+		{"no value", `{"ts": 1712225160}`},
+		{"null value", `{"v": null}`},
+		{"empty value", `{"v": ""}`},
+		{"object value", `{"v": {"a": 1}}`},
+		{"array value", `{"v": [1]}`},
+		{"invalid time", `{"v": 1, "ts": "yesterday"}`},
+		{"boolean time", `{"v": 1, "ts": true}`},
+		{"negative seq", `{"v": 1, "seq": -1}`},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := ParseReading([]byte(tt.payload))
+			if err == nil {
+				t.Errorf("ParseReading(%q) = %+v, want an error", tt.payload, *got)
+			}
+		})
+	}
+}
+
+func TestReadingTimeAt(t *testing.T) {
+	now := time.Date(2025, time.April, 4, 10, 0, 0, 0, time.UTC)
+
+	tests := []struct {
+		name          string
+		time          time.Time
+		want          time.Time
+		wantPlausible bool
+	}{
+		{"no time", time.Time{}, now, true},
+		{"past", now.Add(-time.Hour), now.Add(-time.Hour), true},
+		{"buffered", now.Add(-6 * 24 * time.Hour), now.Add(-6 * 24 * time.Hour), true},
+		{"clock skew", now.Add(30 * time.Second), now.Add(30 * time.Second), true},
+		{"future", now.Add(time.Hour), now, false},
+		{"too old", now.Add(-8 * 24 * time.Hour), now, false},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			reading := Reading{Value: "1", Time: tt.time}
+			got, plausible := reading.readingTimeAt(now)
+			if !got.Equal(tt.want) || plausible != tt.wantPlausible {
+				t.Errorf("readingTimeAt(%v) = %v, %v, want %v, %v", tt.time, got, plausible, tt.want, tt.wantPlausible)
+			}
+		})
+	}
+}
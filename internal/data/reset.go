@@ -8,6 +8,25 @@ import (
 
 const RESET = "reset"
 
+func init() {
+	// the reset is sent by DeviceModel.Reset, it is not a value to command nor to restore on startup
+	RegisterModuleType(ModuleType{
+		Name:     RESET,
+		Kind:     KIND_BOOLEAN,
+		Writable: false,
+		Parse:    parseBool,
+		Encode:   encodeBool,
+		New: func(module *Module, value any) IModule {
+			return Reset{
+				Model:     module.Model,
+				DeviceID:  module.DeviceID,
+				Name:      module.Name,
+				BoolValue: value.(bool),
+			}
+		},
+	})
+}
+
 type Reset struct {
 	gorm.Model
 	DeviceID  string `gorm:"index"`
@@ -0,0 +1,336 @@
+package data
+
+import (
+	"errors"
+	"fmt"
+	"time"
+
+	"HomeIoT/internal/validator"
+
+	"gorm.io/gorm"
+)
+
+// How the conditions of a rule are combined
+const (
+	MATCH_ALL = "all"
+	MATCH_ANY = "any"
+)
+
+// Operators of the rule conditions
+const (
+	OPERATOR_EQ  = "eq"
+	OPERATOR_NE  = "ne"
+	OPERATOR_LT  = "lt"
+	OPERATOR_LTE = "lte"
+	OPERATOR_GT  = "gt"
+	OPERATOR_GTE = "gte"
+)
+
+var Operators = []string{OPERATOR_EQ, OPERATOR_NE, OPERATOR_LT, OPERATOR_LTE, OPERATOR_GT, OPERATOR_GTE}
+
+// Types of the actions fired by the automations
+const (
+	ACTION_TYPE_SET   = "set"
+	ACTION_TYPE_EMAIL = "email"
+	ACTION_TYPE_RESET = "reset"
+)
+
+var ActionTypes = []string{ACTION_TYPE_SET, ACTION_TYPE_EMAIL, ACTION_TYPE_RESET}
+
+// Rule fires its actions when its conditions on the module values start matching.
+// Active holds the result of the last evaluation, so that the actions are only fired on a transition.
+type Rule struct {
+	gorm.Model
+	Name        string
+	Enabled     bool
+	DryRun      bool
+	Match       string
+	Conditions  []RuleCondition `gorm:"constraint:OnDelete:CASCADE"`
+	Actions     []RuleAction    `gorm:"constraint:OnDelete:CASCADE"`
+	Active      bool
+	LastFiredAt *time.Time
+}
+
+type RuleCondition struct {
+	gorm.Model
+	RuleID     uint `gorm:"index"`
+	DeviceID   string
+	ModuleName string
+	Operator   string
+	Value      string
+}
+
+type RuleAction struct {
+	gorm.Model
+	RuleID     uint `gorm:"index"`
+	Type       string
+	DeviceID   string
+	ModuleName string
+	Value      string
+	Recipient  string
+}
+
+// RuleRun records each time the actions of a rule have been fired (or would have been, in dry-run mode).
+type RuleRun struct {
+	gorm.Model
+	RuleID  uint `gorm:"index"`
+	Rule    Rule `gorm:"constraint:OnDelete:CASCADE"`
+	Trigger string
+	DryRun  bool
+	Success bool
+	Details string
+}
+
+type RuleModel struct {
+	DB *gorm.DB
+}
+
+/**
+ * Evaluate compares the current value of a module with the condition.
+ * Numeric modules support every operator, boolean modules only eq and ne.
+ */
+func (c *RuleCondition) Evaluate(value string) (bool, error) {
+	kind, err := ModuleKind(c.ModuleName)
+	if err != nil {
+		return false, err
+	}
+
+	switch kind {
+	case KIND_BOOLEAN:
+		current, err := ToBool(value)
+		if err != nil {
+			return false, fmt.Errorf("%w: %w", ErrInvalidValue, err)
+		}
+		expected, err := ToBool(c.Value)
+		if err != nil {
+			return false, fmt.Errorf("%w: %w", ErrInvalidValue, err)
+		}
+		switch c.Operator {
+		case OPERATOR_EQ:
+			return current == expected, nil
+		case OPERATOR_NE:
+			return current != expected, nil
+		}
+
+	case KIND_NUMERIC:
+		current, err := ToFloat(value)
+		if err != nil {
+			return false, fmt.Errorf("%w: %w", ErrInvalidValue, err)
+		}
+		expected, err := ToFloat(c.Value)
+		if err != nil {
+			return false, fmt.Errorf("%w: %w", ErrInvalidValue, err)
+		}
+		switch c.Operator {
+		case OPERATOR_EQ:
+			return current == expected, nil
+		case OPERATOR_NE:
+			return current != expected, nil
+		case OPERATOR_LT:
+			return current < expected, nil
+		case OPERATOR_LTE:
+			return current <= expected, nil
+		case OPERATOR_GT:
+			return current > expected, nil
+		case OPERATOR_GTE:
+			return current >= expected, nil
+		}
+	}
+
+	return false, fmt.Errorf("operator %s is not supported by module %s", c.Operator, c.ModuleName)
+}
+
+func (c RuleCondition) String() string {
+	return fmt.Sprintf("%s/%s %s %s", c.DeviceID, c.ModuleName, c.Operator, c.Value)
+}
+
+func (a RuleAction) String() string {
+	switch a.Type {
+	case ACTION_TYPE_SET:
+		return fmt.Sprintf("set %s/%s to %s", a.DeviceID, a.ModuleName, a.Value)
+	case ACTION_TYPE_EMAIL:
+		return fmt.Sprintf("email %s", a.Recipient)
+	case ACTION_TYPE_RESET:
+		return fmt.Sprintf("reset %s", a.DeviceID)
+	default:
+		return a.Type
+	}
+}
+
+func ValidateRule(v *validator.Validator, rule *Rule) {
+	v.StringCheck(rule.Name, 1, 100, true, "name")
+	v.Check(validator.PermittedValue(rule.Match, MATCH_ALL, MATCH_ANY), "match", "must be all or any")
+	v.Check(len(rule.Conditions) > 0, "conditions", "at least one condition is required")
+	v.Check(len(rule.Actions) > 0, "actions", "at least one action is required")
+
+	for i, condition := range rule.Conditions {
+		key := fmt.Sprintf("conditions.%d", i)
+		kind, err := ModuleKind(condition.ModuleName)
+		if err != nil {
+			v.AddFieldError(key, "must target a known module")
+			continue
+		}
+		v.Check(validator.PermittedValue(condition.Operator, Operators...), key, "unknown operator")
+		if kind == KIND_BOOLEAN {
+			v.Check(validator.PermittedValue(condition.Operator, OPERATOR_EQ, OPERATOR_NE), key, "boolean modules can only be compared with eq or ne")
+		}
+		_, err = (&Module{Name: condition.ModuleName, Value: condition.Value}).ToIModule()
+		v.Check(err == nil, key, fmt.Sprintf("invalid value for module %s", condition.ModuleName))
+	}
+
+	for i, action := range rule.Actions {
+		ValidateAction(v, fmt.Sprintf("actions.%d", i), &action)
+	}
+}
+
+// ValidateAction checks an action fired by the automations (rules, alerts or schedules).
+func ValidateAction(v *validator.Validator, key string, action *RuleAction) {
+	switch action.Type {
+	case ACTION_TYPE_SET:
+		v.Check(action.DeviceID != "", key, "must target a device")
+		if _, err := ModuleKind(action.ModuleName); err != nil {
+			v.AddFieldError(key, "must target a known module")
+			return
+		}
+		if !IsWritable(action.ModuleName) {
+			v.AddFieldError(key, fmt.Sprintf("module %s is read-only", action.ModuleName))
+			return
+		}
+		_, err := (&Module{Name: action.ModuleName, Value: action.Value}).ToIModule()
+		v.Check(err == nil, key, fmt.Sprintf("invalid value for module %s", action.ModuleName))
+	case ACTION_TYPE_EMAIL:
+		v.Check(validator.Matches(action.Recipient, validator.EmailRX), key, "must be a valid email address")
+	case ACTION_TYPE_RESET:
+		v.Check(action.DeviceID != "", key, "must target a device")
+	default:
+		v.AddFieldError(key, "unknown action")
+	}
+}
+
+func (m *RuleModel) GetAll() ([]*Rule, error) {
+	var rules []*Rule
+	err := m.DB.Preload("Conditions").Preload("Actions").Order("id").Find(&rules).Error
+	if err != nil {
+		return nil, fmt.Errorf("failed to get rules: %w", err)
+	}
+	return rules, nil
+}
+
+func (m *RuleModel) Get(id uint) (*Rule, error) {
+	var rule Rule
+	err := m.DB.Preload("Conditions").Preload("Actions").First(&rule, id).Error
+	if err != nil {
+		switch {
+		case errors.Is(err, gorm.ErrRecordNotFound):
+			return nil, fmt.Errorf("rule with id %d: %w", id, ErrRecordNotFound)
+		default:
+			return nil, fmt.Errorf("failed to get rule with id %d: %w", id, err)
+		}
+	}
+	return &rule, nil
+}
+
+// GetTriggeredBy returns the enabled rules having a condition on the given device module.
+func (m *RuleModel) GetTriggeredBy(deviceID, moduleName string) ([]*Rule, error) {
+	var rules []*Rule
+	err := m.DB.Preload("Conditions").Preload("Actions").
+		Where("enabled AND id IN (?)", m.DB.Model(&RuleCondition{}).Select("rule_id").Where("device_id = ? AND module_name = ?", deviceID, moduleName)).
+		Find(&rules).Error
+	if err != nil {
+		return nil, fmt.Errorf("failed to get rules triggered by %s/%s: %w", deviceID, moduleName, err)
+	}
+	return rules, nil
+}
+
+func (m *RuleModel) Insert(rule *Rule) error {
+	result := m.DB.Create(rule)
+	if result.Error != nil {
+		return fmt.Errorf("could not create rule: %w", result.Error)
+	}
+	if result.RowsAffected == 0 {
+		return fmt.Errorf("could not create rule: %d rows affected", result.RowsAffected)
+	}
+	return nil
+}
+
+// Update saves the rule and replaces its conditions and actions.
+func (m *RuleModel) Update(rule *Rule) error {
+	return m.DB.Transaction(func(tx *gorm.DB) error {
+		err := tx.Unscoped().Where("rule_id = ?", rule.ID).Delete(&RuleCondition{}).Error
+		if err != nil {
+			return fmt.Errorf("error deleting rule conditions: %w", err)
+		}
+		err = tx.Unscoped().Where("rule_id = ?", rule.ID).Delete(&RuleAction{}).Error
+		if err != nil {
+			return fmt.Errorf("error deleting rule actions: %w", err)
+		}
+
+		// the rule is evaluated again from scratch with its new conditions
+		rule.Active = false
+		for i := range rule.Conditions {
+			rule.Conditions[i].ID = 0
+		}
+		for i := range rule.Actions {
+			rule.Actions[i].ID = 0
+		}
+
+		err = tx.Session(&gorm.Session{FullSaveAssociations: true}).Save(rule).Error
+		if err != nil {
+			return fmt.Errorf("error updating rule: %w", err)
+		}
+		return nil
+	})
+}
+
+func (m *RuleModel) Delete(id uint) error {
+	return m.DB.Transaction(func(tx *gorm.DB) error {
+		for _, model := range []any{&RuleCondition{}, &RuleAction{}, &RuleRun{}} {
+			err := tx.Unscoped().Where("rule_id = ?", id).Delete(model).Error
+			if err != nil {
+				return fmt.Errorf("error deleting rule %d: %w", id, err)
+			}
+		}
+		result := tx.Unscoped().Delete(&Rule{}, id)
+		if result.Error != nil {
+			return fmt.Errorf("error deleting rule %d: %w", id, result.Error)
+		}
+		if result.RowsAffected == 0 {
+			return fmt.Errorf("rule with id %d: %w", id, ErrRecordNotFound)
+		}
+		return nil
+	})
+}
+
+// SetActive stores the result of the last evaluation of a rule, and the time its actions were fired if they were.
+func (m *RuleModel) SetActive(rule *Rule, active, fired bool) error {
+	updates := map[string]any{"active": active}
+	if fired {
+		now := time.Now()
+		updates["last_fired_at"] = now
+		rule.LastFiredAt = &now
+	}
+	rule.Active = active
+
+	err := m.DB.Model(&Rule{}).Where("id = ?", rule.ID).Updates(updates).Error
+	if err != nil {
+		return fmt.Errorf("error updating state of rule %d: %w", rule.ID, err)
+	}
+	return nil
+}
+
+func (m *RuleModel) InsertRun(run *RuleRun) error {
+	err := m.DB.Omit("Rule").Create(run).Error
+	if err != nil {
+		return fmt.Errorf("could not record run of rule %d: %w", run.RuleID, err)
+	}
+	return nil
+}
+
+func (m *RuleModel) GetRuns(ruleID uint, limit int) ([]*RuleRun, error) {
+	var runs []*RuleRun
+	err := m.DB.Where("rule_id = ?", ruleID).Order("created_at DESC").Limit(limit).Find(&runs).Error
+	if err != nil {
+		return nil, fmt.Errorf("failed to get runs of rule %d: %w", ruleID, err)
+	}
+	return runs, nil
+}
@@ -0,0 +1,199 @@
+package data
+
+import (
+	"context"
+	"errors"
+	"fmt"
+
+	"HomeIoT/internal/validator"
+
+	"gorm.io/gorm"
+)
+
+// Scene is a named set of module values applied together, e.g. "Movie night".
+type Scene struct {
+	gorm.Model
+	Name    string
+	Targets []SceneTarget `gorm:"constraint:OnDelete:CASCADE"`
+}
+
+type SceneTarget struct {
+	gorm.Model
+	SceneID    uint `gorm:"index"`
+	DeviceID   string
+	ModuleName string
+	Value      string
+}
+
+// SceneResult is the outcome of the publish of a scene target.
+type SceneResult struct {
+	DeviceID string `json:"device_id"`
+	Module   string `json:"module"`
+	Value    string `json:"value"`
+	Success  bool   `json:"success"`
+	Queued   bool   `json:"queued"`
+	Error    string `json:"error,omitempty"`
+}
+
+type SceneModel struct {
+	DB      *gorm.DB
+	Module  *ModuleModel
+	Modules *ModuleModels
+}
+
+func ValidateScene(v *validator.Validator, scene *Scene) {
+	v.StringCheck(scene.Name, 1, 100, true, "name")
+	v.Check(len(scene.Targets) > 0, "targets", "at least one target is required")
+
+	seen := make(map[string]bool)
+	for i, target := range scene.Targets {
+		key := fmt.Sprintf("targets.%d", i)
+		v.Check(target.DeviceID != "", key, "must target a device")
+		v.Check(!seen[target.DeviceID+"/"+target.ModuleName], key, "module targeted twice")
+		seen[target.DeviceID+"/"+target.ModuleName] = true
+
+		if _, err := ModuleKind(target.ModuleName); err == nil && !IsWritable(target.ModuleName) {
+			v.AddFieldError(key, fmt.Sprintf("module %s is read-only", target.ModuleName))
+			continue
+		}
+		_, err := (&Module{Name: target.ModuleName, Value: target.Value}).ToIModule()
+		v.Check(err == nil, key, fmt.Sprintf("invalid value for module %s", target.ModuleName))
+	}
+}
+
+func (m *SceneModel) GetAll() ([]*Scene, error) {
+	var scenes []*Scene
+	err := m.DB.Preload("Targets").Order("name").Find(&scenes).Error
+	if err != nil {
+		return nil, fmt.Errorf("failed to get scenes: %w", err)
+	}
+	return scenes, nil
+}
+
+func (m *SceneModel) Get(id uint) (*Scene, error) {
+	var scene Scene
+	err := m.DB.Preload("Targets").First(&scene, id).Error
+	if err != nil {
+		switch {
+		case errors.Is(err, gorm.ErrRecordNotFound):
+			return nil, fmt.Errorf("scene with id %d: %w", id, ErrRecordNotFound)
+		default:
+			return nil, fmt.Errorf("failed to get scene with id %d: %w", id, err)
+		}
+	}
+	return &scene, nil
+}
+
+func (m *SceneModel) NameExists(name string, exceptID uint) (bool, error) {
+	var count int64
+	err := m.DB.Model(&Scene{}).Where("name = ? AND id <> ?", name, exceptID).Count(&count).Error
+	if err != nil {
+		return false, fmt.Errorf("error checking scene name %s: %w", name, err)
+	}
+	return count > 0, nil
+}
+
+func (m *SceneModel) Insert(scene *Scene) error {
+	result := m.DB.Create(scene)
+	if result.Error != nil {
+		return fmt.Errorf("could not create scene %s: %w", scene.Name, result.Error)
+	}
+	if result.RowsAffected == 0 {
+		return fmt.Errorf("could not create scene %s: %d rows affected", scene.Name, result.RowsAffected)
+	}
+	return nil
+}
+
+// Update saves the scene and replaces its targets.
+func (m *SceneModel) Update(scene *Scene) error {
+	return m.DB.Transaction(func(tx *gorm.DB) error {
+		err := tx.Unscoped().Where("scene_id = ?", scene.ID).Delete(&SceneTarget{}).Error
+		if err != nil {
+			return fmt.Errorf("error deleting scene targets: %w", err)
+		}
+
+		for i := range scene.Targets {
+			scene.Targets[i].ID = 0
+		}
+
+		err = tx.Session(&gorm.Session{FullSaveAssociations: true}).Save(scene).Error
+		if err != nil {
+			return fmt.Errorf("error updating scene: %w", err)
+		}
+		return nil
+	})
+}
+
+func (m *SceneModel) Delete(id uint) error {
+	return m.DB.Transaction(func(tx *gorm.DB) error {
+		err := tx.Unscoped().Where("scene_id = ?", id).Delete(&SceneTarget{}).Error
+		if err != nil {
+			return fmt.Errorf("error deleting targets of scene %d: %w", id, err)
+		}
+		result := tx.Unscoped().Delete(&Scene{}, id)
+		if result.Error != nil {
+			return fmt.Errorf("error deleting scene %d: %w", id, result.Error)
+		}
+		if result.RowsAffected == 0 {
+			return fmt.Errorf("scene with id %d: %w", id, ErrRecordNotFound)
+		}
+		return nil
+	})
+}
+
+// Capture builds the targets of a scene from the current values of the commandable modules of the devices.
+func (m *SceneModel) Capture(scene *Scene, deviceIDs []string) error {
+	for _, deviceID := range deviceIDs {
+		modules, err := m.Module.GetByDeviceID(deviceID)
+		if err != nil {
+			return err
+		}
+		for _, module := range modules {
+			// the sensors are only read, they are not part of a scene
+			if !IsWritable(module.Name) || module.Value == "" {
+				continue
+			}
+			scene.Targets = append(scene.Targets, SceneTarget{
+				DeviceID:   deviceID,
+				ModuleName: module.Name,
+				Value:      module.Value,
+			})
+		}
+	}
+	return nil
+}
+
+/**
+ * Apply publishes the value of every target of the scene, and reports the outcome of each publish:
+ * sent, queued until the broker is reachable, or failed.
+ * Every target is checked before anything is published, so that a scene referring to a removed
+ * module is not half applied: the first missing module is returned as an error instead.
+ */
+func (m *SceneModel) Apply(ctx context.Context, scene *Scene) ([]SceneResult, error) {
+	modules := make([]*Module, len(scene.Targets))
+	for i, target := range scene.Targets {
+		module, err := m.Module.GetByDeviceAndName(target.DeviceID, target.ModuleName)
+		if err != nil {
+			return nil, err
+		}
+		modules[i] = module
+	}
+
+	results := make([]SceneResult, len(scene.Targets))
+	for i, target := range scene.Targets {
+		results[i] = SceneResult{
+			DeviceID: target.DeviceID,
+			Module:   target.ModuleName,
+			Value:    target.Value,
+			Success:  true,
+		}
+		err := m.Modules.Set(ctx, *modules[i], target.Value)
+		if err != nil {
+			results[i].Success = false
+			results[i].Queued = errors.Is(err, ErrPublishQueued)
+			results[i].Error = err.Error()
+		}
+	}
+
+	return results, nil
+}
@@ -0,0 +1,215 @@
+package data
+
+import (
+	"errors"
+	"fmt"
+	"time"
+
+	"HomeIoT/internal/cron"
+	"HomeIoT/internal/validator"
+
+	"gorm.io/gorm"
+)
+
+// Policies applied to the runs missed while the server was down
+const (
+	MISSED_SKIP     = "skip"
+	MISSED_RUN_ONCE = "run_once"
+	MISSED_RUN_ALL  = "run_all"
+)
+
+var MissedPolicies = []string{MISSED_SKIP, MISSED_RUN_ONCE, MISSED_RUN_ALL}
+
+// Schedule runs a module command or a reset at the times of its cron expression.
+// A reset without DeviceID resets every device.
+type Schedule struct {
+	gorm.Model
+	Name         string
+	Spec         string
+	Enabled      bool
+	MissedPolicy string
+	ActionType   string
+	DeviceID     string
+	ModuleName   string
+	Value        string
+	NextRunAt    *time.Time `gorm:"index"`
+	LastRunAt    *time.Time
+}
+
+type ScheduleRun struct {
+	gorm.Model
+	ScheduleID  uint     `gorm:"index"`
+	Schedule    Schedule `gorm:"constraint:OnDelete:CASCADE"`
+	ScheduledAt time.Time
+	Missed      bool
+	Skipped     bool
+	Success     bool
+	Details     string
+}
+
+type ScheduleModel struct {
+	DB *gorm.DB
+}
+
+func (s Schedule) ActionString() string {
+	switch {
+	case s.ActionType == ACTION_TYPE_SET:
+		return fmt.Sprintf("set %s/%s to %s", s.DeviceID, s.ModuleName, s.Value)
+	case s.ActionType == ACTION_TYPE_RESET && s.DeviceID == "":
+		return "reset every device"
+	case s.ActionType == ACTION_TYPE_RESET:
+		return fmt.Sprintf("reset %s", s.DeviceID)
+	default:
+		return s.ActionType
+	}
+}
+
+func ValidateSchedule(v *validator.Validator, schedule *Schedule) {
+	v.StringCheck(schedule.Name, 1, 100, true, "name")
+	_, err := cron.Parse(schedule.Spec)
+	v.Check(err == nil, "spec", "must be a valid cron expression (minute hour day month weekday)")
+	v.Check(validator.PermittedValue(schedule.MissedPolicy, MissedPolicies...), "missed_policy", "unknown policy")
+
+	switch schedule.ActionType {
+	case ACTION_TYPE_SET:
+		v.Check(schedule.DeviceID != "", "target", "must target a device")
+		if _, err := ModuleKind(schedule.ModuleName); err != nil {
+			v.AddFieldError("target", "must target a known module")
+			return
+		}
+		if !IsWritable(schedule.ModuleName) {
+			v.AddFieldError("target", fmt.Sprintf("module %s is read-only", schedule.ModuleName))
+			return
+		}
+		_, err := (&Module{Name: schedule.ModuleName, Value: schedule.Value}).ToIModule()
+		v.Check(err == nil, "value", fmt.Sprintf("invalid value for module %s", schedule.ModuleName))
+	case ACTION_TYPE_RESET:
+	default:
+		v.AddFieldError("action_type", "unknown action")
+	}
+}
+
+// Occurrences returns the times of the schedule after from and until to included, at most limit of them.
+func (s *Schedule) Occurrences(from, to time.Time, limit int) ([]time.Time, error) {
+	spec, err := cron.Parse(s.Spec)
+	if err != nil {
+		return nil, err
+	}
+
+	var times []time.Time
+	for t := spec.Next(from); !t.IsZero() && !t.After(to) && len(times) < limit; t = spec.Next(t) {
+		times = append(times, t)
+	}
+	return times, nil
+}
+
+// ComputeNextRun sets NextRunAt to the first occurrence after t, or nil if the expression never matches again.
+func (s *Schedule) ComputeNextRun(t time.Time) error {
+	spec, err := cron.Parse(s.Spec)
+	if err != nil {
+		return err
+	}
+
+	next := spec.Next(t)
+	s.NextRunAt = nil
+	if !next.IsZero() {
+		s.NextRunAt = &next
+	}
+	return nil
+}
+
+func (m *ScheduleModel) GetAll() ([]*Schedule, error) {
+	var schedules []*Schedule
+	err := m.DB.Order("id").Find(&schedules).Error
+	if err != nil {
+		return nil, fmt.Errorf("failed to get schedules: %w", err)
+	}
+	return schedules, nil
+}
+
+func (m *ScheduleModel) Get(id uint) (*Schedule, error) {
+	var schedule Schedule
+	err := m.DB.First(&schedule, id).Error
+	if err != nil {
+		switch {
+		case errors.Is(err, gorm.ErrRecordNotFound):
+			return nil, fmt.Errorf("schedule with id %d: %w", id, ErrRecordNotFound)
+		default:
+			return nil, fmt.Errorf("failed to get schedule with id %d: %w", id, err)
+		}
+	}
+	return &schedule, nil
+}
+
+// GetDue returns the enabled schedules whose next run is due at the given time.
+func (m *ScheduleModel) GetDue(t time.Time) ([]*Schedule, error) {
+	var schedules []*Schedule
+	err := m.DB.Where("enabled AND next_run_at <= ?", t).Order("next_run_at").Find(&schedules).Error
+	if err != nil {
+		return nil, fmt.Errorf("failed to get due schedules: %w", err)
+	}
+	return schedules, nil
+}
+
+func (m *ScheduleModel) Insert(schedule *Schedule) error {
+	result := m.DB.Create(schedule)
+	if result.Error != nil {
+		return fmt.Errorf("could not create schedule: %w", result.Error)
+	}
+	if result.RowsAffected == 0 {
+		return fmt.Errorf("could not create schedule: %d rows affected", result.RowsAffected)
+	}
+	return nil
+}
+
+func (m *ScheduleModel) Update(schedule *Schedule) error {
+	err := m.DB.Save(schedule).Error
+	if err != nil {
+		return fmt.Errorf("error updating schedule %d: %w", schedule.ID, err)
+	}
+	return nil
+}
+
+// SetNextRun stores the next run of a schedule, and the time of its last run if it ran.
+func (m *ScheduleModel) SetNextRun(schedule *Schedule) error {
+	err := m.DB.Model(&Schedule{}).Where("id = ?", schedule.ID).
+		Updates(map[string]any{"next_run_at": schedule.NextRunAt, "last_run_at": schedule.LastRunAt}).Error
+	if err != nil {
+		return fmt.Errorf("error updating next run of schedule %d: %w", schedule.ID, err)
+	}
+	return nil
+}
+
+func (m *ScheduleModel) Delete(id uint) error {
+	return m.DB.Transaction(func(tx *gorm.DB) error {
+		err := tx.Unscoped().Where("schedule_id = ?", id).Delete(&ScheduleRun{}).Error
+		if err != nil {
+			return fmt.Errorf("error deleting runs of schedule %d: %w", id, err)
+		}
+		result := tx.Unscoped().Delete(&Schedule{}, id)
+		if result.Error != nil {
+			return fmt.Errorf("error deleting schedule %d: %w", id, result.Error)
+		}
+		if result.RowsAffected == 0 {
+			return fmt.Errorf("schedule with id %d: %w", id, ErrRecordNotFound)
+		}
+		return nil
+	})
+}
+
+func (m *ScheduleModel) InsertRun(run *ScheduleRun) error {
+	err := m.DB.Omit("Schedule").Create(run).Error
+	if err != nil {
+		return fmt.Errorf("could not record run of schedule %d: %w", run.ScheduleID, err)
+	}
+	return nil
+}
+
+func (m *ScheduleModel) GetRuns(scheduleID uint, limit int) ([]*ScheduleRun, error) {
+	var runs []*ScheduleRun
+	err := m.DB.Where("schedule_id = ?", scheduleID).Order("created_at DESC").Limit(limit).Find(&runs).Error
+	if err != nil {
+		return nil, fmt.Errorf("failed to get runs of schedule %d: %w", scheduleID, err)
+	}
+	return runs, nil
+}
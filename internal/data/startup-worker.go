@@ -0,0 +1,135 @@
+package data
+
+import (
+	"fmt"
+	"log/slog"
+	"sync"
+	"time"
+
+	mqtt "github.com/eclipse/paho.mqtt.golang"
+)
+
+// DefaultSetupDelay is the delay between the startup message of a device and the setup reply,
+// leaving the device the time to subscribe to its setup channel.
+const DefaultSetupDelay = 5 * time.Second
+
+/**
+ * StartupWorker handles the startup messages out of the MQTT handler, so that the other messages keep flowing
+ * while the devices wait for their setup.
+ * The startups of a device are handled one at a time and in order; while one is in progress,
+ * only the latest of the following ones is kept, a rebooting device being only interested in its last setup.
+ */
+type StartupWorker struct {
+	Data  *DataModel
+	Delay time.Duration
+
+	mu      sync.Mutex
+	pending map[string]*StartupMessage
+	running map[string]bool
+	stopped bool
+
+	wg   sync.WaitGroup
+	stop chan struct{}
+	once sync.Once
+}
+
+func NewStartupWorker(data *DataModel, delay time.Duration) *StartupWorker {
+	return &StartupWorker{
+		Data:    data,
+		Delay:   delay,
+		pending: make(map[string]*StartupMessage),
+		running: make(map[string]bool),
+		stop:    make(chan struct{}),
+	}
+}
+
+// Enqueue hands a startup message over to the worker of its device, without blocking the MQTT handler.
+func (w *StartupWorker) Enqueue(msg mqtt.Message) {
+	// DEBUG
+	w.Data.Logger.Debug("received startup MQTT message", slog.String("HANDLER", "startupWorker"), slog.String("TOPIC", msg.Topic()), slog.String("PAYLOAD", string(msg.Payload())))
+
+	// Parse the payload into a StartupMessage
+	startupMessage, err := NewStartupMessage(msg.Payload())
+	if err != nil {
+		w.Data.Logger.Error(err.Error())
+		return
+	}
+
+	w.mu.Lock()
+	defer w.mu.Unlock()
+
+	if w.stopped {
+		w.Data.Logger.Warn("startup ignored while shutting down", slog.String("device", startupMessage.DeviceID))
+		return
+	}
+
+	if _, ok := w.pending[startupMessage.DeviceID]; ok {
+		w.Data.Logger.Debug("startup superseded by a newer one", slog.String("device", startupMessage.DeviceID))
+	}
+	w.pending[startupMessage.DeviceID] = startupMessage
+
+	if !w.running[startupMessage.DeviceID] {
+		w.running[startupMessage.DeviceID] = true
+		w.wg.Add(1)
+		go w.run(startupMessage.DeviceID)
+	}
+}
+
+// run handles the startups of a device until none is pending.
+func (w *StartupWorker) run(deviceID string) {
+	defer w.wg.Done()
+
+	for {
+		w.mu.Lock()
+		startupMessage, ok := w.pending[deviceID]
+		if !ok {
+			delete(w.running, deviceID)
+			w.mu.Unlock()
+			return
+		}
+		delete(w.pending, deviceID)
+		w.mu.Unlock()
+
+		w.handle(startupMessage)
+	}
+}
+
+// handle registers the device of a startup message, then replies its setup after the delay.
+func (w *StartupWorker) handle(startupMessage *StartupMessage) {
+	device, err := w.Data.registerStartup(startupMessage)
+	if err != nil {
+		w.Data.Logger.Error(fmt.Errorf("error handling the startup of device %s: %w", startupMessage.DeviceID, err).Error())
+		return
+	}
+
+	timer := time.NewTimer(w.Delay)
+	defer timer.Stop()
+
+	select {
+	case <-timer.C:
+		w.Data.replySetup(device)
+	case <-w.stop:
+		w.Data.Logger.Warn("setup reply cancelled by the shutdown", slog.String("device", device.ID))
+	}
+}
+
+// Run waits until Stop is called, then returns once the startups in progress are done.
+func (w *StartupWorker) Run() {
+	w.Data.Logger.Info("startup worker started", slog.Duration("setup_delay", w.Delay))
+
+	<-w.stop
+	w.wg.Wait()
+
+	w.Data.Logger.Info("startup worker stopped")
+}
+
+// Stop stops the worker. The setup replies still waiting for their delay are cancelled.
+func (w *StartupWorker) Stop() {
+	w.once.Do(func() {
+		w.mu.Lock()
+		w.stopped = true
+		w.mu.Unlock()
+
+		close(w.stop)
+	})
+}
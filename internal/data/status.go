@@ -0,0 +1,14 @@
+package data
+
+const STATUS_MODULE = "status"
+
+// Status is the channel on which a device publishes its online/offline status, typically as its MQTT Will.
+type Status struct{}
+
+func (s *Status) GetName() string {
+	return STATUS_MODULE
+}
+
+func (s *Status) GetValue() any {
+	return nil
+}
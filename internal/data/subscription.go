@@ -1,6 +1,7 @@
 package data
 
 import (
+	"context"
 	"encoding/json"
 	"errors"
 	"fmt"
@@ -12,72 +13,80 @@ import (
 )
 
 /**
- * Sub subscribes to the given topic and sets the appropriate handler.
+ * Sub subscribes to the given topic and sets the appropriate handler, again on every reconnection to the broker.
  * The handler is determined based on the topic prefix and suffix.
- * - If the topic starts with "home/" and ends with "/startup", the startupHandler is used.
+ * - If the topic starts with "home/" and ends with "/startup", the message is handed over to the StartupWorker.
+ * - If the topic starts with "home/" and ends with "/status", the device status ("online" or "offline", e.g. as its MQTT Will) is handled.
  */
 func (m *DataModel) Sub(topic string) {
 	// Ajouté le 4/04/2025 à 10h06
 	// DEBUG
 	m.Logger.Debug("Sub subscribing to MQTT topic", slog.String("TOPIC", topic))
 
-	token := m.Broker.Subscribe(topic, m.Broker.qos, m.mqttHandler)
-	token.Wait()
+	m.Broker.AddSubscription(topic, m.mqttHandler)
 }
 
 func (m *DataModel) mqttHandler(client mqtt.Client, msg mqtt.Message) {
+	if msg.Topic() == m.Broker.StatusTopic {
+		// the hub's own status
+		return
+	}
 	if strings.HasPrefix(msg.Topic(), "home/") {
 		if strings.HasSuffix(msg.Topic(), "/startup") {
 			// DEBUG
 			m.Logger.Debug("SUB Dans la boucle subscribing to MQTT startup topic", slog.String("TOPIC", msg.Topic()))
-			m.startupHandler(client, msg)
+			// the setup is replied by the startup worker, after a delay which must not hold the MQTT handler
+			m.Startups.Enqueue(msg)
+		} else if strings.HasSuffix(msg.Topic(), "/"+STATUS_MODULE) {
+			m.statusHandler(client, msg)
+		} else if strings.HasSuffix(msg.Topic(), "/"+COMMAND_SUFFIX) {
+			// the hub's own commands
+			return
+		} else if strings.HasSuffix(msg.Topic(), "/"+ACK_SUFFIX) {
+			m.ackHandler(client, msg)
 		} else {
-			m.dataHandler(client, msg)
+			// the readings and batches are stored by the workers of the ingester, out of the MQTT handler
+			m.Ingester.Enqueue(msg)
 		}
 	} else {
 		m.messageHandler(client, msg)
 	}
 }
 
-func (m *DataModel) dataHandler(client mqtt.Client, msg mqtt.Message) {
+// ingestBatch stores the readings of several modules published at once by a device, see NewBatch, and returns their number.
+func (m *DataModel) ingestBatch(msg mqtt.Message) int {
 	// DEBUG
-	m.Logger.Debug("received MQTT message", slog.String("HANDLER", "dataHandler"), slog.String("TOPIC", msg.Topic()), slog.String("PAYLOAD", string(msg.Payload())))
+	m.Logger.Debug("received batch MQTT message", slog.String("HANDLER", "ingestBatch"), slog.String("TOPIC", msg.Topic()), slog.String("PAYLOAD", string(msg.Payload())))
 
-	data, err := m.NewData(msg)
-	if err != nil {
-		m.Logger.Error(fmt.Errorf("error creating data from MQTT message: %w", err).Error())
-		m.Logger.Warn("aborting data creation")
-		return
+	batch, err := m.NewBatch(msg)
+	if errors.Is(err, ErrDuplicateReading) {
+		m.Logger.Debug("duplicate batch dropped", slog.String("error", err.Error()))
+		return 0
 	}
-	err = m.insert(data)
 	if err != nil {
-		m.Logger.Error(fmt.Errorf("error inserting data: %w", err).Error())
-		m.Logger.Warn("aborting data creation")
+		m.Logger.Error(fmt.Errorf("error ingesting batch MQTT message: %w", err).Error())
+		return 0
 	}
+
+	m.markSeen(&batch[0].Device)
+	for _, data := range batch {
+		m.publishReading(data)
+	}
+	return len(batch)
 }
 
 /**
- * startupHandler handles the startup message from the device.
- * It checks if the device exists in the database and creates it if not.
+ * registerStartup handles the startup message from the device, out of the MQTT handler (see StartupWorker).
+ * It checks if the device exists in the database and creates it if not, then returns it to be sent its setup.
  */
-func (m *DataModel) startupHandler(client mqtt.Client, msg mqtt.Message) {
-	// DEBUG
-	m.Logger.Debug("received startup MQTT message", slog.String("HANDLER", "messageHandler"), slog.String("TOPIC", msg.Topic()), slog.String("PAYLOAD", string(msg.Payload())))
-
-	// Parse the payload into a StartupMessage
-	startupMessage, err := NewStartupMessage(msg.Payload())
-	if err != nil {
-		m.Logger.Error(err.Error())
-		return
-	}
-
+func (m *DataModel) registerStartup(startupMessage *StartupMessage) (*Device, error) {
 	// Convert the StartupMessage into a Device
 	device := startupMessage.ToDevice()
 
 	// Check if the Device exists and create it if not
-	err = m.Check(device)
+	err := m.Check(device)
 	// DEBUG
-	m.Logger.Debug("startupHandler Check if the Device exists and create it if not", slog.String("HANDLER", "messageHandler"), slog.String("TOPIC", msg.Topic()), slog.String("PAYLOAD", string(msg.Payload())))
+	m.Logger.Debug("registerStartup Check if the Device exists and create it if not", slog.String("HANDLER", "startupWorker"), slog.String("DEVICE", device.ID))
 
 	if err != nil {
 		switch {
@@ -85,40 +94,151 @@ func (m *DataModel) startupHandler(client mqtt.Client, msg mqtt.Message) {
 
 			// Create the Device
 			// DEBUG
-			m.Logger.Debug("startupHandler Create the Device", slog.String("HANDLER", "messageHandler"), slog.String("TOPIC", msg.Topic()), slog.String("PAYLOAD", string(msg.Payload())))
+			m.Logger.Debug("registerStartup Create the Device", slog.String("HANDLER", "startupWorker"), slog.String("DEVICE", device.ID))
 
 			result := m.DB.Create(&device)
 			if result.Error != nil {
-				m.Logger.Error(fmt.Errorf("error creating the device: %w", result.Error).Error())
-				return
+				return nil, fmt.Errorf("error creating the device: %w", result.Error)
 			}
 			if result.RowsAffected == 0 {
-				m.Logger.Error(fmt.Errorf("error creating the device: %w", result.Error).Error())
-				return
+				return nil, fmt.Errorf("error creating the device: %d rows affected", result.RowsAffected)
 			}
+
+			m.Events.Publish(Event{
+				Type:       EVENT_DEVICE,
+				DeviceID:   device.ID,
+				LocationID: device.LocationID,
+			})
 		default:
-			m.Logger.Error(err.Error())
-			return
+			return nil, err
 		}
 		// TODO -> what to do after creating the device, if necessary
 	}
 
+	// the modules of the device may have changed with its firmware
+	m.Devices.Cache.Invalidate(device.ID)
+
+	m.markSeen(device)
+
+	return device, nil
+}
+
+// replySetup responds to the startup message of a device with its setup, then sends it its desired module values.
+func (m *DataModel) replySetup(device *Device) {
 	// Create new StartupMessage from device fetched or created
 	responseMessage := NewResponseMessage(device)
 	jsonMessage, err := json.Marshal(responseMessage)
 	if err != nil {
 		m.Logger.Error(fmt.Errorf("error marshaling json: %w", err).Error())
+		return
 	}
 
 	// Respond to the device with the data fetched or created
 	// DEBUG
-	m.Logger.Debug("startupHandler Répondre à l'appareil avec les données récupérées ou créées", slog.String("JSON MESSAGE", string(jsonMessage)))
+	m.Logger.Debug("replySetup Répondre à l'appareil avec les données récupérées ou créées", slog.String("JSON MESSAGE", string(jsonMessage)))
+
+	err = m.Broker.Pub(context.Background(), device.GetChannel(&Setup{}), string(jsonMessage))
+	if err != nil {
+		switch {
+		case errors.Is(err, ErrPublishQueued):
+			m.Logger.Warn("setup response queued until the broker is reachable", slog.String("device", device.ID))
+		default:
+			m.Logger.Error(fmt.Errorf("error sending the setup response to device %s: %w", device.ID, err).Error())
+		}
+	}
+
+	m.restoreDesired(device)
+}
+
+/**
+ * restoreDesired sends again the desired values of the modules of a device which (re)started,
+ * so that it comes back in the state which was asked for rather than its default one.
+ */
+func (m *DataModel) restoreDesired(device *Device) {
+	for i := range device.Modules {
+		module := &device.Modules[i]
+		if module.Desired == nil {
+			continue
+		}
+
+		m.Logger.Debug("restoring desired module value", slog.String("device", device.ID), slog.String("module", module.Name), slog.String("desired", *module.Desired))
+
+		_, err := m.Commands.Send(context.Background(), device, module, *module.Desired)
+		if err != nil && !errors.Is(err, ErrPublishQueued) {
+			m.Logger.Error(fmt.Errorf("error restoring module %s of device %s: %w", module.Name, device.ID, err).Error())
+		}
+	}
+}
+
+/**
+ * statusHandler handles the status published by a device, or by the broker on its behalf with its Will.
+ * "online" and "offline" set the device status immediately, without waiting for the heartbeat timeout.
+ */
+func (m *DataModel) statusHandler(client mqtt.Client, msg mqtt.Message) {
+	// DEBUG
+	m.Logger.Debug("received status MQTT message", slog.String("HANDLER", "statusHandler"), slog.String("TOPIC", msg.Topic()), slog.String("PAYLOAD", string(msg.Payload())))
+
+	channelElems := strings.Split(msg.Topic(), "/")
+	if len(channelElems) != 6 {
+		m.Logger.Warn("invalid status channel format", slog.String("TOPIC", msg.Topic()))
+		return
+	}
+	deviceID := channelElems[4]
+
+	var device Device
+	err := m.DB.First(&device, "id = ?", deviceID).Error
+	if err != nil {
+		m.Logger.Error(fmt.Errorf("error finding device %s: %w", deviceID, err).Error())
+		return
+	}
+
+	switch strings.ToLower(strings.TrimSpace(string(msg.Payload()))) {
+	case DEVICE_ONLINE:
+		m.markSeen(&device)
+	case DEVICE_OFFLINE:
+		m.markOffline(&device)
+	default:
+		m.Logger.Warn("unknown device status", slog.String("TOPIC", msg.Topic()), slog.String("PAYLOAD", string(msg.Payload())))
+	}
+}
+
+/**
+ * ackHandler handles the acknowledgement of a command by a device, on the "ack" suffix of the module channel.
+ * The acknowledgements of the commands already finished, e.g. of a retry, are ignored.
+ */
+func (m *DataModel) ackHandler(client mqtt.Client, msg mqtt.Message) {
 	// DEBUG
-	m.Logger.Debug("startupHandler Valeur du Topic", slog.String("TOPIC", msg.Topic()))
+	m.Logger.Debug("received ack MQTT message", slog.String("HANDLER", "ackHandler"), slog.String("TOPIC", msg.Topic()), slog.String("PAYLOAD", string(msg.Payload())))
+
+	channelElems := strings.Split(msg.Topic(), "/")
+	if len(channelElems) != 7 {
+		m.Logger.Warn("invalid ack channel format", slog.String("TOPIC", msg.Topic()))
+		return
+	}
+	deviceID := channelElems[4]
+
+	ack, err := NewAckMessage(msg.Payload())
+	if err != nil {
+		m.Logger.Error(err.Error(), slog.String("TOPIC", msg.Topic()))
+		return
+	}
 
-	// Il faut peut être modifier le startup en setup dans le msg.Topic
-	// msg.Topic()= strings.Replace(msg.Topic(), "startup", "setup", 1)
-	m.Broker.Pub(device.GetChannel(&Setup{}), string(jsonMessage))
+	command, done, err := m.Commands.Ack(deviceID, ack)
+	if err != nil {
+		m.Logger.Error(fmt.Errorf("error acknowledging command: %w", err).Error())
+		return
+	}
+	if !done {
+		m.Logger.Debug("ack of a finished command ignored", slog.String("command", command.ID), slog.String("status", command.Status))
+		return
+	}
+
+	// the device answers, so it is online
+	m.markSeen(&Device{ID: command.DeviceID, LocationID: command.LocationID})
+
+	if command.Status == COMMAND_FAILED {
+		m.Logger.Warn("command failed on device", slog.String("command", command.ID), slog.String("device", command.DeviceID), slog.String("module", command.Module), slog.String("error", command.Error))
+	}
 }
 
 func (m *DataModel) messageHandler(client mqtt.Client, msg mqtt.Message) {
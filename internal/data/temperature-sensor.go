@@ -1,13 +1,30 @@
 package data
 
 import (
-	"strconv"
-	
 	"gorm.io/gorm"
 )
 
 const TEMPERATURE_SENSOR = "temperatureSensor"
 
+func init() {
+	RegisterModuleType(ModuleType{
+		Name:     TEMPERATURE_SENSOR,
+		Kind:     KIND_NUMERIC,
+		Unit:     "°C",
+		Writable: false,
+		Parse:    parseFloat,
+		Encode:   encodeFloat,
+		New: func(module *Module, value any) IModule {
+			return TemperatureSensor{
+				Model:        module.Model,
+				DeviceID:     module.DeviceID,
+				Name:         module.Name,
+				ValueDegrees: value.(float64),
+			}
+		},
+	})
+}
+
 type TemperatureSensor struct {
 	gorm.Model
 	DeviceID     string `gorm:"index"`
@@ -22,17 +39,3 @@ func (t TemperatureSensor) GetValue() any {
 func (t TemperatureSensor) GetName() string {
 	return t.Name
 }
-
-type TemperatureSensorModel struct {
-	DB     *gorm.DB
-	Broker *Broker
-}
-
-func (m *TemperatureSensorModel) Set(channel string, value any) error {
-	floatValue, err := ToFloat(value)
-	if err != nil {
-		return err
-	}
-	m.Broker.Pub(channel, strconv.FormatFloat(floatValue, 'f', 2, 64))
-	return nil
-}
@@ -0,0 +1,101 @@
+package data
+
+import (
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"fmt"
+	"time"
+
+	"gorm.io/gorm"
+	"gorm.io/gorm/clause"
+)
+
+// Scopes of the tokens
+const (
+	SCOPE_PASSWORD_RESET = "password-reset"
+)
+
+// Token is a single-use secret sent to a user. Only its SHA-256 hash is stored.
+type Token struct {
+	Hash      []byte `gorm:"primaryKey"`
+	UserID    uint   `gorm:"index"`
+	User      User   `gorm:"constraint:OnDelete:CASCADE"`
+	Scope     string
+	Expiry    time.Time
+	Plaintext string `gorm:"-"`
+}
+
+type TokenModel struct {
+	DB *gorm.DB
+}
+
+// generateToken creates a token with 64 random bytes, encoded as an 86 characters long string.
+func generateToken(userID uint, ttl time.Duration, scope string) (*Token, error) {
+	randomBytes := make([]byte, 64)
+	_, err := rand.Read(randomBytes)
+	if err != nil {
+		return nil, err
+	}
+
+	token := &Token{
+		UserID:    userID,
+		Scope:     scope,
+		Expiry:    time.Now().Add(ttl),
+		Plaintext: base64.RawURLEncoding.EncodeToString(randomBytes),
+	}
+	hash := sha256.Sum256([]byte(token.Plaintext))
+	token.Hash = hash[:]
+
+	return token, nil
+}
+
+// New creates and stores a new token, replacing the previous tokens of the user with the same scope.
+func (m *TokenModel) New(userID uint, ttl time.Duration, scope string) (*Token, error) {
+	token, err := generateToken(userID, ttl, scope)
+	if err != nil {
+		return nil, fmt.Errorf("error generating token: %w", err)
+	}
+
+	err = m.DB.Transaction(func(tx *gorm.DB) error {
+		err := tx.Where("scope = ? AND user_id = ?", scope, userID).Delete(&Token{}).Error
+		if err != nil {
+			return err
+		}
+		return tx.Omit("User").Create(token).Error
+	})
+	if err != nil {
+		return nil, fmt.Errorf("error creating token: %w", err)
+	}
+
+	return token, nil
+}
+
+/**
+ * consumeToken deletes a valid (not expired) token of the given scope and returns the ID of its user.
+ * The token is looked up and deleted in a single statement, so that it can only be used once.
+ */
+func consumeToken(db *gorm.DB, scope, plaintext string) (uint, error) {
+	hash := sha256.Sum256([]byte(plaintext))
+
+	var tokens []Token
+	err := db.Clauses(clause.Returning{Columns: []clause.Column{{Name: "user_id"}}}).
+		Where("hash = ? AND scope = ? AND expiry > ?", hash[:], scope, time.Now()).
+		Delete(&tokens).Error
+	if err != nil {
+		return 0, fmt.Errorf("failed to consume token: %w", err)
+	}
+	if len(tokens) == 0 {
+		return 0, fmt.Errorf("token: %w", ErrRecordNotFound)
+	}
+
+	return tokens[0].UserID, nil
+}
+
+func (m *TokenModel) DeleteAllForUser(scope string, userID uint) error {
+	err := m.DB.Where("scope = ? AND user_id = ?", scope, userID).Delete(&Token{}).Error
+	if err != nil {
+		return fmt.Errorf("error deleting tokens of user %d: %w", userID, err)
+	}
+	return nil
+}
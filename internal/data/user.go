@@ -0,0 +1,291 @@
+package data
+
+import (
+	"errors"
+	"fmt"
+	"strings"
+
+	"HomeIoT/internal/validator"
+
+	"golang.org/x/crypto/bcrypt"
+	"gorm.io/gorm"
+)
+
+var (
+	// ErrDuplicateEmail is returned when registering a user with an email already in use.
+	ErrDuplicateEmail = errors.New("duplicate email")
+
+	// ErrInvalidCredentials is returned when the email or the password of a user is wrong.
+	ErrInvalidCredentials = errors.New("invalid credentials")
+
+	// ErrRegistrationClosed is returned when registering the first user while a user already exists.
+	ErrRegistrationClosed = errors.New("registration closed")
+)
+
+// Roles of the users, see PolicyModel.Can for what each role may do
+const (
+	ROLE_ADMIN    = "admin"
+	ROLE_RESIDENT = "resident"
+	ROLE_GUEST    = "guest"
+)
+
+var Roles = []string{ROLE_ADMIN, ROLE_RESIDENT, ROLE_GUEST}
+
+type User struct {
+	gorm.Model
+	Name           string
+	Email          string `gorm:"uniqueIndex"`
+	HashedPassword []byte
+	Role           string `gorm:"default:guest"`
+	Version        int    `gorm:"default:1"`
+}
+
+type UserModel struct {
+	DB *gorm.DB
+}
+
+func ValidateUser(v *validator.Validator, user *User) {
+	v.StringCheck(user.Name, 2, 70, true, "name")
+	v.ValidateEmail(user.Email)
+	v.Check(validator.PermittedValue(user.Role, Roles...), "role", "must be admin, resident or guest")
+}
+
+func (m *UserModel) Insert(user *User, password string) error {
+	err := hashPassword(user, password)
+	if err != nil {
+		return err
+	}
+	return insertUser(m.DB, user)
+}
+
+/**
+ * InsertFirst creates the first user, which administers the system, or returns ErrRegistrationClosed if a user exists.
+ * The users table is locked until the user is created, so that two concurrent registrations cannot both be the first.
+ */
+func (m *UserModel) InsertFirst(user *User, password string) error {
+	err := hashPassword(user, password)
+	if err != nil {
+		return err
+	}
+	user.Role = ROLE_ADMIN
+
+	return m.DB.Transaction(func(tx *gorm.DB) error {
+		err := tx.Exec("LOCK TABLE users IN EXCLUSIVE MODE").Error
+		if err != nil {
+			return fmt.Errorf("error locking users: %w", err)
+		}
+
+		var count int64
+		err = tx.Model(&User{}).Count(&count).Error
+		if err != nil {
+			return fmt.Errorf("error counting users: %w", err)
+		}
+		if count > 0 {
+			return ErrRegistrationClosed
+		}
+
+		return insertUser(tx, user)
+	})
+}
+
+// hashPassword sets the hashed password of a user, whose email is stored in lower case.
+func hashPassword(user *User, password string) error {
+	hashedPassword, err := bcrypt.GenerateFromPassword([]byte(password), 12)
+	if err != nil {
+		return fmt.Errorf("error hashing password: %w", err)
+	}
+	user.Email = strings.ToLower(user.Email)
+	user.HashedPassword = hashedPassword
+	return nil
+}
+
+func insertUser(db *gorm.DB, user *User) error {
+	var count int64
+	err := db.Model(&User{}).Where("email = ?", user.Email).Count(&count).Error
+	if err != nil {
+		return fmt.Errorf("error checking email: %w", err)
+	}
+	if count > 0 {
+		return ErrDuplicateEmail
+	}
+
+	result := db.Create(user)
+	if result.Error != nil {
+		return fmt.Errorf("could not create user: %w", result.Error)
+	}
+	if result.RowsAffected == 0 {
+		return fmt.Errorf("could not create user: %d rows affected", result.RowsAffected)
+	}
+	return nil
+}
+
+/**
+ * Authenticate checks the email and password of a user and returns the matching user.
+ * It returns ErrInvalidCredentials if the user does not exist or the password is wrong.
+ */
+func (m *UserModel) Authenticate(email, password string) (*User, error) {
+	var user User
+	err := m.DB.Where("email = ?", strings.ToLower(email)).First(&user).Error
+	if err != nil {
+		switch {
+		case errors.Is(err, gorm.ErrRecordNotFound):
+			return nil, ErrInvalidCredentials
+		default:
+			return nil, fmt.Errorf("error fetching user: %w", err)
+		}
+	}
+
+	err = bcrypt.CompareHashAndPassword(user.HashedPassword, []byte(password))
+	if err != nil {
+		switch {
+		case errors.Is(err, bcrypt.ErrMismatchedHashAndPassword):
+			return nil, ErrInvalidCredentials
+		default:
+			return nil, fmt.Errorf("error checking password: %w", err)
+		}
+	}
+
+	return &user, nil
+}
+
+func (m *UserModel) Get(id uint) (*User, error) {
+	var user User
+	err := m.DB.First(&user, id).Error
+	if err != nil {
+		switch {
+		case errors.Is(err, gorm.ErrRecordNotFound):
+			return nil, fmt.Errorf("user with id %d: %w", id, ErrRecordNotFound)
+		default:
+			return nil, fmt.Errorf("failed to get user with id %d: %w", id, err)
+		}
+	}
+	return &user, nil
+}
+
+func (m *UserModel) GetAll() ([]*User, error) {
+	var users []*User
+	err := m.DB.Order("id").Find(&users).Error
+	if err != nil {
+		return nil, fmt.Errorf("failed to get users: %w", err)
+	}
+	return users, nil
+}
+
+func (m *UserModel) GetByEmail(email string) (*User, error) {
+	var user User
+	err := m.DB.Where("email = ?", strings.ToLower(email)).First(&user).Error
+	if err != nil {
+		switch {
+		case errors.Is(err, gorm.ErrRecordNotFound):
+			return nil, fmt.Errorf("user with email %s: %w", email, ErrRecordNotFound)
+		default:
+			return nil, fmt.Errorf("failed to get user with email %s: %w", email, err)
+		}
+	}
+	return &user, nil
+}
+
+/**
+ * UpdatePassword sets a new password for the user and increments its version,
+ * which invalidates every session opened with the previous password.
+ */
+func (m *UserModel) UpdatePassword(user *User, password string) error {
+	hashedPassword, err := bcrypt.GenerateFromPassword([]byte(password), 12)
+	if err != nil {
+		return fmt.Errorf("error hashing password: %w", err)
+	}
+
+	err = updatePassword(m.DB, user, hashedPassword)
+	if err != nil {
+		return err
+	}
+	user.HashedPassword = hashedPassword
+	user.Version++
+
+	return nil
+}
+
+/**
+ * ResetPassword consumes a password reset token and sets the new password of its user, see UpdatePassword.
+ * The token is consumed in the same transaction as the password update, it returns ErrRecordNotFound
+ * if the token is invalid, expired or already used.
+ */
+func (m *UserModel) ResetPassword(plaintext, password string) (*User, error) {
+	hashedPassword, err := bcrypt.GenerateFromPassword([]byte(password), 12)
+	if err != nil {
+		return nil, fmt.Errorf("error hashing password: %w", err)
+	}
+
+	var user User
+	err = m.DB.Transaction(func(tx *gorm.DB) error {
+		userID, err := consumeToken(tx, SCOPE_PASSWORD_RESET, plaintext)
+		if err != nil {
+			return err
+		}
+
+		// the other reset links sent to the user are not valid anymore either
+		err = tx.Where("scope = ? AND user_id = ?", SCOPE_PASSWORD_RESET, userID).Delete(&Token{}).Error
+		if err != nil {
+			return fmt.Errorf("error deleting tokens of user %d: %w", userID, err)
+		}
+
+		err = tx.First(&user, userID).Error
+		if err != nil {
+			return fmt.Errorf("failed to get user %d: %w", userID, err)
+		}
+		return updatePassword(tx, &user, hashedPassword)
+	})
+	if err != nil {
+		return nil, err
+	}
+	user.HashedPassword = hashedPassword
+	user.Version++
+
+	return &user, nil
+}
+
+func updatePassword(db *gorm.DB, user *User, hashedPassword []byte) error {
+	err := db.Model(user).Updates(map[string]any{
+		"hashed_password": hashedPassword,
+		"version":         gorm.Expr("version + 1"),
+	}).Error
+	if err != nil {
+		return fmt.Errorf("error updating user password: %w", err)
+	}
+	return nil
+}
+
+func (m *UserModel) UpdateRole(user *User) error {
+	err := m.DB.Model(&User{}).Where("id = ?", user.ID).Update("role", user.Role).Error
+	if err != nil {
+		return fmt.Errorf("error updating user role: %w", err)
+	}
+	return nil
+}
+
+func (m *UserModel) Count() (int64, error) {
+	var count int64
+	err := m.DB.Model(&User{}).Count(&count).Error
+	if err != nil {
+		return 0, fmt.Errorf("error counting users: %w", err)
+	}
+	return count, nil
+}
+
+// EnsureAdmin promotes the oldest user to admin when no admin exists, so that the system can always be administered.
+func (m *UserModel) EnsureAdmin() error {
+	var count int64
+	err := m.DB.Model(&User{}).Where("role = ?", ROLE_ADMIN).Count(&count).Error
+	if err != nil {
+		return fmt.Errorf("error counting admins: %w", err)
+	}
+	if count > 0 {
+		return nil
+	}
+
+	err = m.DB.Model(&User{}).Where("id = (?)", m.DB.Model(&User{}).Select("MIN(id)")).Update("role", ROLE_ADMIN).Error
+	if err != nil {
+		return fmt.Errorf("error promoting admin: %w", err)
+	}
+	return nil
+}
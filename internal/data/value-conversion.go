@@ -16,7 +16,12 @@ func ToBool(value any) (bool, error) {
 		if err != nil {
 			return boolValue, err
 		}
-	case int, float64:
+	case int:
+		if value != 0 && value != 1 {
+			return boolValue, fmt.Errorf("cannot convert value %v to bool", value)
+		}
+		boolValue = value != 0
+	case float64:
 		if value != 0 && value != 1 {
 			return boolValue, fmt.Errorf("cannot convert value %v to bool", value)
 		}
@@ -42,9 +47,10 @@ func ToFloat(value any) (float64, error) {
 		if err != nil {
 			return floatValue, err
 		}
-	case int, float64:
-		floatValue = value.(float64)
-		return floatValue, nil
+	case int:
+		floatValue = float64(value)
+	case float64:
+		floatValue = value
 	default:
 		return floatValue, fmt.Errorf("cannot convert value %v with type %T to float64", value, value)
 	}
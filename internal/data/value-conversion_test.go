@@ -0,0 +1,57 @@
+package data
+
+import "testing"
+
+func TestToBool(t *testing.T) {
+	tests := []struct {
+		name    string
+		value   any
+		want    bool
+		wantErr bool
+	}{
+		{"true", true, true, false},
+		{"false", false, false, false},
+		{"string true", "true", true, false},
+		{"string zero", "0", false, false},
+		{"int one", 1, true, false},
+		{"int zero", 0, false, false},
+		{"JSON one", float64(1), true, false},
+		{"JSON zero", float64(0), false, false},
+		{"int two", 2, false, true},
+		{"JSON half", 0.5, false, true},
+		{"JSON two", float64(2), false, true},
+		{"invalid string", "on", false, true},
+		{"nil", nil, false, true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := ToBool(tt.value)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("ToBool(%v) error = %v, want error: %v", tt.value, err, tt.wantErr)
+			}
+			if got != tt.want {
+				t.Errorf("ToBool(%v) = %v, want %v", tt.value, got, tt.want)
+			}
+		})
+	}
+}
+
+func TestEncodeNumericBool(t *testing.T) {
+	tests := []struct {
+		value any
+		want  string
+	}{
+		{float64(1), "true"},
+		{float64(0), "false"},
+		{1, "true"},
+		{0, "false"},
+	}
+
+	for _, tt := range tests {
+		got, err := encodeBool(tt.value)
+		if err != nil || got != tt.want {
+			t.Errorf("encodeBool(%v) = %q, %v, want %q", tt.value, got, err, tt.want)
+		}
+	}
+}
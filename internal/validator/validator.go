@@ -63,6 +63,9 @@ func (v *Validator) AddNonFieldError(message string) {
 //	key - The field name
 //	message - The error message to add
 func (v *Validator) AddFieldError(key, message string) {
+	if v.FieldErrors == nil {
+		v.FieldErrors = make(map[string]string)
+	}
 	if _, exists := v.FieldErrors[key]; !exists {
 		v.FieldErrors[key] = message
 	}